@@ -0,0 +1,291 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gobwas/glob"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+var ErrUnauthorized = errors.New("invalid user or password")
+var ErrUserNotFound = errors.New("user not found")
+var ErrUnknownPermission = errors.New("permission must be one of read, write or admin")
+var ErrEmptyUser = errors.New("user name and password must be set")
+var ErrBadKeyPattern = errors.New("key pattern must be a valid glob")
+var ErrBadHash = errors.New("password hash must be bcrypt")
+
+type Permission string
+
+const (
+	Read  Permission = "read"
+	Write Permission = "write"
+	Admin Permission = "admin"
+)
+
+// Principal is an authenticated caller, either ACL user or token claims.
+type Principal interface {
+	Identity() string
+	Allows(cmd string, perm Permission) bool
+	CanAccess(key string) bool
+	CanAccessAll() bool
+}
+
+// PasswordCost is the bcrypt work factor of new password hashes.
+var PasswordCost = bcrypt.DefaultCost
+
+// User is an account of the cache. Password is never stored, only its
+// bcrypt hash. Keys holds glob patterns of accessible keys, empty list
+// grants access to every key.
+type User struct {
+	Name        string       `json:"name"`
+	Hash        string       `json:"hash,omitempty"`
+	Permissions []Permission `json:"permissions"`
+	Keys        []string     `json:"keys,omitempty"`
+
+	globs []glob.Glob
+}
+
+func (u *User) SetPassword(pass string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), PasswordCost)
+	if err != nil {
+		return err
+	}
+	u.Hash = string(hash)
+	return nil
+}
+
+func (u *User) CheckPassword(pass string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.Hash), []byte(pass)) == nil
+}
+
+var dummy struct {
+	once sync.Once
+	hash []byte
+}
+
+// dummyHash is checked for unknown users, so that they take as long as
+// known ones with a wrong password.
+func dummyHash() []byte {
+	dummy.once.Do(func() {
+		dummy.hash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), PasswordCost)
+	})
+	return dummy.hash
+}
+
+func (u *User) Identity() string {
+	return u.Name
+}
+
+// Allows grants user every command covered by its permissions.
+func (u *User) Allows(cmd string, perm Permission) bool {
+	return u.Can(perm)
+}
+
+// Can reports whether user has permission p, admin implies all of them.
+func (u *User) Can(p Permission) bool {
+	for _, granted := range u.Permissions {
+		if granted == p || granted == Admin {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) CanAccess(key string) bool {
+	if u.CanAccessAll() {
+		return true
+	}
+	for _, g := range u.globs {
+		if g.Match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) CanAccessAll() bool {
+	return len(u.Keys) == 0
+}
+
+func (u *User) compile() error {
+	for _, p := range u.Permissions {
+		if p != Read && p != Write && p != Admin {
+			return ErrUnknownPermission
+		}
+	}
+	globs := make([]glob.Glob, 0, len(u.Keys))
+	for _, pattern := range u.Keys {
+		g, err := glob.Compile(pattern)
+		if err != nil {
+			return ErrBadKeyPattern
+		}
+		globs = append(globs, g)
+	}
+	u.globs = globs
+	return nil
+}
+
+// public returns a copy of user without credentials.
+func (u *User) public() User {
+	return User{
+		Name:        u.Name,
+		Permissions: u.Permissions,
+		Keys:        u.Keys,
+	}
+}
+
+type aclFile struct {
+	Users []*User `json:"users"`
+}
+
+// ACL keeps users in memory and saves them to the file it was loaded from.
+type ACL struct {
+	mx    sync.RWMutex
+	path  string
+	users map[string]*User
+}
+
+func NewACL(path string) *ACL {
+	return &ACL{
+		mx:    sync.RWMutex{},
+		path:  path,
+		users: make(map[string]*User),
+	}
+}
+
+// LoadACL reads users from path, missing file gives an empty ACL
+// which will be created on the first save.
+func LoadACL(path string) (*ACL, error) {
+	acl := NewACL(path)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return acl, nil
+		}
+		return nil, err
+	}
+	var f aclFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	for _, u := range f.Users {
+		if err := u.compile(); err != nil {
+			return nil, err
+		}
+		if _, err := bcrypt.Cost([]byte(u.Hash)); err != nil {
+			return nil, ErrBadHash
+		}
+		acl.users[u.Name] = u
+	}
+	return acl, nil
+}
+
+// Reload replaces users with the ones from the file, e.g. after the
+// file is edited by hand. Users are kept if the file is broken.
+func (a *ACL) Reload() error {
+	if a.path == "" {
+		return nil
+	}
+	fresh, err := LoadACL(a.path)
+	if err != nil {
+		return err
+	}
+	a.Replace(fresh)
+	return nil
+}
+
+// Replace takes the users of fresh, so that they can be loaded by
+// LoadACL first and applied later along with other settings.
+func (a *ACL) Replace(fresh *ACL) {
+	fresh.mx.RLock()
+	users := make(map[string]*User, len(fresh.users))
+	for name, u := range fresh.users {
+		users[name] = u
+	}
+	fresh.mx.RUnlock()
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	a.users = users
+}
+
+func (a *ACL) Authenticate(name, pass string) (*User, error) {
+	a.mx.RLock()
+	u, ok := a.users[name]
+	a.mx.RUnlock()
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(pass))
+		return nil, ErrUnauthorized
+	}
+	if !u.CheckPassword(pass) {
+		return nil, ErrUnauthorized
+	}
+	return u, nil
+}
+
+func (a *ACL) Len() int {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	return len(a.users)
+}
+
+func (a *ACL) Users() []User {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	users := make([]User, 0, len(a.users))
+	for _, u := range a.users {
+		users = append(users, u.public())
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+	return users
+}
+
+// SetUser adds or replaces user with the given password and saves the ACL.
+func (a *ACL) SetUser(u *User, pass string) error {
+	if u.Name == "" || pass == "" {
+		return ErrEmptyUser
+	}
+	if err := u.compile(); err != nil {
+		return err
+	}
+	if err := u.SetPassword(pass); err != nil {
+		return err
+	}
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	a.users[u.Name] = u
+	return a.save()
+}
+
+func (a *ACL) RemoveUser(name string) error {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	if _, ok := a.users[name]; !ok {
+		return ErrUserNotFound
+	}
+	delete(a.users, name)
+	return a.save()
+}
+
+func (a *ACL) save() error {
+	if a.path == "" {
+		return nil
+	}
+	f := aclFile{Users: make([]*User, 0, len(a.users))}
+	for _, u := range a.users {
+		f.Users = append(f.Users, u)
+	}
+	sort.Slice(f.Users, func(i, j int) bool {
+		return f.Users[i].Name < f.Users[j].Name
+	})
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(a.path, data, 0600)
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUserPermissions(t *testing.T) {
+	r := require.New(t)
+	reader := &User{Name: "reader", Permissions: []Permission{Read}, Keys: []string{"user:*"}}
+	r.NoError(reader.compile())
+	r.True(reader.Can(Read))
+	r.False(reader.Can(Write))
+	r.True(reader.CanAccess("user:42"))
+	r.False(reader.CanAccess("session:42"))
+	r.False(reader.CanAccessAll())
+	admin := &User{Name: "admin", Permissions: []Permission{Admin}}
+	r.NoError(admin.compile())
+	r.True(admin.Can(Write))
+	r.True(admin.CanAccess("session:42"))
+	bad := &User{Name: "bad", Permissions: []Permission{"root"}}
+	r.Equal(ErrUnknownPermission, bad.compile())
+}
+
+func TestACL(t *testing.T) {
+	r := require.New(t)
+	path := filepath.Join(os.TempDir(), "rediq-acl.json")
+	defer os.Remove(path)
+	os.Remove(path)
+	acl, err := LoadACL(path)
+	r.NoError(err)
+	r.Equal(0, acl.Len())
+	r.NoError(acl.SetUser(&User{Name: "alice", Permissions: []Permission{Write}}, "secret"))
+	r.Equal(ErrEmptyUser, acl.SetUser(&User{Name: "bob"}, ""))
+
+	info, err := os.Stat(path)
+	r.NoError(err)
+	r.Equal(os.FileMode(0600), info.Mode().Perm())
+	alice := acl.users["alice"]
+	r.True(strings.HasPrefix(alice.Hash, "$2"))
+
+	loaded, err := LoadACL(path)
+	r.NoError(err)
+	u, err := loaded.Authenticate("alice", "secret")
+	r.NoError(err)
+	r.True(u.Can(Write))
+	_, err = loaded.Authenticate("alice", "wrong")
+	r.Equal(ErrUnauthorized, err)
+	_, err = loaded.Authenticate("mallory", "secret")
+	r.Equal(ErrUnauthorized, err)
+	users := loaded.Users()
+	r.Len(users, 1)
+	r.Empty(users[0].Hash)
+	r.NoError(loaded.RemoveUser("alice"))
+	r.Equal(ErrUserNotFound, loaded.RemoveUser("alice"))
+
+	// acl still has alice until it is reloaded
+	_, err = acl.Authenticate("alice", "secret")
+	r.NoError(err)
+	r.NoError(acl.Reload())
+	r.Equal(0, acl.Len())
+	fresh := NewACL("")
+	r.NoError(fresh.SetUser(&User{Name: "bob", Permissions: []Permission{Read}}, "secret"))
+	acl.Replace(fresh)
+	_, err = acl.Authenticate("bob", "secret")
+	r.NoError(err)
+	r.NoError(ioutil.WriteFile(path, []byte("{"), 0600))
+	r.Error(loaded.Reload())
+}
+
+func TestBadHash(t *testing.T) {
+	r := require.New(t)
+	path := filepath.Join(os.TempDir(), "rediq-acl-sha256.json")
+	defer os.Remove(path)
+	// salted sha256 hashes are not accepted, users must be set again
+	data := `{"users":[{"name":"carol","salt":"salt","hash":"9a6b2d9d3ab10bf1e41da7a0b46e3ff8b1c9a5e7d5d8c1b2e5f3f1c4b1a2d3e4","permissions":["read"]}]}`
+	r.NoError(ioutil.WriteFile(path, []byte(data), 0600))
+	_, err := LoadACL(path)
+	r.Equal(ErrBadHash, err)
+}
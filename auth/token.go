@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrTokenMalformed = errors.New("token is malformed")
+var ErrTokenSignature = errors.New("token signature is invalid")
+var ErrTokenExpired = errors.New("token is expired")
+var ErrTokenAlgorithm = errors.New("token must be signed with HS256")
+
+// jwtHeader is the header of minted tokens. Verify accepts any header
+// of a JWT signed with HS256, e.g. with other fields or their order.
+const jwtHeader = `{"alg":"HS256","typ":"JWT"}`
+
+type header struct {
+	Alg string `json:"alg"`
+}
+
+// Claims of a bearer token. Commands holds command names (get, set, ...)
+// or permissions (read, write, admin) granting a group of commands.
+// Prefixes limits accessible keys, empty list grants every key.
+type Claims struct {
+	Subject   string   `json:"sub"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+	Commands  []string `json:"cmd"`
+	Prefixes  []string `json:"pfx,omitempty"`
+}
+
+func (c *Claims) Identity() string {
+	return c.Subject
+}
+
+func (c *Claims) Allows(cmd string, perm Permission) bool {
+	for _, granted := range c.Commands {
+		if granted == cmd || Permission(granted) == perm || Permission(granted) == Admin {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Claims) CanAccess(key string) bool {
+	if c.CanAccessAll() {
+		return true
+	}
+	for _, prefix := range c.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Claims) CanAccessAll() bool {
+	return len(c.Prefixes) == 0
+}
+
+// Mint signs claims issued now and expiring after ttl.
+func Mint(secret []byte, c Claims, ttl time.Duration) (string, error) {
+	now := time.Now()
+	c.IssuedAt = now.Unix()
+	c.ExpiresAt = now.Add(ttl).Unix()
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	unsigned := encodeSegment([]byte(jwtHeader)) + "." + encodeSegment(payload)
+	return unsigned + "." + sign(secret, unsigned), nil
+}
+
+func Verify(secret []byte, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenMalformed
+	}
+	raw, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, ErrTokenMalformed
+	}
+	var h header
+	if err := json.Unmarshal(raw, &h); err != nil {
+		return nil, ErrTokenMalformed
+	}
+	if h.Alg != "HS256" {
+		return nil, ErrTokenAlgorithm
+	}
+	expected := sign(secret, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return nil, ErrTokenSignature
+	}
+	payload, err := decodeSegment(parts[1])
+	if err != nil {
+		return nil, ErrTokenMalformed
+	}
+	var c Claims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, ErrTokenMalformed
+	}
+	if time.Now().Unix() >= c.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+	return &c, nil
+}
+
+func sign(secret []byte, unsigned string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return encodeSegment(mac.Sum(nil))
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	r := require.New(t)
+	secret := []byte("secret")
+	token, err := Mint(secret, Claims{
+		Subject:  "alice",
+		Commands: []string{"get", "write"},
+		Prefixes: []string{"user:"},
+	}, time.Minute)
+	r.NoError(err)
+	claims, err := Verify(secret, token)
+	r.NoError(err)
+	r.Equal("alice", claims.Identity())
+	r.True(claims.Allows("get", Read))
+	r.True(claims.Allows("set", Write))
+	r.False(claims.Allows("keys", Read))
+	r.True(claims.CanAccess("user:42"))
+	r.False(claims.CanAccess("session:42"))
+
+	_, err = Verify([]byte("wrong"), token)
+	r.Equal(ErrTokenSignature, err)
+	_, err = Verify(secret, strings.TrimSuffix(token, token[len(token)-2:]))
+	r.Equal(ErrTokenSignature, err)
+	_, err = Verify(secret, "garbage")
+	r.Equal(ErrTokenMalformed, err)
+	expired, err := Mint(secret, Claims{Subject: "alice"}, -time.Second)
+	r.NoError(err)
+	_, err = Verify(secret, expired)
+	r.Equal(ErrTokenExpired, err)
+}
+
+func TestTokenHeader(t *testing.T) {
+	r := require.New(t)
+	secret := []byte("secret")
+	token, err := Mint(secret, Claims{Subject: "alice"}, time.Minute)
+	r.NoError(err)
+	payload := strings.Split(token, ".")[1]
+	signed := func(header string) string {
+		unsigned := encodeSegment([]byte(header)) + "." + payload
+		return unsigned + "." + sign(secret, unsigned)
+	}
+	claims, err := Verify(secret, signed(`{"typ":"JWT","kid":"1","alg":"HS256"}`))
+	r.NoError(err)
+	r.Equal("alice", claims.Subject)
+	_, err = Verify(secret, signed(`{"alg":"none","typ":"JWT"}`))
+	r.Equal(ErrTokenAlgorithm, err)
+	_, err = Verify(secret, encodeSegment([]byte(`{"alg":"none"}`))+"."+payload+".")
+	r.Equal(ErrTokenAlgorithm, err)
+	_, err = Verify(secret, signed(`{"alg":"HS512","typ":"JWT"}`))
+	r.Equal(ErrTokenAlgorithm, err)
+	_, err = Verify(secret, signed(`not json`))
+	r.Equal(ErrTokenMalformed, err)
+}
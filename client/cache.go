@@ -0,0 +1,369 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Phil192/rediq/storage"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout    = 10 * time.Second
+	defaultRetries    = 2
+	defaultBackoff    = 50 * time.Millisecond
+	defaultMaxBackoff = 2 * time.Second
+	defaultMaxIdle    = 64
+	defaultIdle       = 90 * time.Second
+)
+
+// Client is a typed client of one namespace, it is safe for concurrent
+// use. Missing keys are reported with storage.ErrNotFound and other
+// failed requests with *StatusError, which matches ErrForbidden and
+// friends with errors.Is. Requests are retried, see Retry, so all of
+// them must be idempotent, as the keyspace commands are.
+type Client struct {
+	conn *cacheClient
+	ns   string
+	// near is nil unless enabled by NearCache
+	near *nearCache
+
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// New connects to the server at addr like http://host:8081, by default
+// with 10s timeout, 2 retries and up to 64 idle connections.
+func New(addr string, opts ...clientOpt) (*Client, error) {
+	opt := &clientOptions{
+		timeout:     defaultTimeout,
+		retries:     defaultRetries,
+		backoff:     defaultBackoff,
+		maxBackoff:  defaultMaxBackoff,
+		maxIdle:     defaultMaxIdle,
+		idleTimeout: defaultIdle,
+	}
+	for _, o := range opts {
+		if o != nil {
+			o(opt)
+		}
+	}
+	conn, err := newCacheClient(strings.TrimSuffix(addr, "/"), opt.login, opt.pass, opt)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		conn:       conn,
+		retries:    opt.retries,
+		backoff:    opt.backoff,
+		maxBackoff: opt.maxBackoff,
+	}
+	if opt.nearSize > 0 && opt.nearTTL > 0 {
+		// streams last for good, unlike requests
+		stream := *conn
+		cli := *conn.cli
+		cli.Timeout = 0
+		stream.cli = &cli
+		c.near = newNearCache(&stream, opt.nearSize, opt.nearTTL)
+	}
+	return c, nil
+}
+
+// Select returns a client of the namespace sharing connections with c,
+// an empty name stands for the default one.
+func (c *Client) Select(ns string) *Client {
+	cp := *c
+	cp.ns = ns
+	return &cp
+}
+
+func (c *Client) Namespace() string {
+	return c.ns
+}
+
+// Close stops watching changes for the near cache, if any, and closes
+// idle connections.
+func (c *Client) Close() {
+	if c.near != nil {
+		c.near.close()
+	}
+	c.conn.cli.CloseIdleConnections()
+}
+
+// Set stores value with its type, see storage.TypeOf. Zero ttl keeps
+// the key until it is removed or the namespace default ttl is over.
+func (c *Client) Set(ctx context.Context, key string, value interface{}, ttl time.Duration, tags ...string) error {
+	typ, err := storage.TypeOf(value)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(postItem{key, value, ttl, tags, &typ})
+	if err != nil {
+		return err
+	}
+	_, err = c.call(ctx, "POST", c.path("set", ""), nil, body)
+	c.invalidate(key)
+	return err
+}
+
+// Get reads the key from the near cache, if enabled, or the server.
+func (c *Client) Get(ctx context.Context, key string) (*storage.Value, error) {
+	if c.near == nil {
+		return c.get(ctx, key)
+	}
+	if v, ok := c.near.get(c.ns, key); ok {
+		return v, nil
+	}
+	gen := c.near.begin(c.ns, key)
+	v, err := c.get(ctx, key)
+	c.near.finish(c.ns, key, gen, v)
+	return v, err
+}
+
+func (c *Client) get(ctx context.Context, key string) (*storage.Value, error) {
+	body, err := c.call(ctx, "GET", c.path("get", key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var v storage.Value
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// GetBy returns the element of a list value by int index or of a map
+// value by string key, storage.ErrNotFound if there is no such element.
+func (c *Client) GetBy(ctx context.Context, key string, index interface{}) (interface{}, error) {
+	switch index.(type) {
+	case int, string:
+	default:
+		return nil, storage.ErrSubSeqType
+	}
+	q := url.Values{}
+	q.Set("key", key)
+	q.Set("index", fmt.Sprint(index))
+	body, err := c.call(ctx, "GET", APIPath(c.ns, "getby"), q, nil)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Keys returns keys matching glob pattern, no keys is not an error.
+func (c *Client) Keys(ctx context.Context, pattern string) ([]string, error) {
+	body, err := c.call(ctx, "GET", c.path("keys", pattern), nil, nil)
+	if err == storage.ErrNotFound {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var keys []string
+	if err := json.Unmarshal(body, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Remove deletes key, missing key is not an error.
+func (c *Client) Remove(ctx context.Context, key string) error {
+	_, err := c.call(ctx, "DELETE", c.path("remove", key), nil, nil)
+	c.invalidate(key)
+	return err
+}
+
+// InvalidateTag removes keys tagged with tag and returns them.
+func (c *Client) InvalidateTag(ctx context.Context, tag string) ([]string, error) {
+	body, err := c.call(ctx, "DELETE", c.path("tag", tag), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	if err := json.Unmarshal(body, &keys); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		c.invalidate(key)
+	}
+	return keys, nil
+}
+
+// TTL returns the remaining ttl of key, zero for persistent keys.
+func (c *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	body, err := c.call(ctx, "GET", c.path("ttl", key), nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	var item struct {
+		TTL time.Duration `json:"ttl"`
+	}
+	if err := json.Unmarshal(body, &item); err != nil {
+		return 0, err
+	}
+	return item.TTL, nil
+}
+
+// Expire sets a new ttl of key, zero ttl makes it persistent.
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	if ttl < 0 {
+		return storage.ErrNegativeTTL
+	}
+	q := url.Values{}
+	q.Set("ttl", ttl.String())
+	_, err := c.call(ctx, "PUT", c.path("expire", key), q, nil)
+	c.invalidate(key)
+	return err
+}
+
+// Persist removes the ttl of key.
+func (c *Client) Persist(ctx context.Context, key string) error {
+	return c.Expire(ctx, key, 0)
+}
+
+// Len returns the number of keys in the namespace.
+func (c *Client) Len(ctx context.Context) (int, error) {
+	body, err := c.call(ctx, "GET", c.path("dbsize", ""), nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	if err := json.Unmarshal(body, &n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Flush removes every key of the namespace.
+func (c *Client) Flush(ctx context.Context) error {
+	_, err := c.call(ctx, "DELETE", c.path("flushdb", ""), nil, nil)
+	if c.near != nil {
+		c.near.flush(c.ns)
+	}
+	return err
+}
+
+// Ping checks the server is up, it needs no credentials.
+func (c *Client) Ping(ctx context.Context) error {
+	body, err := c.call(ctx, "GET", "/ping", nil, nil)
+	if err != nil {
+		return err
+	}
+	if string(body) != "PONG" {
+		return ErrNoPong
+	}
+	return nil
+}
+
+// invalidate drops the key written by c from the near cache at once,
+// not waiting for the change to come over the stream.
+func (c *Client) invalidate(key string) {
+	if c.near != nil {
+		c.near.invalidate(c.ns, key)
+	}
+}
+
+// path of the command with the escaped argument, if any.
+func (c *Client) path(cmd, arg string) string {
+	p := strings.TrimSuffix(APIPath(c.ns, cmd), "/")
+	if arg != "" {
+		p += "/" + url.PathEscape(arg)
+	}
+	return p
+}
+
+// call sends the request, retrying failed attempts, and returns the
+// body of a successful response.
+func (c *Client) call(ctx context.Context, method, path string, q url.Values, body []byte) ([]byte, error) {
+	u := c.conn.sock + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	for attempt := 0; ; attempt++ {
+		code, data, err := c.attempt(ctx, method, u, body)
+		if err == nil && code >= 200 && code < 300 {
+			return data, nil
+		}
+		if err == nil {
+			err = statusError(code, data)
+		}
+		if attempt >= c.retries || !retryable(ctx, code, err) {
+			return nil, err
+		}
+		wait := time.NewTimer(c.wait(attempt))
+		select {
+		case <-wait.C:
+		case <-ctx.Done():
+			wait.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, u string, body []byte) (int, []byte, error) {
+	var req *http.Request
+	var err error
+	if body == nil {
+		req, err = http.NewRequest(method, u, nil)
+	} else {
+		req, err = http.NewRequest(method, u, bytes.NewReader(body))
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	code, data, err := c.conn.doRequest(req.WithContext(ctx))
+	if err != nil && ctx.Err() != nil {
+		return 0, nil, ctx.Err()
+	}
+	return code, data, err
+}
+
+// wait returns the backoff before the next attempt, doubled after
+// every attempt and randomized by half to spread retries of clients.
+func (c *Client) wait(attempt int) time.Duration {
+	d := c.backoff << uint(attempt)
+	if d <= 0 || (c.maxBackoff > 0 && d > c.maxBackoff) {
+		d = c.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func statusError(code int, body []byte) error {
+	if code == http.StatusNotFound {
+		return storage.ErrNotFound
+	}
+	return &StatusError{Code: code, Body: strings.TrimSpace(string(body))}
+}
+
+// retryable reports whether the request may succeed next time: the
+// server is overloaded or restarting, or the connection failed.
+func retryable(ctx context.Context, code int, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case 0:
+		// errors of http.Client, unlike failed token sources
+		_, ok := err.(*url.Error)
+		return ok
+	}
+	return false
+}
@@ -2,25 +2,77 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/Phil192/rediq/storage"
+	"github.com/Phil192/rediq/trace"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"time"
 )
 
+var ErrBadCA = errors.New("no certificates found in CA file")
+var ErrNoPong = errors.New("server did not answer ping")
+var ErrBadRequest = errors.New("bad request")
+var ErrUnauthorized = errors.New("unauthorized")
+var ErrForbidden = errors.New("forbidden")
+var ErrRateLimited = errors.New("request rate limit exceeded")
+var ErrQuotaExceeded = errors.New("namespace quota exceeded")
+
+var statusErrors = map[int]error{
+	http.StatusBadRequest:          ErrBadRequest,
+	http.StatusUnauthorized:        ErrUnauthorized,
+	http.StatusForbidden:           ErrForbidden,
+	http.StatusTooManyRequests:     ErrRateLimited,
+	http.StatusInsufficientStorage: ErrQuotaExceeded,
+}
+
 type postItem struct {
-	Key   string        `json:"key"`
-	Value string        `json:"value"`
-	TTL   time.Duration `json:"ttl"`
+	Key   string             `json:"key"`
+	Value interface{}        `json:"value"`
+	TTL   time.Duration      `json:"ttl"`
+	Tags  []string           `json:"tags,omitempty"`
+	Type  *storage.InputType `json:"type,omitempty"`
+}
+
+// StatusError is returned for unexpected response status.
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.Code, e.Body)
+}
+
+// Is matches the error of the status code, like
+// errors.Is(err, ErrForbidden).
+func (e *StatusError) Is(target error) bool {
+	return statusErrors[e.Code] == target
 }
 
 type User interface {
 	Socket() string
-	Post(string, string, string, time.Duration) ([]byte, error)
+	Select(string)
+	Namespace() string
+	Post(string, string, string, time.Duration, ...string) ([]byte, error)
+	PostValue(string, string, interface{}, time.Duration, ...string) ([]byte, error)
 	Get(string, string) ([]byte, error)
+	GetValue(string, string) (*storage.Value, error)
+	PutRaw(string, string, io.Reader, string, time.Duration, ...string) error
+	GetRaw(string, string) (io.ReadCloser, string, error)
 	Delete(string, string) ([]byte, error)
+	Ping() error
+	Export(io.Writer, string) error
+	Import(io.Reader, string, string) (int, error)
+	WithContext(context.Context) User
 }
 
 type cacheClient struct {
@@ -28,24 +80,124 @@ type cacheClient struct {
 	sock  string
 	login string
 	pass  string
+	ns    string
+	// sharedToken sends the sha1 token header instead of basic auth
+	sharedToken bool
+	ctx         context.Context
+
+	tokens *tokenCache
+	tracer trace.Tracer
 }
 
-func NewClient(sock, lgn, pass string) User {
-	return &cacheClient{
-		cli:   &http.Client{},
-		sock:  sock,
-		login: lgn,
-		pass:  pass,
+func NewClient(sock, lgn, pass string, opts ...clientOpt) (User, error) {
+	opt := &clientOptions{}
+	for _, o := range opts {
+		if o != nil {
+			o(opt)
+		}
 	}
+	return newCacheClient(sock, lgn, pass, opt)
+}
+
+func newCacheClient(sock, lgn, pass string, opt *clientOptions) (*cacheClient, error) {
+	cfg, err := tlsConfig(opt)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		TLSClientConfig: cfg,
+		IdleConnTimeout: opt.idleTimeout,
+	}
+	if opt.maxIdle > 0 {
+		transport.MaxIdleConns = opt.maxIdle
+		transport.MaxIdleConnsPerHost = opt.maxIdle
+	}
+	c := &cacheClient{
+		cli: &http.Client{
+			Transport: transport,
+			Timeout:   opt.timeout,
+		},
+		sock:        sock,
+		login:       lgn,
+		pass:        pass,
+		sharedToken: opt.sharedToken,
+		tracer:      opt.tracer,
+	}
+	if opt.tokens != nil {
+		c.tokens = &tokenCache{source: opt.tokens}
+	}
+	return c, nil
+}
+
+func tlsConfig(opt *clientOptions) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opt.caFile != "" {
+		data, err := ioutil.ReadFile(opt.caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, ErrBadCA
+		}
+		cfg.RootCAs = pool
+	}
+	if opt.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(opt.certFile, opt.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
 }
 
 func (c *cacheClient) Socket() string {
 	return c.sock
 }
 
-func (c *cacheClient) Post(addr string, key, val string, dur time.Duration) ([]byte, error) {
-	data := postItem{key, val, dur}
-	j, err := json.Marshal(&data)
+// Select switches the namespace used by APIPath, empty name
+// stands for the default one.
+func (c *cacheClient) Select(ns string) {
+	c.ns = ns
+}
+
+func (c *cacheClient) Namespace() string {
+	return c.ns
+}
+
+// WithContext returns a copy of the client sending requests with ctx,
+// which cancels them and passes the trace context of its span.
+func (c *cacheClient) WithContext(ctx context.Context) User {
+	cp := *c
+	cp.ctx = ctx
+	return &cp
+}
+
+// APIPath builds the url path of the command in the namespace.
+func APIPath(ns, cmd string) string {
+	if ns == "" {
+		return fmt.Sprintf("/api/v1/%s/", cmd)
+	}
+	return fmt.Sprintf("/api/v1/ns/%s/%s/", ns, cmd)
+}
+
+func (c *cacheClient) Post(addr string, key, val string, dur time.Duration, tags ...string) ([]byte, error) {
+	return c.post(addr, postItem{key, val, dur, tags, nil})
+}
+
+// PostValue stores val with its type, see storage.InputType. Bytes and
+// storage.StringSet keep their types unlike json strings and lists.
+func (c *cacheClient) PostValue(addr string, key string, val interface{}, dur time.Duration, tags ...string) ([]byte, error) {
+	typ, err := storage.TypeOf(val)
+	if err != nil {
+		return nil, err
+	}
+	return c.post(addr, postItem{key, val, dur, tags, &typ})
+}
+
+func (c *cacheClient) post(addr string, item postItem) ([]byte, error) {
+	j, err := json.Marshal(&item)
 	if err != nil {
 		return nil, err
 	}
@@ -69,6 +221,94 @@ func (c *cacheClient) Get(addr, key string) ([]byte, error) {
 	return c.sendRequest(req)
 }
 
+// GetValue returns value with the body of its type, storage.ErrNotFound
+// for missing key and *StatusError for other failures.
+func (c *cacheClient) GetValue(addr, key string) (*storage.Value, error) {
+	req, err := http.NewRequest(
+		"GET",
+		fmt.Sprintf("%s%s", addr, key),
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	code, body, err := c.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	switch code {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, storage.ErrNotFound
+	default:
+		return nil, &StatusError{Code: code, Body: string(body)}
+	}
+	var v storage.Value
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// PutRaw streams r as the value of key, addr is the raw command path.
+// Empty contentType stands for application/octet-stream.
+func (c *cacheClient) PutRaw(addr, key string, r io.Reader, contentType string, ttl time.Duration, tags ...string) error {
+	q := url.Values{}
+	if ttl > 0 {
+		q.Set("ttl", ttl.String())
+	}
+	for _, tag := range tags {
+		q.Add("tag", tag)
+	}
+	u := fmt.Sprintf("%s%s", addr, key)
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequest("PUT", u, r)
+	if err != nil {
+		return err
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	req.Header.Set("Content-Type", contentType)
+	code, body, err := c.doRequest(req)
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return &StatusError{Code: code, Body: string(body)}
+	}
+	return nil
+}
+
+// GetRaw returns the value stream with its content type, caller must
+// close the stream.
+func (c *cacheClient) GetRaw(addr, key string) (io.ReadCloser, string, error) {
+	req, err := http.NewRequest(
+		"GET",
+		fmt.Sprintf("%s%s", addr, key),
+		nil,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, resp.Header.Get("Content-Type"), nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, "", storage.ErrNotFound
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return nil, "", &StatusError{Code: resp.StatusCode, Body: string(body)}
+}
+
 func (c *cacheClient) Delete(addr, key string) ([]byte, error) {
 	req, err := http.NewRequest(
 		"DELETE",
@@ -82,19 +322,168 @@ func (c *cacheClient) Delete(addr, key string) ([]byte, error) {
 
 }
 
+// Ping checks the server is up, it needs no credentials.
+func (c *cacheClient) Ping() error {
+	body, err := c.Get(c.sock, "/ping")
+	if err != nil {
+		return err
+	}
+	if string(body) != "PONG" {
+		return ErrNoPong
+	}
+	return nil
+}
+
+// Export writes a snapshot of all namespaces to w, it needs admin
+// permission. Format is jsonl or csv, empty for the rediq backup format.
+func (c *cacheClient) Export(w io.Writer, format string) error {
+	q := url.Values{}
+	if format != "" {
+		q.Set("format", format)
+	}
+	req, err := http.NewRequest("GET", c.sock+"/api/v1/admin/export?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return &StatusError{Code: resp.StatusCode, Body: string(body)}
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Import loads a snapshot written by Export or a Redis rdb file with
+// format rdb, mode is merge or replace. It returns the number of
+// imported keys.
+func (c *cacheClient) Import(r io.Reader, format, mode string) (int, error) {
+	q := url.Values{}
+	q.Set("mode", mode)
+	if format != "" {
+		q.Set("format", format)
+	}
+	req, err := http.NewRequest("POST", c.sock+"/api/v1/admin/import?"+q.Encode(), r)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	code, body, err := c.doRequest(req)
+	if err != nil {
+		return 0, err
+	}
+	if code != http.StatusOK {
+		return 0, &StatusError{Code: code, Body: string(body)}
+	}
+	var res struct {
+		Imported int `json:"imported"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return 0, err
+	}
+	return res.Imported, nil
+}
+
 func (c *cacheClient) sendRequest(req *http.Request) ([]byte, error) {
-	hasher := sha1.New()
-	_, err := hasher.Write([]byte(c.login + c.pass))
-	req.Header.Set("token", fmt.Sprintf("%x", hasher.Sum(nil)))
+	_, body, err := c.doRequest(req)
+	return body, err
+}
 
-	resp, err := c.cli.Do(req)
+func (c *cacheClient) doRequest(req *http.Request) (int, []byte, error) {
+	resp, err := c.do(req)
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
+
+// do sends authorized request with the traceparent header of the span
+// in the client context, caller must close the response body. The
+// client span, if traced, ends with the response headers.
+func (c *cacheClient) do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if c.ctx != nil {
+		ctx = c.ctx
+	}
+	if c.tracer == nil {
+		if sc := trace.SpanFromContext(ctx).Context(); sc.IsValid() {
+			req.Header.Set(trace.Header, sc.Traceparent())
+		}
+		return c.send(req.WithContext(ctx))
+	}
+	ctx, span := trace.StartWith(ctx, c.tracer, "rediq.client "+req.Method, trace.SpanContext{})
+	defer span.End()
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.url", req.URL.Path)
+	req.Header.Set(trace.Header, span.Context().Traceparent())
+	resp, err := c.send(req.WithContext(ctx))
+	if err != nil {
+		span.SetError(err)
 		return nil, err
 	}
-	return body, nil
+	span.SetAttribute("http.status_code", resp.StatusCode)
+	return resp, nil
+}
+
+// authorize sets only the configured credential: a bearer token if
+// Tokens is set, otherwise login and password as the sha1 token header
+// with SharedToken or as basic auth.
+func (c *cacheClient) authorize(req *http.Request) error {
+	if c.tokens != nil {
+		return c.tokens.authorize(req, false)
+	}
+	if c.login == "" && c.pass == "" {
+		return nil
+	}
+	if !c.sharedToken {
+		req.SetBasicAuth(c.login, c.pass)
+		return nil
+	}
+	hasher := sha1.New()
+	if _, err := hasher.Write([]byte(c.login + c.pass)); err != nil {
+		return err
+	}
+	req.Header.Set("token", fmt.Sprintf("%x", hasher.Sum(nil)))
+	return nil
+}
+
+func (c *cacheClient) send(req *http.Request) (*http.Response, error) {
+	if err := c.authorize(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	// token may be revoked or expired earlier than we expected,
+	// so get a new one and retry once, streamed body can't be resent
+	if resp.StatusCode == http.StatusUnauthorized && c.tokens != nil &&
+		(req.Body == nil || req.GetBody != nil) {
+		resp.Body.Close()
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		if err := c.tokens.authorize(req, true); err != nil {
+			return nil, err
+		}
+		resp, err = c.cli.Do(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
 }
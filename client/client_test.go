@@ -0,0 +1,345 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/Phil192/rediq/auth"
+	"github.com/Phil192/rediq/rest"
+	"github.com/Phil192/rediq/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newServer serves a new cache, authenticated against acl if it is set
+// and without authentication otherwise.
+func newServer(name string, acl *auth.ACL) *httptest.Server {
+	c := storage.NewCacheV2(
+		storage.DumpPath(filepath.Join(os.TempDir(), name)),
+		storage.Namespace("limited", storage.MaxKeys(1)),
+	)
+	app := rest.NewApp(storage.Downgrade(c), rest.ACL(acl), rest.NoAuth(acl == nil))
+	engine := gin.New()
+	app.RouteAPI(engine)
+	return httptest.NewServer(engine)
+}
+
+func TestClient(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	srv := newServer("rediq-client.dump", nil)
+	defer srv.Close()
+	c, err := New(srv.URL + "/")
+	r.NoError(err)
+	defer c.Close()
+
+	r.NoError(c.Ping(ctx))
+	r.NoError(c.Set(ctx, "str", "v", 0, "t"))
+	r.NoError(c.Set(ctx, "list", []interface{}{"a", "b"}, time.Hour))
+	r.NoError(c.Set(ctx, "map", map[string]interface{}{"f": "v"}, 0, "t"))
+	r.NoError(c.Set(ctx, "bytes", []byte{0, 1}, 0))
+	r.NoError(c.Set(ctx, "a b/c", 1, 0, "x/y"))
+
+	v, err := c.Get(ctx, "str")
+	r.NoError(err)
+	r.Equal("v", v.Body)
+	r.Equal([]string{"t"}, v.Tags)
+	v, err = c.Get(ctx, "bytes")
+	r.NoError(err)
+	r.Equal([]byte{0, 1}, v.Body)
+	_, err = c.Get(ctx, "missing")
+	r.Equal(storage.ErrNotFound, err)
+	v, err = c.Get(ctx, "a b/c")
+	r.NoError(err)
+	r.Equal(int64(1), v.Body)
+	r.NoError(c.Expire(ctx, "a b/c", time.Minute))
+	ttl, err := c.TTL(ctx, "a b/c")
+	r.NoError(err)
+	r.True(ttl > 59*time.Second)
+	keys, err := c.Keys(ctx, "a b/*")
+	r.NoError(err)
+	r.Equal([]string{"a b/c"}, keys)
+	removed, err := c.InvalidateTag(ctx, "x/y")
+	r.NoError(err)
+	r.Equal([]string{"a b/c"}, removed)
+	r.NoError(c.Set(ctx, "a b/c", 1, 0))
+	r.NoError(c.Remove(ctx, "a b/c"))
+	_, err = c.Get(ctx, "a b/c")
+	r.Equal(storage.ErrNotFound, err)
+
+	el, err := c.GetBy(ctx, "list", 1)
+	r.NoError(err)
+	r.Equal("b", el)
+	el, err = c.GetBy(ctx, "map", "f")
+	r.NoError(err)
+	r.Equal("v", el)
+	_, err = c.GetBy(ctx, "list", 5)
+	r.Equal(storage.ErrNotFound, err)
+	_, err = c.GetBy(ctx, "list", 1.5)
+	r.Equal(storage.ErrSubSeqType, err)
+
+	keys, err = c.Keys(ctx, "*s*")
+	r.NoError(err)
+	r.ElementsMatch([]string{"str", "list", "bytes"}, keys)
+	keys, err = c.Keys(ctx, "none*")
+	r.NoError(err)
+	r.Empty(keys)
+
+	ttl, err = c.TTL(ctx, "list")
+	r.NoError(err)
+	r.True(ttl > 59*time.Minute)
+	r.NoError(c.Expire(ctx, "str", time.Minute))
+	ttl, err = c.TTL(ctx, "str")
+	r.NoError(err)
+	r.True(ttl > 59*time.Second && ttl <= time.Minute)
+	r.NoError(c.Persist(ctx, "list"))
+	ttl, err = c.TTL(ctx, "list")
+	r.NoError(err)
+	r.Equal(time.Duration(0), ttl)
+	r.Equal(storage.ErrNotFound, c.Expire(ctx, "missing", time.Minute))
+	r.Equal(storage.ErrNegativeTTL, c.Expire(ctx, "str", -time.Second))
+
+	removed, err = c.InvalidateTag(ctx, "t")
+	r.NoError(err)
+	r.ElementsMatch([]string{"str", "map"}, removed)
+	r.NoError(c.Remove(ctx, "bytes"))
+	r.NoError(c.Remove(ctx, "bytes"))
+	n, err := c.Len(ctx)
+	r.NoError(err)
+	r.Equal(1, n)
+
+	other := c.Select("other")
+	r.Equal("other", other.Namespace())
+	r.NoError(other.Set(ctx, "str", "other", 0))
+	v, err = other.Get(ctx, "str")
+	r.NoError(err)
+	r.Equal("other", v.Body)
+	_, err = c.Get(ctx, "str")
+	r.Equal(storage.ErrNotFound, err)
+
+	r.NoError(c.Flush(ctx))
+	n, err = c.Len(ctx)
+	r.NoError(err)
+	r.Equal(0, n)
+	n, err = other.Len(ctx)
+	r.NoError(err)
+	r.Equal(1, n)
+
+	limited := c.Select("limited")
+	r.NoError(limited.Set(ctx, "a", "1", 0))
+	err = limited.Set(ctx, "b", "2", 0)
+	r.True(errors.Is(err, ErrQuotaExceeded))
+	r.Equal(507, err.(*StatusError).Code)
+}
+
+func TestClientAuth(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	acl := auth.NewACL("")
+	r.NoError(acl.SetUser(&auth.User{Name: "reader", Permissions: []auth.Permission{auth.Read}}, "secret"))
+	srv := newServer("rediq-client-auth.dump", acl)
+	defer srv.Close()
+
+	c, err := New(srv.URL, BasicAuth("reader", "secret"))
+	r.NoError(err)
+	_, err = c.Get(ctx, "k")
+	r.Equal(storage.ErrNotFound, err)
+	err = c.Set(ctx, "k", "v", 0)
+	r.True(errors.Is(err, ErrForbidden))
+
+	c, err = New(srv.URL, BasicAuth("reader", "wrong"))
+	r.NoError(err)
+	_, err = c.Get(ctx, "k")
+	r.True(errors.Is(err, ErrUnauthorized))
+	r.False(errors.Is(err, ErrForbidden))
+
+	// only the configured credential is sent
+	headers := make(chan http.Header, 1)
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		headers <- req.Header
+		w.Write([]byte("PONG"))
+	}))
+	defer echo.Close()
+	tokens := func() (string, time.Time, error) {
+		return "signed", time.Now().Add(time.Hour), nil
+	}
+	c, err = New(echo.URL, BasicAuth("reader", "secret"), Tokens(tokens))
+	r.NoError(err)
+	r.NoError(c.Ping(ctx))
+	h := <-headers
+	r.Equal("Bearer signed", h.Get("Authorization"))
+	r.Empty(h.Get("token"))
+	c, err = New(echo.URL, BasicAuth("reader", "secret"))
+	r.NoError(err)
+	r.NoError(c.Ping(ctx))
+	h = <-headers
+	r.True(strings.HasPrefix(h.Get("Authorization"), "Basic "))
+	r.Empty(h.Get("token"))
+	c, err = New(echo.URL, BasicAuth("reader", "secret"), SharedToken(true))
+	r.NoError(err)
+	r.NoError(c.Ping(ctx))
+	h = <-headers
+	r.Empty(h.Get("Authorization"))
+	r.NotEmpty(h.Get("token"))
+	c, err = New(echo.URL)
+	r.NoError(err)
+	r.NoError(c.Ping(ctx))
+	h = <-headers
+	r.Empty(h.Get("Authorization"))
+	r.Empty(h.Get("token"))
+}
+
+func TestClientRetry(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	var calls, failures int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("PONG"))
+	}))
+	defer srv.Close()
+
+	c, err := New(srv.URL, Retry(2, time.Millisecond, 5*time.Millisecond))
+	r.NoError(err)
+	atomic.StoreInt32(&failures, 2)
+	r.NoError(c.Ping(ctx))
+	r.Equal(int32(3), atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&calls, 0)
+	atomic.StoreInt32(&failures, 3)
+	err = c.Ping(ctx)
+	r.IsType(&StatusError{}, err)
+	r.Equal(503, err.(*StatusError).Code)
+	r.Equal(int32(3), atomic.LoadInt32(&calls))
+
+	c, err = New(srv.URL, Retry(5, time.Hour, time.Hour))
+	r.NoError(err)
+	atomic.StoreInt32(&calls, 0)
+	atomic.StoreInt32(&failures, 1)
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	r.Equal(context.DeadlineExceeded, c.Ping(timeout))
+	r.Equal(int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestClientTimeout(t *testing.T) {
+	r := require.New(t)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c, err := New(srv.URL, Timeout(20*time.Millisecond), Retry(1, time.Millisecond, time.Millisecond))
+	r.NoError(err)
+	start := time.Now()
+	err = c.Ping(context.Background())
+	r.Error(err)
+	r.True(time.Since(start) < time.Second)
+}
+
+func TestNearCache(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	dump := filepath.Join(os.TempDir(), "rediq-near.dump")
+	os.Remove(dump)
+	cache := storage.NewCacheV2(storage.DumpPath(dump))
+	r.NoError(cache.Run(ctx))
+	app := rest.NewApp(storage.Downgrade(cache), rest.NoAuth(true))
+	engine := gin.New()
+	app.RouteAPI(engine)
+	var gets int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.Path, "/get/") {
+			atomic.AddInt32(&gets, 1)
+		}
+		engine.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+
+	other, err := New(srv.URL)
+	r.NoError(err)
+	c, err := New(srv.URL, NearCache(2, time.Minute))
+	r.NoError(err)
+	defer c.Close()
+	body := func(key string) interface{} {
+		v, err := c.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		return v.Body
+	}
+	cached := func(key string) bool {
+		n := atomic.LoadInt32(&gets)
+		_, err := c.Get(ctx, key)
+		return err == nil && atomic.LoadInt32(&gets) == n
+	}
+
+	r.NoError(other.Set(ctx, "k", "v", 0))
+	r.Eventually(func() bool { body("k"); return cached("k") }, time.Second, 10*time.Millisecond)
+	r.NoError(other.Set(ctx, "k", "v2", 0))
+	r.Eventually(func() bool { return body("k") == "v2" }, time.Second, 10*time.Millisecond)
+	r.True(cached("k"))
+	r.NoError(other.Remove(ctx, "k"))
+	r.Eventually(func() bool { return body("k") == storage.ErrNotFound }, time.Second, 10*time.Millisecond)
+
+	r.NoError(c.Set(ctx, "own", "a", 0))
+	r.Equal("a", body("own"))
+	r.True(cached("own"))
+	r.NoError(c.Set(ctx, "own", "b", 0))
+	r.Equal("b", body("own"))
+
+	r.NoError(other.Set(ctx, "x", "x", 0))
+	r.NoError(other.Set(ctx, "y", "y", 0))
+	// the set events may arrive after the reads and drop them
+	r.Eventually(func() bool { body("x"); body("y"); return cached("x") && cached("y") }, time.Second, 10*time.Millisecond)
+	r.False(cached("own"))
+	c.near.mx.Lock()
+	r.Equal(2, c.near.spaces[""].lru.Len())
+	c.near.mx.Unlock()
+
+	r.NoError(other.Set(ctx, "short", "v", time.Second))
+	r.Eventually(func() bool { body("short"); return cached("short") }, time.Second, 10*time.Millisecond)
+	r.Eventually(func() bool { return body("short") == storage.ErrNotFound }, 3*time.Second, 50*time.Millisecond)
+
+	body("y")
+	r.True(cached("y"))
+	r.NoError(other.Flush(ctx))
+	r.Eventually(func() bool { return body("y") == storage.ErrNotFound }, time.Second, 10*time.Millisecond)
+
+	ns := c.Select("ns")
+	r.NoError(other.Select("ns").Set(ctx, "k", "ns", 0))
+	r.Eventually(func() bool {
+		n := atomic.LoadInt32(&gets)
+		v, err := ns.Get(ctx, "k")
+		return err == nil && v.Body == "ns" && atomic.LoadInt32(&gets) == n
+	}, time.Second, 10*time.Millisecond)
+
+	// a namespace read before it is created is watched as well
+	fresh := c.Select("fresh")
+	_, err = fresh.Get(ctx, "k")
+	r.Error(err)
+	r.Eventually(func() bool {
+		c.near.mx.Lock()
+		defer c.near.mx.Unlock()
+		return c.near.spaces["fresh"].live
+	}, time.Second, 10*time.Millisecond)
+	r.NoError(other.Select("fresh").Set(ctx, "k", "fresh", 0))
+	r.Eventually(func() bool {
+		n := atomic.LoadInt32(&gets)
+		v, err := fresh.Get(ctx, "k")
+		return err == nil && v.Body == "fresh" && atomic.LoadInt32(&gets) == n
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,469 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Phil192/rediq/storage"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultVNodes = 160
+	defaultHealth = 5 * time.Second
+	// maxParallel limits requests in flight of one multi-key call
+	maxParallel = 16
+)
+
+var ErrNoNodes = errors.New("no cluster nodes available")
+
+// PartialError is returned by calls to every node, like Keys, when some
+// nodes turn out to be down. The result holds data of the other nodes.
+type PartialError struct {
+	Down []string
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("cluster nodes are down: %s", strings.Join(e.Down, ", "))
+}
+
+// Cluster spreads keys of one namespace over independent servers with a
+// consistent hash ring, so adding or losing a node moves only the keys
+// of that node. Failed nodes are left out of the ring until they answer
+// pings again, see HealthCheck. Keys written to a failed node are lost
+// for the cluster unless they are replicated, see Replicas.
+type Cluster struct {
+	state *clusterState
+	ns    string
+}
+
+type clusterState struct {
+	mx     sync.RWMutex
+	ring   *ring
+	up     map[string]bool
+	nodes  map[string]*Client
+	vnodes int
+
+	replicas int
+	// health is the interval of checks, failed nodes are removed from
+	// the ring only if they are checked to come back
+	health time.Duration
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewCluster connects to the servers at addrs, opts are applied to the
+// client of every node. By default a node is placed on the ring 160
+// times, keys are not replicated and nodes are pinged every 5s.
+func NewCluster(addrs []string, opts ...clientOpt) (*Cluster, error) {
+	if len(addrs) == 0 {
+		return nil, ErrNoNodes
+	}
+	opt := &clientOptions{vnodes: defaultVNodes, replicas: 1, health: defaultHealth}
+	for _, o := range opts {
+		if o != nil {
+			o(opt)
+		}
+	}
+	if opt.vnodes < 1 {
+		opt.vnodes = 1
+	}
+	if opt.replicas < 1 {
+		opt.replicas = 1
+	}
+	s := &clusterState{
+		up:       make(map[string]bool, len(addrs)),
+		nodes:    make(map[string]*Client, len(addrs)),
+		vnodes:   opt.vnodes,
+		replicas: opt.replicas,
+		health:   opt.health,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, addr := range addrs {
+		if _, ok := s.nodes[addr]; ok {
+			continue
+		}
+		cli, err := New(addr, opts...)
+		if err != nil {
+			return nil, err
+		}
+		s.nodes[addr] = cli
+		s.up[addr] = true
+	}
+	s.rebuild()
+	if s.health > 0 {
+		go s.check(s.health)
+	} else {
+		close(s.done)
+	}
+	return &Cluster{state: s}, nil
+}
+
+// Select returns a cluster client of the namespace sharing nodes with c.
+func (c *Cluster) Select(ns string) *Cluster {
+	return &Cluster{state: c.state, ns: ns}
+}
+
+func (c *Cluster) Namespace() string {
+	return c.ns
+}
+
+// Nodes returns the addresses of the nodes in the ring.
+func (c *Cluster) Nodes() []string {
+	c.state.mx.RLock()
+	defer c.state.mx.RUnlock()
+	var nodes []string
+	for addr, up := range c.state.up {
+		if up {
+			nodes = append(nodes, addr)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Close stops health checks and closes idle connections of every node.
+func (c *Cluster) Close() {
+	c.state.once.Do(func() {
+		close(c.state.stop)
+	})
+	<-c.state.done
+	for _, cli := range c.state.nodes {
+		cli.Close()
+	}
+}
+
+// Set writes the key to every of its replicas.
+func (c *Cluster) Set(ctx context.Context, key string, value interface{}, ttl time.Duration, tags ...string) error {
+	return c.write(key, func(cli *Client) error {
+		return cli.Set(ctx, key, value, ttl, tags...)
+	})
+}
+
+// Get reads the key from the first replica that answers.
+func (c *Cluster) Get(ctx context.Context, key string) (v *storage.Value, err error) {
+	err = c.read(key, func(cli *Client) (err error) {
+		v, err = cli.Get(ctx, key)
+		return err
+	})
+	return v, err
+}
+
+// GetBy is Client.GetBy on the first replica of the key that answers.
+func (c *Cluster) GetBy(ctx context.Context, key string, index interface{}) (el interface{}, err error) {
+	err = c.read(key, func(cli *Client) (err error) {
+		el, err = cli.GetBy(ctx, key, index)
+		return err
+	})
+	return el, err
+}
+
+func (c *Cluster) TTL(ctx context.Context, key string) (ttl time.Duration, err error) {
+	err = c.read(key, func(cli *Client) (err error) {
+		ttl, err = cli.TTL(ctx, key)
+		return err
+	})
+	return ttl, err
+}
+
+// Remove deletes the key from every of its replicas.
+func (c *Cluster) Remove(ctx context.Context, key string) error {
+	return c.write(key, func(cli *Client) error {
+		return cli.Remove(ctx, key)
+	})
+}
+
+func (c *Cluster) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return c.write(key, func(cli *Client) error {
+		return cli.Expire(ctx, key, ttl)
+	})
+}
+
+func (c *Cluster) Persist(ctx context.Context, key string) error {
+	return c.Expire(ctx, key, 0)
+}
+
+// GetMulti reads keys in parallel, missing keys are left out of the
+// result.
+func (c *Cluster) GetMulti(ctx context.Context, keys ...string) (map[string]*storage.Value, error) {
+	var mx sync.Mutex
+	values := make(map[string]*storage.Value, len(keys))
+	err := c.parallel(ctx, keys, func(key string) error {
+		v, err := c.Get(ctx, key)
+		if err == storage.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		mx.Lock()
+		values[key] = v
+		mx.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// SetMulti writes items in parallel with the same ttl and tags.
+func (c *Cluster) SetMulti(ctx context.Context, items map[string]interface{}, ttl time.Duration, tags ...string) error {
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	return c.parallel(ctx, keys, func(key string) error {
+		return c.Set(ctx, key, items[key], ttl, tags...)
+	})
+}
+
+// RemoveMulti deletes keys in parallel.
+func (c *Cluster) RemoveMulti(ctx context.Context, keys ...string) error {
+	return c.parallel(ctx, keys, func(key string) error {
+		return c.Remove(ctx, key)
+	})
+}
+
+// Keys returns keys matching pattern on every node, without duplicates
+// of replicas. Keys of the nodes that answer are returned along with
+// *PartialError if other nodes are down.
+func (c *Cluster) Keys(ctx context.Context, pattern string) ([]string, error) {
+	return c.merge(func(cli *Client) ([]string, error) {
+		return cli.Keys(ctx, pattern)
+	})
+}
+
+// InvalidateTag removes keys tagged with tag on every node and returns
+// them without duplicates of replicas.
+func (c *Cluster) InvalidateTag(ctx context.Context, tag string) ([]string, error) {
+	return c.merge(func(cli *Client) ([]string, error) {
+		return cli.InvalidateTag(ctx, tag)
+	})
+}
+
+// Flush removes every key of the namespace on every node.
+func (c *Cluster) Flush(ctx context.Context) error {
+	_, err := c.merge(func(cli *Client) ([]string, error) {
+		return nil, cli.Flush(ctx)
+	})
+	return err
+}
+
+// read tries the replicas of key in turn while they fail.
+func (c *Cluster) read(key string, fn func(cli *Client) error) error {
+	nodes := c.state.lookup(key)
+	if len(nodes) == 0 {
+		return ErrNoNodes
+	}
+	var err error
+	for _, node := range nodes {
+		err = fn(c.client(node))
+		if !c.state.failed(node, err) {
+			return err
+		}
+	}
+	return err
+}
+
+// write applies fn to every replica of key and returns the first error.
+func (c *Cluster) write(key string, fn func(cli *Client) error) error {
+	nodes := c.state.lookup(key)
+	if len(nodes) == 0 {
+		return ErrNoNodes
+	}
+	var first error
+	for _, node := range nodes {
+		err := fn(c.client(node))
+		c.state.failed(node, err)
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// parallel applies fn to every key with up to maxParallel requests in
+// flight, every key is a request of its own. It returns the first error.
+func (c *Cluster) parallel(ctx context.Context, keys []string, fn func(key string) error) error {
+	sem := make(chan struct{}, maxParallel)
+	errs := make(chan error, len(keys))
+	for _, key := range keys {
+		sem <- struct{}{}
+		go func(key string) {
+			defer func() { <-sem }()
+			err := ctx.Err()
+			if err == nil {
+				err = fn(key)
+			}
+			errs <- err
+		}(key)
+	}
+	var first error
+	for range keys {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// merge applies fn to every node in the ring in parallel and merges the
+// results. Nodes found down are left out and reported by *PartialError
+// along with the results of the others, other errors fail the call.
+func (c *Cluster) merge(fn func(cli *Client) ([]string, error)) ([]string, error) {
+	nodes := c.Nodes()
+	if len(nodes) == 0 {
+		return nil, ErrNoNodes
+	}
+	type result struct {
+		node string
+		keys []string
+		err  error
+		down bool
+	}
+	results := make(chan result, len(nodes))
+	for _, node := range nodes {
+		go func(node string) {
+			keys, err := fn(c.client(node))
+			results <- result{node, keys, err, c.state.failed(node, err)}
+		}(node)
+	}
+	var first error
+	var down []string
+	seen := make(map[string]bool)
+	merged := []string{}
+	for range nodes {
+		res := <-results
+		if res.down {
+			down = append(down, res.node)
+			continue
+		}
+		if res.err != nil {
+			if first == nil {
+				first = res.err
+			}
+			continue
+		}
+		for _, key := range res.keys {
+			if !seen[key] {
+				seen[key] = true
+				merged = append(merged, key)
+			}
+		}
+	}
+	if first != nil {
+		return nil, first
+	}
+	if len(down) == len(nodes) {
+		return nil, ErrNoNodes
+	}
+	sort.Strings(merged)
+	if len(down) > 0 {
+		sort.Strings(down)
+		return merged, &PartialError{Down: down}
+	}
+	return merged, nil
+}
+
+func (c *Cluster) client(node string) *Client {
+	return c.state.nodes[node].Select(c.ns)
+}
+
+func (s *clusterState) lookup(key string) []string {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.ring.lookup(key, s.replicas)
+}
+
+// failed reports whether err means the node is down and if so removes
+// it from the ring until it passes a health check, if checks are on.
+func (s *clusterState) failed(node string, err error) bool {
+	if !nodeDown(err) {
+		return false
+	}
+	if s.health > 0 {
+		s.setUp(node, false)
+	}
+	return true
+}
+
+func (s *clusterState) setUp(node string, up bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.up[node] == up {
+		return
+	}
+	s.up[node] = up
+	s.rebuild()
+}
+
+// rebuild must be called with mx locked.
+func (s *clusterState) rebuild() {
+	var nodes []string
+	for addr, up := range s.up {
+		if up {
+			nodes = append(nodes, addr)
+		}
+	}
+	s.ring = newRing(nodes, s.vnodes)
+}
+
+// check pings every node each interval, a ping is not retried and is
+// limited by Timeout.
+func (s *clusterState) check(interval time.Duration) {
+	defer close(s.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		// Close doesn't wait for hanging pings
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+		}
+		var wg sync.WaitGroup
+		for addr, cli := range s.nodes {
+			wg.Add(1)
+			go func(addr string, cli Client) {
+				defer wg.Done()
+				cli.retries = 0
+				s.setUp(addr, cli.Ping(ctx) == nil)
+			}(addr, *cli)
+		}
+		wg.Wait()
+	}
+}
+
+// nodeDown reports whether err is a network error or the node is
+// unavailable, unlike errors of the request itself.
+func nodeDown(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(*url.Error); ok {
+		return true
+	}
+	if e, ok := err.(*StatusError); ok {
+		switch e.Code {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+	return false
+}
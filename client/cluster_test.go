@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRing(t *testing.T) {
+	r := require.New(t)
+	full := newRing([]string{"a", "b", "c"}, 100)
+	less := newRing([]string{"c", "a"}, 100)
+	owned := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint("key", i)
+		nodes := full.lookup(key, 5)
+		r.Len(nodes, 3)
+		owned[nodes[0]]++
+		if nodes[0] != "b" {
+			r.Equal(nodes[0], less.lookup(key, 1)[0], key)
+		} else {
+			r.Equal(nodes[1], less.lookup(key, 1)[0], key)
+		}
+	}
+	for _, node := range []string{"a", "b", "c"} {
+		r.True(owned[node] > 200, node)
+	}
+	r.Empty(newRing(nil, 100).lookup("key", 1))
+}
+
+func TestCluster(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	var addrs []string
+	var servers []*httptest.Server
+	for i := 0; i < 3; i++ {
+		srv := newServer(fmt.Sprintf("rediq-cluster-%d.dump", i), nil)
+		defer srv.Close()
+		servers = append(servers, srv)
+		addrs = append(addrs, srv.URL)
+	}
+	sort.Strings(addrs)
+	c, err := NewCluster(addrs, Replicas(2), HealthCheck(10*time.Millisecond), Retry(0, 0, 0))
+	r.NoError(err)
+	defer c.Close()
+	r.Equal(addrs, c.Nodes())
+
+	items := map[string]interface{}{}
+	var keys []string
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		items[key] = fmt.Sprint(i)
+		keys = append(keys, key)
+	}
+	r.NoError(c.SetMulti(ctx, items, 0, "t"))
+	for _, addr := range addrs {
+		node, err := New(addr)
+		r.NoError(err)
+		n, err := node.Len(ctx)
+		r.NoError(err)
+		r.True(n > 0 && n < 30, addr)
+	}
+	values, err := c.GetMulti(ctx, append(keys, "missing")...)
+	r.NoError(err)
+	r.Len(values, 30)
+	r.Equal("7", values["k07"].Body)
+	all, err := c.Keys(ctx, "k*")
+	r.NoError(err)
+	r.Equal(keys, all)
+
+	for _, srv := range servers {
+		if srv.URL == addrs[0] {
+			srv.Close()
+		}
+	}
+	for _, key := range keys {
+		v, err := c.Get(ctx, key)
+		r.NoError(err, key)
+		r.Equal(items[key], v.Body)
+	}
+	r.Equal(addrs[1:], c.Nodes())
+	r.NoError(c.RemoveMulti(ctx, "k00", "k01"))
+	removed, err := c.InvalidateTag(ctx, "t")
+	r.NoError(err)
+	r.Equal(keys[2:], removed)
+
+	other := c.Select("other")
+	r.NoError(other.Set(ctx, "k", "v", 0))
+	_, err = c.Get(ctx, "k")
+	r.Error(err)
+	r.NoError(other.Flush(ctx))
+	all, err = other.Keys(ctx, "*")
+	r.NoError(err)
+	r.Empty(all)
+
+	// without health checks nothing brings failed nodes back
+	unchecked, err := NewCluster(addrs, HealthCheck(0), Retry(0, 0, 0))
+	r.NoError(err)
+	defer unchecked.Close()
+	for _, key := range keys {
+		unchecked.Get(ctx, key)
+	}
+	r.Equal(addrs, unchecked.Nodes())
+	// calls to every node skip the failed one and report it
+	r.NoError(c.Set(ctx, "k99", "v", 0))
+	all, err = unchecked.Keys(ctx, "k*")
+	r.IsType(&PartialError{}, err)
+	r.Equal([]string{addrs[0]}, err.(*PartialError).Down)
+	r.Equal([]string{"k99"}, all)
+}
@@ -0,0 +1,256 @@
+package client
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"github.com/Phil192/rediq/storage"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minReconnect = 100 * time.Millisecond
+	maxReconnect = 5 * time.Second
+)
+
+// control lines of the watch stream, see rest watchHandler
+const (
+	watchReady storage.ChangeOp = "ready"
+	watchPing  storage.ChangeOp = "ping"
+	watchReset storage.ChangeOp = "reset"
+)
+
+// nearCache keeps values read by Client in process. Every namespace is
+// watched over its own stream and values are served only while it is
+// up, so they are never older than ttl even if the stream dies silently
+// and usually only for the time a change takes to arrive.
+type nearCache struct {
+	conn   *cacheClient
+	size   int
+	ttl    time.Duration
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mx     sync.Mutex
+	spaces map[string]*nearSpace
+}
+
+type nearSpace struct {
+	live  bool
+	items map[string]*list.Element
+	lru   *list.List
+	// pending reads of keys, a read is not cached if the key has
+	// changed in between
+	pending map[string]*nearRead
+}
+
+type nearItem struct {
+	key     string
+	v       *storage.Value
+	expires time.Time
+}
+
+type nearRead struct {
+	refs int
+	gen  uint64
+}
+
+// newNearCache streams changes with conn, which must have no timeout.
+func newNearCache(conn *cacheClient, size int, ttl time.Duration) *nearCache {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &nearCache{
+		conn:   conn,
+		size:   size,
+		ttl:    ttl,
+		ctx:    ctx,
+		cancel: cancel,
+		spaces: make(map[string]*nearSpace),
+	}
+}
+
+func (n *nearCache) close() {
+	n.cancel()
+	n.wg.Wait()
+}
+
+// space returns the namespace and starts watching it on the first use.
+// It must be called with mx locked.
+func (n *nearCache) space(ns string) *nearSpace {
+	s, ok := n.spaces[ns]
+	if ok {
+		return s
+	}
+	s = &nearSpace{
+		items:   make(map[string]*list.Element),
+		lru:     list.New(),
+		pending: make(map[string]*nearRead),
+	}
+	n.spaces[ns] = s
+	if n.ctx.Err() == nil {
+		n.wg.Add(1)
+		go n.watch(ns, s)
+	}
+	return s
+}
+
+func (n *nearCache) get(ns, key string) (*storage.Value, bool) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	s := n.space(ns)
+	e, ok := s.items[key]
+	if !ok || !s.live {
+		return nil, false
+	}
+	item := e.Value.(*nearItem)
+	if time.Now().After(item.expires) {
+		s.lru.Remove(e)
+		delete(s.items, key)
+		return nil, false
+	}
+	s.lru.MoveToFront(e)
+	return item.v, true
+}
+
+// begin registers a read of key from the server and returns the
+// generation to pass to finish.
+func (n *nearCache) begin(ns, key string) uint64 {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	s := n.space(ns)
+	r, ok := s.pending[key]
+	if !ok {
+		r = &nearRead{}
+		s.pending[key] = r
+	}
+	r.refs++
+	return r.gen
+}
+
+// finish caches v read since begin unless the key has changed or the
+// stream has been down in between, nil v is not cached.
+func (n *nearCache) finish(ns, key string, gen uint64, v *storage.Value) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	s := n.space(ns)
+	r := s.pending[key]
+	if r.refs--; r.refs == 0 {
+		delete(s.pending, key)
+	}
+	if v == nil || r.gen != gen || !s.live {
+		return
+	}
+	ttl := n.ttl
+	if v.TTL > 0 && v.TTL < ttl {
+		ttl = v.TTL
+	}
+	item := &nearItem{key: key, v: v, expires: time.Now().Add(ttl)}
+	if e, ok := s.items[key]; ok {
+		e.Value = item
+		s.lru.MoveToFront(e)
+		return
+	}
+	s.items[key] = s.lru.PushFront(item)
+	for s.lru.Len() > n.size {
+		e := s.lru.Back()
+		s.lru.Remove(e)
+		delete(s.items, e.Value.(*nearItem).key)
+	}
+}
+
+func (n *nearCache) invalidate(ns, key string) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	s := n.space(ns)
+	if e, ok := s.items[key]; ok {
+		s.lru.Remove(e)
+		delete(s.items, key)
+	}
+	if r, ok := s.pending[key]; ok {
+		r.gen++
+	}
+}
+
+func (n *nearCache) flush(ns string) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	n.clear(n.space(ns))
+}
+
+func (n *nearCache) reset(s *nearSpace, live bool) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	s.live = live
+	n.clear(s)
+}
+
+// clear forgets every key of the namespace, it must be called with mx
+// locked.
+func (n *nearCache) clear(s *nearSpace) {
+	s.items = make(map[string]*list.Element)
+	s.lru.Init()
+	for _, r := range s.pending {
+		r.gen++
+	}
+}
+
+// watch keeps the stream of the namespace up until the cache is closed.
+func (n *nearCache) watch(ns string, s *nearSpace) {
+	defer n.wg.Done()
+	for attempt := 0; ; attempt++ {
+		if n.stream(ns, s) {
+			attempt = 0
+		}
+		n.reset(s, false)
+		d := minReconnect << uint(attempt)
+		if d <= 0 || d > maxReconnect {
+			d = maxReconnect
+		}
+		wait := time.NewTimer(d)
+		select {
+		case <-wait.C:
+		case <-n.ctx.Done():
+			wait.Stop()
+			return
+		}
+	}
+}
+
+// stream applies changes of the namespace until the stream ends and
+// reports whether it was ready.
+func (n *nearCache) stream(ns string, s *nearSpace) (ready bool) {
+	req, err := http.NewRequest("GET", n.conn.sock+strings.TrimSuffix(APIPath(ns, "watch"), "/"), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := n.conn.do(req.WithContext(n.ctx))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var change storage.Change
+		if err := dec.Decode(&change); err != nil {
+			return ready
+		}
+		switch change.Op {
+		case watchReady:
+			ready = true
+			n.reset(s, true)
+		case watchPing:
+		case watchReset:
+			return ready
+		case storage.ChangeFlush:
+			n.flush(ns)
+		default:
+			n.invalidate(ns, change.Key)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"github.com/Phil192/rediq/trace"
+	"time"
+)
+
+type clientOpt func(o *clientOptions)
+
+type clientOptions struct {
+	caFile   string
+	certFile string
+	keyFile  string
+	tokens   TokenSource
+	tracer   trace.Tracer
+
+	login       string
+	pass        string
+	sharedToken bool
+
+	timeout time.Duration
+
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	maxIdle     int
+	idleTimeout time.Duration
+
+	vnodes   int
+	replicas int
+	health   time.Duration
+
+	nearSize int
+	nearTTL  time.Duration
+}
+
+// RootCA makes client trust server certificates signed by CAs from the file.
+func RootCA(caFile string) clientOpt {
+	return func(o *clientOptions) {
+		o.caFile = caFile
+	}
+}
+
+// ClientCert is presented to the server with mutual TLS enabled.
+func ClientCert(certFile, keyFile string) clientOpt {
+	return func(o *clientOptions) {
+		o.certFile = certFile
+		o.keyFile = keyFile
+	}
+}
+
+// Tokens authenticates requests with bearer tokens from src
+// instead of login and password.
+func Tokens(src TokenSource) clientOpt {
+	return func(o *clientOptions) {
+		o.tokens = src
+	}
+}
+
+// Tracer starts a client span with t for every request, a child of the
+// span in the context set by WithContext.
+func Tracer(t trace.Tracer) clientOpt {
+	return func(o *clientOptions) {
+		o.tracer = t
+	}
+}
+
+// BasicAuth authenticates requests of Client with login and password.
+func BasicAuth(login, pass string) clientOpt {
+	return func(o *clientOptions) {
+		o.login = login
+		o.pass = pass
+	}
+}
+
+// SharedToken sends login and password as the sha1 token header checked
+// by servers without an ACL, instead of basic auth.
+func SharedToken(enabled bool) clientOpt {
+	return func(o *clientOptions) {
+		o.sharedToken = enabled
+	}
+}
+
+// Timeout limits every attempt of a request including reading the
+// response, zero means no limit.
+func Timeout(d time.Duration) clientOpt {
+	return func(o *clientOptions) {
+		o.timeout = d
+	}
+}
+
+// Retry makes Client retry requests failed with network errors or
+// statuses 429, 502, 503 and 504 up to n times. The wait starts with
+// backoff and doubles up to max, with jitter.
+func Retry(n int, backoff, max time.Duration) clientOpt {
+	return func(o *clientOptions) {
+		o.retries = n
+		o.backoff = backoff
+		o.maxBackoff = max
+	}
+}
+
+// Pool keeps up to n idle connections to the server and closes them
+// after being idle for idle.
+func Pool(n int, idle time.Duration) clientOpt {
+	return func(o *clientOptions) {
+		o.maxIdle = n
+		o.idleTimeout = idle
+	}
+}
+
+// VirtualNodes places every node of Cluster on the hash ring n times,
+// more points spread keys more evenly.
+func VirtualNodes(n int) clientOpt {
+	return func(o *clientOptions) {
+		o.vnodes = n
+	}
+}
+
+// Replicas makes Cluster write every key to n nodes and read it from
+// the next of them if the first one fails.
+func Replicas(n int) clientOpt {
+	return func(o *clientOptions) {
+		o.replicas = n
+	}
+}
+
+// HealthCheck makes Cluster ping its nodes every interval, failed nodes
+// are removed from the ring until they answer again. Zero disables the
+// checks, then nodes are never removed.
+func HealthCheck(interval time.Duration) clientOpt {
+	return func(o *clientOptions) {
+		o.health = interval
+	}
+}
+
+// NearCache makes Client keep up to size values read by Get of every
+// namespace in process for up to ttl. The server pushes changes of keys
+// over a watch stream and values are served only while it is up. Cached
+// values are shared between callers, which must not modify them.
+func NearCache(size int, ttl time.Duration) clientOpt {
+	return func(o *clientOptions) {
+		o.nearSize = size
+		o.nearTTL = ttl
+	}
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// ring is a consistent hash ring, each node is placed on it vnodes
+// times. It is immutable, changed rings are built anew.
+type ring struct {
+	points []uint32
+	owners map[uint32]string
+	nodes  int
+}
+
+func newRing(nodes []string, vnodes int) *ring {
+	r := &ring{owners: make(map[uint32]string, len(nodes)*vnodes), nodes: len(nodes)}
+	// sorted, so that colliding points go to the same node everywhere
+	sorted := append([]string(nil), nodes...)
+	sort.Strings(sorted)
+	for _, node := range sorted {
+		for i := 0; i < vnodes; i++ {
+			p := hash(node + "#" + strconv.Itoa(i))
+			if _, taken := r.owners[p]; taken {
+				continue
+			}
+			r.owners[p] = node
+			r.points = append(r.points, p)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// lookup returns up to n distinct nodes of key, the owner first and
+// then the next nodes clockwise.
+func (r *ring) lookup(key string, n int) []string {
+	if len(r.points) == 0 {
+		return nil
+	}
+	if n > r.nodes {
+		n = r.nodes
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	nodes := make([]string, 0, n)
+	for j := 0; j < len(r.points) && len(nodes) < n; j++ {
+		node := r.owners[r.points[(i+j)%len(r.points)]]
+		if !contains(nodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// hash spreads similar keys evenly unlike crc32, which is linear.
+func hash(s string) uint32 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"github.com/Phil192/rediq/auth"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// refreshBefore is how long before expiry a token gets replaced.
+const refreshBefore = 10 * time.Second
+
+// TokenSource issues a new bearer token with its expiry time.
+type TokenSource func() (string, time.Time, error)
+
+// HMACTokens mints tokens with claims locally, the secret must be
+// the one the server was started with.
+func HMACTokens(secret []byte, claims auth.Claims, ttl time.Duration) TokenSource {
+	return func() (string, time.Time, error) {
+		token, err := auth.Mint(secret, claims, ttl)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		return token, time.Now().Add(ttl), nil
+	}
+}
+
+// tokenCache keeps the current token and asks source for a new one
+// when it's about to expire.
+type tokenCache struct {
+	mx      sync.Mutex
+	source  TokenSource
+	token   string
+	expires time.Time
+}
+
+func (t *tokenCache) get(force bool) (string, error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if force || time.Now().Add(refreshBefore).After(t.expires) {
+		token, expires, err := t.source()
+		if err != nil {
+			return "", err
+		}
+		t.token, t.expires = token, expires
+	}
+	return t.token, nil
+}
+
+func (t *tokenCache) authorize(req *http.Request, force bool) error {
+	token, err := t.get(force)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Phil192/rediq/storage"
+	"sort"
+	"strings"
+	"time"
+)
+
+type serverInfo struct {
+	storage.Stats
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Clients   int64  `json:"clients"`
+	HeapBytes uint64 `json:"heap_bytes"`
+}
+
+// renderInfo formats the info response in sections, like redis-cli does.
+func renderInfo(data []byte) (string, error) {
+	var i serverInfo
+	if err := json.Unmarshal(data, &i); err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "# Server")
+	fmt.Fprintf(&b, "version: %s\n", i.Version)
+	fmt.Fprintf(&b, "go_version: %s\n", i.GoVersion)
+	fmt.Fprintf(&b, "started: %s\n", i.Started.Format(time.RFC3339))
+	fmt.Fprintf(&b, "uptime: %s\n", i.Uptime.Truncate(time.Second))
+	fmt.Fprintf(&b, "clients: %d\n", i.Clients)
+
+	fmt.Fprintln(&b, "\n# Memory")
+	fmt.Fprintf(&b, "values_bytes: %d\n", i.Bytes)
+	fmt.Fprintf(&b, "heap_bytes: %d\n", i.HeapBytes)
+	if i.Compression != "" {
+		fmt.Fprintf(&b, "compression: %s\n", i.Compression)
+		fmt.Fprintf(&b, "compressed_keys: %d\n", i.CompressedKeys)
+		fmt.Fprintf(&b, "compression_ratio: %.2f\n", i.CompressionRatio)
+	}
+
+	fmt.Fprintln(&b, "\n# Persistence")
+	if i.LastDump.IsZero() {
+		fmt.Fprintln(&b, "last_dump: never")
+	} else {
+		fmt.Fprintf(&b, "last_dump: %s\n", i.LastDump.Format(time.RFC3339))
+	}
+	if i.LastDumpErr == "" {
+		fmt.Fprintln(&b, "last_dump_status: ok")
+	} else {
+		fmt.Fprintf(&b, "last_dump_status: %s\n", i.LastDumpErr)
+	}
+
+	fmt.Fprintln(&b, "\n# Keyspace")
+	fmt.Fprintf(&b, "namespaces: %d\n", i.Namespaces)
+	fmt.Fprintf(&b, "shards: %d\n", i.Shards)
+	fmt.Fprintf(&b, "keys: %d\n", i.Keys)
+	fmt.Fprintf(&b, "keys_with_ttl: %d\n", i.KeysWithTTL)
+	for _, t := range sortedNames(i.KeysByType) {
+		fmt.Fprintf(&b, "keys_%s: %d\n", t, i.KeysByType[t])
+	}
+	names := make([]string, 0, len(i.ShardKeys))
+	for name := range i.ShardKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		shards := i.ShardKeys[name]
+		keys := 0
+		for _, n := range shards {
+			keys += n
+		}
+		fmt.Fprintf(&b, "%s: keys=%d shards=%d\n", name, keys, len(shards))
+	}
+	return b.String(), nil
+}
+
+func sortedNames(m map[string]int) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type slowEntry struct {
+	ID       int64         `json:"id"`
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+	Command  string        `json:"command"`
+	Args     []string      `json:"args"`
+	Client   string        `json:"client"`
+}
+
+func renderSlowLog(data []byte) (string, error) {
+	var entries []slowEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if len(entries) == 0 {
+		fmt.Fprintln(&b, "(empty)")
+	}
+	for _, e := range entries {
+		fmt.Fprintf(&b, "%d) %s %s %s %s %s\n",
+			e.ID,
+			e.Time.Format(time.RFC3339),
+			e.Duration,
+			e.Client,
+			e.Command,
+			strings.Join(e.Args, " "),
+		)
+	}
+	return b.String(), nil
+}
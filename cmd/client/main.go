@@ -14,24 +14,34 @@ import (
 func main() {
 	login := flag.String("login", "login", "login for basic auth")
 	password := flag.String("password", "password", "password for basic auth")
-	sock := flag.String("socket", "http://0.0.0.0:8081", "socket to request")
+	sock := flag.String("socket", "http://0.0.0.0:8081", "socket to request, use https:// for TLS")
+	ca := flag.String("ca", "", "CA file to verify server certificate")
+	cert := flag.String("cert", "", "client certificate for mutual TLS")
+	key := flag.String("key", "", "client key for mutual TLS")
+	shared := flag.Bool("sharedtoken", false, "send the TOKEN header instead of basic auth, for servers without -acl")
 	flag.Parse()
 
 	shell := ishell.New()
-	cli := client.NewClient(
+	cli, err := client.NewClient(
 		*sock,
 		*login,
 		*password,
+		client.RootCA(*ca),
+		client.ClientCert(*cert, *key),
+		client.SharedToken(*shared),
 	)
-	resp, err := cli.Get(*sock, "/ping")
 	if err != nil {
-		fail("Can't connect to cache server", string(resp))
+		fail("Can't create client", err)
+		return
+	}
+	if err := cli.Ping(); err != nil {
+		fail("Can't connect to cache server", err)
 		return
 	}
 	notice("Rediq cache storage. Simple Interactive Client")
 	shell.AddCmd(&ishell.Cmd{
 		Name: "set",
-		Help: "set value to cache with time to live",
+		Help: "set value to cache with time to live and optional tags",
 		Func: func(c *ishell.Context) {
 			if len(c.Args) < 3 {
 				fail("must be three values")
@@ -42,14 +52,14 @@ func main() {
 				fail(err)
 				return
 			}
-			u.Path = "/api/v1/set/"
+			u.Path = client.APIPath(cli.Namespace(), "set")
 			ttl, err := strconv.Atoi(c.Args[2])
 			if err != nil {
 				fail(err)
 				return
 			}
 			dur := time.Duration(ttl) * time.Second
-			body, err := cli.Post(u.String(), c.Args[0], c.Args[1], dur)
+			body, err := cli.Post(u.String(), c.Args[0], c.Args[1], dur, c.Args[3:]...)
 			if err != nil {
 				fail(err)
 				return
@@ -66,7 +76,7 @@ func main() {
 				fail(err)
 				return
 			}
-			u.Path = "/api/v1/get/"
+			u.Path = client.APIPath(cli.Namespace(), "get")
 			body, err := cli.Get(u.String(), c.Args[0])
 			if err != nil {
 				fail(err)
@@ -92,7 +102,7 @@ func main() {
 			q.Set("key", c.Args[0])
 			q.Set("index", c.Args[1])
 			u.RawQuery = q.Encode()
-			u.Path = "/api/v1/getby/"
+			u.Path = client.APIPath(cli.Namespace(), "getby")
 			body, err := cli.Get(u.String(), "")
 			if err != nil {
 				fail(err)
@@ -110,7 +120,29 @@ func main() {
 				fail(err)
 				return
 			}
-			u.Path = "/api/v1/remove/"
+			u.Path = client.APIPath(cli.Namespace(), "remove")
+			body, err := cli.Delete(u.String(), c.Args[0])
+			if err != nil {
+				fail(err)
+				return
+			}
+			success(string(body))
+		},
+	})
+	shell.AddCmd(&ishell.Cmd{
+		Name: "invalidate",
+		Help: "remove all values with tag",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) != 1 {
+				fail("must be one value")
+				return
+			}
+			u, err := url.ParseRequestURI(cli.Socket())
+			if err != nil {
+				fail(err)
+				return
+			}
+			u.Path = client.APIPath(cli.Namespace(), "tag")
 			body, err := cli.Delete(u.String(), c.Args[0])
 			if err != nil {
 				fail(err)
@@ -128,7 +160,7 @@ func main() {
 				fail(err)
 				return
 			}
-			u.Path = "/api/v1/keys/"
+			u.Path = client.APIPath(cli.Namespace(), "keys")
 			body, err := cli.Get(u.String(), c.Args[0])
 			if err != nil {
 				fail(err)
@@ -137,6 +169,183 @@ func main() {
 			c.Println(string(body))
 		},
 	})
+	shell.AddCmd(&ishell.Cmd{
+		Name: "select",
+		Help: "switch namespace, no args for the default one",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) > 1 {
+				fail("must be one value or none")
+				return
+			}
+			ns := ""
+			if len(c.Args) == 1 {
+				ns = c.Args[0]
+			}
+			cli.Select(ns)
+			if ns == "" {
+				shell.SetPrompt(">>> ")
+				return
+			}
+			shell.SetPrompt(fmt.Sprintf("[%s] >>> ", ns))
+		},
+	})
+	shell.AddCmd(&ishell.Cmd{
+		Name: "dbsize",
+		Help: "get number of keys in namespace",
+		Func: func(c *ishell.Context) {
+			u, err := url.ParseRequestURI(cli.Socket())
+			if err != nil {
+				fail(err)
+				return
+			}
+			u.Path = client.APIPath(cli.Namespace(), "dbsize")
+			body, err := cli.Get(u.String(), "")
+			if err != nil {
+				fail(err)
+				return
+			}
+			success(string(body))
+		},
+	})
+	shell.AddCmd(&ishell.Cmd{
+		Name: "flushdb",
+		Help: "remove all keys from namespace",
+		Func: func(c *ishell.Context) {
+			u, err := url.ParseRequestURI(cli.Socket())
+			if err != nil {
+				fail(err)
+				return
+			}
+			u.Path = client.APIPath(cli.Namespace(), "flushdb")
+			body, err := cli.Delete(u.String(), "")
+			if err != nil {
+				fail(err)
+				return
+			}
+			success(string(body))
+		},
+	})
+	shell.AddCmd(&ishell.Cmd{
+		Name: "flushall",
+		Help: "remove all keys from all namespaces",
+		Func: func(c *ishell.Context) {
+			u, err := url.ParseRequestURI(cli.Socket())
+			if err != nil {
+				fail(err)
+				return
+			}
+			u.Path = "/api/v1/flushall"
+			body, err := cli.Delete(u.String(), "")
+			if err != nil {
+				fail(err)
+				return
+			}
+			success(string(body))
+		},
+	})
+	shell.AddCmd(&ishell.Cmd{
+		Name: "namespaces",
+		Help: "list namespaces with number of keys",
+		Func: func(c *ishell.Context) {
+			u, err := url.ParseRequestURI(cli.Socket())
+			if err != nil {
+				fail(err)
+				return
+			}
+			u.Path = "/api/v1/namespaces"
+			body, err := cli.Get(u.String(), "")
+			if err != nil {
+				fail(err)
+				return
+			}
+			c.Println(string(body))
+		},
+	})
+	shell.AddCmd(&ishell.Cmd{
+		Name: "usage",
+		Help: "show resources used by namespaces and their quotas",
+		Func: func(c *ishell.Context) {
+			u, err := url.ParseRequestURI(cli.Socket())
+			if err != nil {
+				fail(err)
+				return
+			}
+			u.Path = "/api/v1/admin/usage"
+			body, err := cli.Get(u.String(), "")
+			if err != nil {
+				fail(err)
+				return
+			}
+			c.Println(string(body))
+		},
+	})
+	shell.AddCmd(&ishell.Cmd{
+		Name: "info",
+		Help: "show server information and statistics",
+		Func: func(c *ishell.Context) {
+			u, err := url.ParseRequestURI(cli.Socket())
+			if err != nil {
+				fail(err)
+				return
+			}
+			u.Path = "/api/v1/info"
+			body, err := cli.Get(u.String(), "")
+			if err != nil {
+				fail(err)
+				return
+			}
+			out, err := renderInfo(body)
+			if err != nil {
+				fail(string(body))
+				return
+			}
+			c.Print(out)
+		},
+	})
+	shell.AddCmd(&ishell.Cmd{
+		Name: "slowlog",
+		Help: "slowlog get [count] shows slow commands, slowlog reset clears the log",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) == 0 || len(c.Args) > 2 {
+				fail("must be get [count] or reset")
+				return
+			}
+			u, err := url.ParseRequestURI(cli.Socket())
+			if err != nil {
+				fail(err)
+				return
+			}
+			u.Path = "/api/v1/admin/slowlog"
+			switch c.Args[0] {
+			case "get":
+				if len(c.Args) == 2 {
+					q := u.Query()
+					q.Set("count", c.Args[1])
+					u.RawQuery = q.Encode()
+				}
+				body, err := cli.Get(u.String(), "")
+				if err != nil {
+					fail(err)
+					return
+				}
+				out, err := renderSlowLog(body)
+				if err != nil {
+					fail(string(body))
+					return
+				}
+				c.Print(out)
+			case "reset":
+				body, err := cli.Delete(u.String(), "")
+				if err != nil {
+					fail(err)
+					return
+				}
+				success(string(body))
+			default:
+				fail("must be get [count] or reset")
+			}
+		},
+	})
 	shell.Run()
 }
 
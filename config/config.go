@@ -0,0 +1,250 @@
+// Package config reads server settings from a yaml file and environment
+// and tells which of them can be changed without restart.
+package config
+
+import (
+	"fmt"
+	"github.com/Phil192/rediq/storage"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix starts environment overrides, e.g. REDIQ_LISTEN_SOCKET
+// overrides listen.socket.
+const EnvPrefix = "REDIQ"
+
+// Config of the server. Fields tagged with reload:"hot" are applied by
+// reload, other changed fields are reported as needing a restart.
+// Secrets (TOKEN, TOKEN_SECRET, ADMIN_PASSWORD, dump keys) are read
+// from the environment only.
+type Config struct {
+	Storage     Storage     `yaml:"storage"`
+	Persistence Persistence `yaml:"persistence"`
+	Auth        Auth        `yaml:"auth"`
+	Listen      Listen      `yaml:"listen"`
+	Log         Log         `yaml:"log"`
+	Limits      Limits      `yaml:"limits"`
+	Audit       Audit       `yaml:"audit"`
+}
+
+type Storage struct {
+	Shards   uint `yaml:"shards"`
+	Items    uint `yaml:"items"`
+	GCCap    int  `yaml:"gccap"`
+	Compress int  `yaml:"compress"`
+}
+
+type Persistence struct {
+	Dump       string `yaml:"dump"`
+	DumpKey    string `yaml:"dump_key"`
+	DumpKeyOld string `yaml:"dump_key_old"`
+	// EncryptPlain loads a plain dump with DumpKey set, to encrypt it
+	EncryptPlain bool `yaml:"encrypt_plain"`
+}
+
+type Auth struct {
+	// ACL is the users file, users are reloaded from it on reload
+	ACL string `yaml:"acl"`
+	// Disabled serves requests without authentication, it can't be
+	// combined with ACL or TOKEN_SECRET
+	Disabled bool `yaml:"disabled"`
+}
+
+type Listen struct {
+	Socket   string        `yaml:"socket"`
+	Cert     string        `yaml:"cert"`
+	Key      string        `yaml:"key"`
+	ClientCA string        `yaml:"client_ca"`
+	Shutdown time.Duration `yaml:"shutdown"`
+	// PublicMetrics serves /metrics without authentication
+	PublicMetrics bool `yaml:"public_metrics"`
+}
+
+type Log struct {
+	Level  int    `yaml:"level" reload:"hot"`
+	File   string `yaml:"file"`
+	ToFile bool   `yaml:"to_file"`
+	// Format is json or text
+	Format string `yaml:"format" reload:"hot"`
+	// Values adds stored values to the request log, they are redacted
+	// otherwise
+	Values bool `yaml:"values"`
+}
+
+type Limits struct {
+	SlowLog    time.Duration                      `yaml:"slowlog" reload:"hot"`
+	SlowLogLen int                                `yaml:"slowlog_len" reload:"hot"`
+	Namespaces map[string]storage.NamespaceConfig `yaml:"namespaces" reload:"hot"`
+}
+
+// Audit log of admin commands and writes, disabled if File is empty.
+type Audit struct {
+	File string `yaml:"file"`
+	// Namespaces with audited writes, all of them if empty
+	Namespaces []string `yaml:"namespaces"`
+}
+
+// Default is the config of a server started without file and flags.
+func Default() *Config {
+	return &Config{
+		Storage: Storage{
+			Shards: 256,
+			Items:  2048,
+			GCCap:  128,
+		},
+		Persistence: Persistence{
+			Dump: "./var/cache.dump",
+		},
+		Listen: Listen{
+			Socket:   "0.0.0.0:8081",
+			Shutdown: 10 * time.Second,
+		},
+		Log: Log{
+			Level:  5,
+			File:   "./var/cache.log",
+			Format: "text",
+		},
+		Limits: Limits{
+			SlowLog:    10 * time.Millisecond,
+			SlowLogLen: 128,
+		},
+	}
+}
+
+// LoadFile reads the yaml file over cfg, settings missing in the file
+// keep their values. Unknown settings are errors.
+func LoadFile(path string, cfg *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// ApplyEnv overrides settings with environment variables named by
+// EnvPrefix, section and setting, like REDIQ_LOG_LEVEL. Lists are comma
+// separated, maps can't be overridden.
+func ApplyEnv(cfg *Config) error {
+	var err error
+	walk(reflect.ValueOf(cfg).Elem(), nil, func(f field) {
+		if err != nil || f.value.Kind() == reflect.Map {
+			return
+		}
+		name := EnvPrefix + "_" + strings.ToUpper(strings.Replace(f.name, ".", "_", -1))
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if perr := parse(f.value, s); perr != nil {
+			err = fmt.Errorf("%s: %s", name, perr)
+		}
+	})
+	return err
+}
+
+func parse(v reflect.Value, s string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Slice:
+		var list []string
+		if s != "" {
+			list = strings.Split(s, ",")
+		}
+		v.Set(reflect.ValueOf(list))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint:
+		i, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetUint(i)
+	}
+	return nil
+}
+
+// Report of a reload: settings applied on the fly and changed settings
+// which need a restart, named like section.setting.
+type Report struct {
+	Applied []string `json:"applied"`
+	Restart []string `json:"restart_required"`
+}
+
+// Reload returns running with hot settings taken from next and reports
+// what has changed. Running itself is not changed.
+func Reload(running, next *Config) (*Config, Report) {
+	cfg := *running
+	report := Report{Applied: []string{}, Restart: []string{}}
+	nextFields := make(map[string]field)
+	walk(reflect.ValueOf(next).Elem(), nil, func(f field) {
+		nextFields[f.name] = f
+	})
+	walk(reflect.ValueOf(&cfg).Elem(), nil, func(f field) {
+		n := nextFields[f.name]
+		if reflect.DeepEqual(f.value.Interface(), n.value.Interface()) {
+			return
+		}
+		if !f.hot {
+			report.Restart = append(report.Restart, f.name)
+			return
+		}
+		f.value.Set(n.value)
+		report.Applied = append(report.Applied, f.name)
+	})
+	sort.Strings(report.Applied)
+	sort.Strings(report.Restart)
+	return &cfg, report
+}
+
+type field struct {
+	name  string
+	value reflect.Value
+	hot   bool
+}
+
+// walk calls fn for the settings of sections of v.
+func walk(v reflect.Value, path []string, fn func(field)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name := strings.Split(sf.Tag.Get("yaml"), ",")[0]
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			walk(fv, append(path, name), fn)
+			continue
+		}
+		fn(field{
+			name:  strings.Join(append(path, name), "."),
+			value: fv,
+			hot:   sf.Tag.Get("reload") == "hot",
+		})
+	}
+}
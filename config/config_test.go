@@ -0,0 +1,86 @@
+package config
+
+import (
+	"github.com/Phil192/rediq/storage"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+storage:
+  shards: 16
+listen:
+  socket: 127.0.0.1:9000
+log:
+  level: 4
+limits:
+  namespaces:
+    tenant:
+      max_keys: 10
+      default_ttl: 1m
+      eviction: random
+`
+
+func TestLoad(t *testing.T) {
+	r := require.New(t)
+	path := filepath.Join(os.TempDir(), "rediq-config.yaml")
+	defer os.Remove(path)
+	r.NoError(ioutil.WriteFile(path, []byte(testConfig), 0600))
+
+	cfg := Default()
+	r.NoError(LoadFile(path, cfg))
+	r.Equal(uint(16), cfg.Storage.Shards)
+	r.Equal(uint(2048), cfg.Storage.Items)
+	r.Equal(storage.NamespaceConfig{
+		MaxKeys:    10,
+		DefaultTTL: time.Minute,
+		Eviction:   storage.EvictRandom,
+	}, cfg.Limits.Namespaces["tenant"])
+
+	os.Setenv("REDIQ_LISTEN_SOCKET", "0.0.0.0:9001")
+	os.Setenv("REDIQ_LISTEN_SHUTDOWN", "3s")
+	defer os.Unsetenv("REDIQ_LISTEN_SOCKET")
+	defer os.Unsetenv("REDIQ_LISTEN_SHUTDOWN")
+	r.NoError(ApplyEnv(cfg))
+	r.Equal("0.0.0.0:9001", cfg.Listen.Socket)
+	r.Equal(3*time.Second, cfg.Listen.Shutdown)
+	os.Setenv("REDIQ_AUDIT_NAMESPACES", "a,b")
+	defer os.Unsetenv("REDIQ_AUDIT_NAMESPACES")
+	r.NoError(ApplyEnv(cfg))
+	r.Equal([]string{"a", "b"}, cfg.Audit.Namespaces)
+	os.Setenv("REDIQ_STORAGE_SHARDS", "many")
+	defer os.Unsetenv("REDIQ_STORAGE_SHARDS")
+	r.Error(ApplyEnv(cfg))
+
+	r.NoError(ioutil.WriteFile(path, []byte("storage:\n  shard: 1\n"), 0600))
+	r.Error(LoadFile(path, Default()))
+	r.NoError(ioutil.WriteFile(path, []byte("limits:\n  namespaces:\n    a:\n      eviction: lru\n"), 0600))
+	r.Error(LoadFile(path, Default()))
+}
+
+func TestReload(t *testing.T) {
+	r := require.New(t)
+	running := Default()
+	next := Default()
+	next.Log.Level = 2
+	next.Storage.Shards = 1
+	next.Listen.Socket = "127.0.0.1:1"
+	next.Limits.Namespaces = map[string]storage.NamespaceConfig{"a": {MaxKeys: 1}}
+	next.Limits.SlowLog = time.Second
+
+	cfg, report := Reload(running, next)
+	r.Equal([]string{"limits.namespaces", "limits.slowlog", "log.level"}, report.Applied)
+	r.Equal([]string{"listen.socket", "storage.shards"}, report.Restart)
+	r.Equal(2, cfg.Log.Level)
+	r.Equal(uint(256), cfg.Storage.Shards)
+	r.Equal(uint(1), cfg.Limits.Namespaces["a"].MaxKeys)
+	r.Equal(5, running.Log.Level)
+
+	_, report = Reload(cfg, cfg)
+	r.Empty(report.Applied)
+	r.Empty(report.Restart)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/Phil192/rediq/migrate"
+	"github.com/Phil192/rediq/storage"
+	"io"
+	"os"
+)
+
+// dumpFlags open the dump of a stopped server for offline import and
+// export.
+type dumpFlags struct {
+	dump       *string
+	dumpKey    *string
+	dumpKeyOld *string
+	plain      *bool
+	format     *string
+	ns         *string
+}
+
+func newDumpFlags(fs *flag.FlagSet, formats string) *dumpFlags {
+	return &dumpFlags{
+		dump:       fs.String("dump", "./var/cache.dump", "path to dump of the stopped server"),
+		dumpKey:    fs.String("dumpkey", "", "file with AES key of the dump, DUMP_KEY env is used if empty"),
+		dumpKeyOld: fs.String("dumpkeyold", "", "file with previous AES key of the dump, DUMP_KEY_OLD env is used if empty"),
+		plain:      fs.Bool("encryptplain", false, "load a plain dump with -dumpkey set to encrypt it"),
+		format:     fs.String("format", "jsonl", formats),
+		ns:         fs.String("ns", "", "namespace of csv keys, jsonl records without namespace and Redis db 0"),
+	}
+}
+
+// open loads the dump, Close of the cache writes it back.
+func (f *dumpFlags) open(ctx context.Context) (storage.StorerV2, error) {
+	key, err := loadKey(*f.dumpKey, "DUMP_KEY")
+	if err != nil {
+		return nil, err
+	}
+	oldKey, err := loadKey(*f.dumpKeyOld, "DUMP_KEY_OLD")
+	if err != nil {
+		return nil, err
+	}
+	var oldKeys [][]byte
+	if oldKey != nil {
+		oldKeys = append(oldKeys, oldKey)
+	}
+	c := storage.NewCacheV2(storage.DumpPath(*f.dump), storage.DumpEncryption(key, oldKeys...),
+		storage.EncryptPlainDump(*f.plain))
+	if err := c.Run(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// importData loads a file into the dump of a stopped server, e.g. to
+// seed it from a Redis backup:
+//
+//	rediq import -format rdb -i dump.rdb -dump ./var/cache.dump
+func importData(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	df := newDumpFlags(fs, "jsonl, csv or rdb")
+	in := fs.String("i", "", "file to import, stdin if empty")
+	mode := fs.String("mode", "merge", "merge keeps keys missing in the file, replace drops them")
+	fs.Parse(args)
+
+	format, err := migrate.ParseFormat(*df.format)
+	if err != nil {
+		return err
+	}
+	m, err := storage.ParseImportMode(*mode)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	ctx := context.Background()
+	c, err := df.open(ctx)
+	if err != nil {
+		return err
+	}
+	n, err := migrate.Import(ctx, c, r, format, migrate.Options{Namespace: *df.ns, Mode: m})
+	if err != nil {
+		c.Close(ctx)
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "imported keys:", n)
+	return c.Close(ctx)
+}
+
+// exportData writes the dump of a stopped server in an interoperable
+// format:
+//
+//	rediq export -format csv -o keys.csv -dump ./var/cache.dump
+func exportData(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	df := newDumpFlags(fs, "jsonl or csv")
+	out := fs.String("o", "", "file to export to, stdout if empty")
+	fs.Parse(args)
+
+	format, err := migrate.ParseFormat(*df.format)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	c, err := df.open(ctx)
+	if err != nil {
+		return err
+	}
+	// the dump is removed on load, so it is written back in any case
+	defer c.Close(ctx)
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := migrate.Export(ctx, c, w, format, migrate.Options{Namespace: *df.ns})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "exported keys:", n)
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"github.com/Phil192/rediq/config"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// listFlag is a comma separated list.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = nil
+	if s != "" {
+		*l = strings.Split(s, ",")
+	}
+	return nil
+}
+
+// bindFlags makes flags write to cfg, so that flags given on the command
+// line override the config file and environment.
+func bindFlags(fs *flag.FlagSet, cfg *config.Config) *string {
+	path := fs.String("config", "", "yaml config file, reloaded on SIGHUP")
+	fs.IntVar(&cfg.Log.Level, "logLevel", cfg.Log.Level, "set log level")
+	fs.StringVar(&cfg.Listen.Socket, "socket", cfg.Listen.Socket, "socket to listen")
+	fs.IntVar(&cfg.Storage.GCCap, "gccap", cfg.Storage.GCCap, "buffer size of gc channel")
+	fs.UintVar(&cfg.Storage.Shards, "shards", cfg.Storage.Shards, "max number of shards")
+	fs.UintVar(&cfg.Storage.Items, "items", cfg.Storage.Items, "max number of items in single shard")
+	fs.BoolVar(&cfg.Log.ToFile, "stdout", cfg.Log.ToFile, "write log to the -log file instead of stderr")
+	fs.StringVar(&cfg.Log.File, "log", cfg.Log.File, "log file")
+	fs.StringVar(&cfg.Persistence.Dump, "dump", cfg.Persistence.Dump, "path to dump cache data")
+	fs.StringVar(&cfg.Auth.ACL, "acl", cfg.Auth.ACL, "path to users file, shared TOKEN is used if empty")
+	fs.BoolVar(&cfg.Auth.Disabled, "noauth", cfg.Auth.Disabled, "serve requests without authentication")
+	fs.StringVar(&cfg.Listen.Cert, "cert", cfg.Listen.Cert, "TLS certificate, serve plain http if empty")
+	fs.StringVar(&cfg.Listen.Key, "key", cfg.Listen.Key, "TLS key")
+	fs.BoolVar(&cfg.Listen.PublicMetrics, "publicmetrics", cfg.Listen.PublicMetrics, "serve /metrics without authentication")
+	fs.StringVar(&cfg.Listen.ClientCA, "clientca", cfg.Listen.ClientCA, "CA to verify client certificates with, enables mutual TLS")
+	fs.DurationVar(&cfg.Limits.SlowLog, "slowlog", cfg.Limits.SlowLog, "log commands slower than this, negative disables slow log")
+	fs.IntVar(&cfg.Limits.SlowLogLen, "slowloglen", cfg.Limits.SlowLogLen, "max number of slow log entries")
+	fs.IntVar(&cfg.Storage.Compress, "compress", cfg.Storage.Compress, "gzip values of at least this many bytes, 0 disables compression")
+	fs.StringVar(&cfg.Persistence.DumpKey, "dumpkey", cfg.Persistence.DumpKey, "file with AES key to encrypt dump, DUMP_KEY env is used if empty")
+	fs.StringVar(&cfg.Persistence.DumpKeyOld, "dumpkeyold", cfg.Persistence.DumpKeyOld, "file with previous AES key to read dump during rotation, DUMP_KEY_OLD env is used if empty")
+	fs.BoolVar(&cfg.Persistence.EncryptPlain, "encryptplain", cfg.Persistence.EncryptPlain, "load a plain dump with -dumpkey set to encrypt it")
+	fs.StringVar(&cfg.Log.Format, "logformat", cfg.Log.Format, "log format, json or text")
+	fs.BoolVar(&cfg.Log.Values, "logvalues", cfg.Log.Values, "write stored values to the request log instead of redacting them")
+	fs.StringVar(&cfg.Audit.File, "audit", cfg.Audit.File, "append admin commands and writes to this file, disabled if empty")
+	fs.Var((*listFlag)(&cfg.Audit.Namespaces), "auditns", "comma separated namespaces with audited writes, all if empty")
+	fs.DurationVar(&cfg.Listen.Shutdown, "shutdown", cfg.Listen.Shutdown, "time to drain requests and to dump data on shutdown")
+	return path
+}
+
+// loadConfig builds the config from defaults, the config file,
+// environment and flags, each overriding the previous ones. Flags are
+// parsed twice: to find the file and to override it.
+func loadConfig(args []string) (*config.Config, string, error) {
+	probe := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	probe.SetOutput(ioutil.Discard)
+	path := bindFlags(probe, config.Default())
+	probe.Parse(args)
+
+	cfg := config.Default()
+	if *path != "" {
+		if err := config.LoadFile(*path, cfg); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := config.ApplyEnv(cfg); err != nil {
+		return nil, "", err
+	}
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	bindFlags(fs, cfg)
+	fs.Parse(args)
+	return cfg, *path, nil
+}
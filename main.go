@@ -1,62 +1,196 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
 	"flag"
+	"fmt"
+	"github.com/Phil192/rediq/auth"
 	"github.com/Phil192/rediq/rest"
 	"github.com/Phil192/rediq/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
 var ErrTokenNotFound = errors.New("token not found in os env")
+var ErrNoUsers = errors.New("acl has no users, set ADMIN_PASSWORD to create admin")
+var ErrSecretNotFound = errors.New("token secret not found in os env TOKEN_SECRET")
+var ErrLogFormat = errors.New("unknown log format, use json or text")
+var ErrAuthConflict = errors.New("auth is disabled, but acl or TOKEN_SECRET is set")
 
 func main() {
 	var f io.Writer
 	var err error
 
-	logLevel := flag.Int("logLevel", 5, "set log level")
-	sock := flag.String("socket", "0.0.0.0:8081", "socket to listen")
-	gcCap := flag.Int("gccap", 128, "buffer size of gc channel")
-	shardsNum := flag.Uint("shards", 256, "max number of shards")
-	itemsNum := flag.Uint("items", 2048, "max number of items in single shard")
-	output := flag.Bool("stdout", false, "stdout or log")
-	logTo := flag.String("log", "./var/cache.log", "log file")
-	dump := flag.String("dump", "./var/cache.dump", "path to dump cache data")
-	flag.Parse()
+	if len(os.Args) > 1 {
+		commands := map[string]func([]string) error{
+			"token":   mintToken,
+			"backup":  backup,
+			"restore": restore,
+			"import":  importData,
+			"export":  exportData,
+		}
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatalln(err)
+			}
+			return
+		}
+	}
 
-	log.SetLevel(log.Level(*logLevel))
+	cfg, cfgPath, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.SetLevel(log.Level(cfg.Log.Level))
+	formatter, err := logFormatter(cfg.Log.Format)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.SetFormatter(formatter)
 
-	if *output {
-		f, err = os.OpenFile(*logTo, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0755)
+	if cfg.Log.ToFile {
+		f, err = os.OpenFile(cfg.Log.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0755)
 		if err != nil {
 			log.Fatalln(err)
 		}
 		log.SetOutput(f)
 	}
-	c := storage.NewCache(
-		storage.ShardsNum(*shardsNum),
-		storage.ItemsPerShard(*itemsNum),
-		storage.DumpPath(*dump),
-		storage.GCCap(*gcCap),
-	)
-	c.Run()
+	// everything which may stop the server is checked before the dump
+	// is loaded
+	var acl *auth.ACL
+	if cfg.Auth.ACL != "" {
+		acl, err = loadACL(cfg.Auth.ACL)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	secret := []byte(os.Getenv("TOKEN_SECRET"))
+	switch {
+	case cfg.Auth.Disabled && (acl != nil || len(secret) > 0):
+		log.Fatalln(ErrAuthConflict)
+	case cfg.Auth.Disabled:
+		log.Warningln("authentication is disabled, every request is served")
+	case acl == nil && len(secret) == 0:
+		if err := checkEnvToken(); err != nil {
+			log.Fatalln(err)
+		}
+	}
 
-	if err := checkEnvToken(); err != nil {
+	var audit io.Writer
+	if cfg.Audit.File != "" {
+		af, err := os.OpenFile(cfg.Audit.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer af.Close()
+		audit = af
+	}
+
+	var cmp storage.Compressor
+	if cfg.Storage.Compress > 0 {
+		cmp = storage.Gzip(gzip.DefaultCompression)
+	}
+	key, err := loadKey(cfg.Persistence.DumpKey, "DUMP_KEY")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var oldKeys [][]byte
+	oldKey, err := loadKey(cfg.Persistence.DumpKeyOld, "DUMP_KEY_OLD")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if oldKey != nil {
+		oldKeys = append(oldKeys, oldKey)
+	}
+	c := storage.NewCacheV2(
+		storage.ShardsNum(cfg.Storage.Shards),
+		storage.ItemsPerShard(cfg.Storage.Items),
+		storage.DumpPath(cfg.Persistence.Dump),
+		storage.GCCap(cfg.Storage.GCCap),
+		storage.Compression(cmp, cfg.Storage.Compress),
+		storage.DumpEncryption(key, oldKeys...),
+		storage.EncryptPlainDump(cfg.Persistence.EncryptPlain),
+		storage.Namespaces(cfg.Limits.Namespaces),
+	)
+	if err := c.Run(context.Background()); err != nil {
 		log.Fatalln(err)
 	}
 
+	r := &reloader{args: os.Args[1:], cfg: cfg, cache: c, acl: acl}
 	app := rest.NewApp(
-		c,
+		storage.Downgrade(c),
 		rest.LogFile(f),
-		rest.SetSocket(*sock),
+		rest.SetSocket(cfg.Listen.Socket),
+		rest.ACL(acl),
+		rest.TokenSecret(secret),
+		rest.NoAuth(cfg.Auth.Disabled),
+		rest.PublicMetrics(cfg.Listen.PublicMetrics),
+		rest.TLS(cfg.Listen.Cert, cfg.Listen.Key),
+		rest.ClientCA(cfg.Listen.ClientCA),
+		rest.Version(version),
+		rest.SlowLog(cfg.Limits.SlowLog, cfg.Limits.SlowLogLen),
+		rest.Reload(r.reload),
+		rest.LogValues(cfg.Log.Values),
+		rest.Audit(audit, cfg.Audit.Namespaces...),
 	)
-	app.RouteAPI(gin.Default())
-	if err := app.ListenAndServe(); err != nil {
-		log.Fatalf("listen: %s\n", err)
+	r.slowLog = app.SetSlowLog
+	// requests are logged by the app itself
+	engine := gin.New()
+	engine.Use(gin.Recovery())
+	app.RouteAPI(engine)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- app.ListenAndServe()
+	}()
+	if cfgPath != "" {
+		log.Infoln("config loaded from", cfgPath)
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+wait:
+	for {
+		select {
+		case err := <-serveErr:
+			if err != nil {
+				log.Fatalf("listen: %s\n", err)
+			}
+			break wait
+		case <-hangup:
+			if _, err := r.reload(); err != nil {
+				log.Errorln("fail to reload config:", err)
+			}
+		case sig := <-interrupt:
+			log.Infoln("shutting down:", sig)
+			break wait
+		}
+	}
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.Listen.Shutdown)
+	defer cancel()
+	if err := app.Shutdown(drainCtx); err != nil {
+		log.Warningln("fail to drain requests:", err)
+	}
+	dumpCtx, cancelDump := context.WithTimeout(context.Background(), cfg.Listen.Shutdown)
+	defer cancelDump()
+	if err := c.Close(dumpCtx); err != nil {
+		log.Errorln("fail to close cache:", err)
+		os.Exit(1)
 	}
+	log.Infoln("stopped")
 }
 
 func checkEnvToken() error {
@@ -67,3 +201,87 @@ func checkEnvToken() error {
 	}
 	return nil
 }
+
+// loadACL reads users file and creates admin user with password
+// from ADMIN_PASSWORD env if there are no users yet.
+func loadACL(path string) (*auth.ACL, error) {
+	acl, err := auth.LoadACL(path)
+	if err != nil {
+		return nil, err
+	}
+	if acl.Len() > 0 {
+		return acl, nil
+	}
+	pass := os.Getenv("ADMIN_PASSWORD")
+	if pass == "" {
+		return nil, ErrNoUsers
+	}
+	admin := &auth.User{
+		Name:        "admin",
+		Permissions: []auth.Permission{auth.Admin},
+	}
+	if err := acl.SetUser(admin, pass); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func logFormatter(format string) (log.Formatter, error) {
+	switch format {
+	case "json":
+		return &log.JSONFormatter{}, nil
+	case "text":
+		return &log.TextFormatter{}, nil
+	}
+	return nil, ErrLogFormat
+}
+
+// loadKey reads a dump key from the file or, if path is empty, from
+// the env variable. It returns nil if neither is set.
+func loadKey(path, env string) ([]byte, error) {
+	s := os.Getenv(env)
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		s = string(data)
+	}
+	if s == "" {
+		return nil, nil
+	}
+	key, err := storage.ParseKey(s)
+	if err != nil {
+		return nil, errors.Wrap(err, env)
+	}
+	return key, nil
+}
+
+// mintToken prints a bearer token signed with TOKEN_SECRET:
+// rediq token -sub alice -ttl 1h -cmd read,set -prefix user:
+func mintToken(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	sub := fs.String("sub", "", "token subject")
+	ttl := fs.Duration("ttl", 15*time.Minute, "token lifetime")
+	cmd := fs.String("cmd", "read", "comma separated commands or permissions (read, write, admin)")
+	prefix := fs.String("prefix", "", "comma separated prefixes of accessible keys, all keys if empty")
+	fs.Parse(args)
+
+	secret := os.Getenv("TOKEN_SECRET")
+	if secret == "" {
+		return ErrSecretNotFound
+	}
+	claims := auth.Claims{
+		Subject:  *sub,
+		Commands: strings.Split(*cmd, ","),
+	}
+	if *prefix != "" {
+		claims.Prefixes = strings.Split(*prefix, ",")
+	}
+	token, err := auth.Mint([]byte(secret), claims, *ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
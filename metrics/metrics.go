@@ -0,0 +1,205 @@
+// Package metrics implements counters and histograms rendered
+// in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+type Sample struct {
+	Labels []Label
+	Value  float64
+}
+
+// Write renders a metric family of type typ (counter, gauge) with samples.
+func Write(w io.Writer, name, help, typ string, samples ...Sample) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ); err != nil {
+		return err
+	}
+	for _, s := range samples {
+		if err := writeSample(w, name, s.Labels, s.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSample(w io.Writer, name string, labels []Label, value float64) error {
+	_, err := fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels), formatValue(value))
+	return err
+}
+
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, l.Name, labelEscaper.Replace(l.Value)))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	mx     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+	series map[string][]string
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		mx:     sync.Mutex{},
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+		series: make(map[string][]string),
+	}
+}
+
+func (c *CounterVec) Add(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.values[key] += v
+	c.series[key] = values
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Render(w io.Writer) error {
+	c.mx.Lock()
+	samples := make([]Sample, 0, len(c.values))
+	for _, key := range sortedKeys(c.series) {
+		samples = append(samples, Sample{
+			Labels: zipLabels(c.labels, c.series[key]),
+			Value:  c.values[key],
+		})
+	}
+	c.mx.Unlock()
+	return Write(w, c.name, c.help, "counter", samples...)
+}
+
+type histogram struct {
+	values []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec is a histogram partitioned by label values.
+type HistogramVec struct {
+	mx      sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogram
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		mx:      sync.Mutex{},
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+}
+
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *HistogramVec) Render(w io.Writer) error {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name); err != nil {
+		return err
+	}
+	series := make(map[string][]string, len(h.series))
+	for key, s := range h.series {
+		series[key] = s.values
+	}
+	for _, key := range sortedKeys(series) {
+		s := h.series[key]
+		labels := zipLabels(h.labels, s.values)
+		for i, upper := range h.buckets {
+			le := append(labels, Label{"le", formatValue(upper)})
+			if err := writeSample(w, h.name+"_bucket", le, float64(s.counts[i])); err != nil {
+				return err
+			}
+		}
+		inf := append(labels, Label{"le", "+Inf"})
+		if err := writeSample(w, h.name+"_bucket", inf, float64(s.count)); err != nil {
+			return err
+		}
+		if err := writeSample(w, h.name+"_sum", labels, s.sum); err != nil {
+			return err
+		}
+		if err := writeSample(w, h.name+"_count", labels, float64(s.count)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func zipLabels(names, values []string) []Label {
+	labels := make([]Label, 0, len(names))
+	for i, name := range names {
+		labels = append(labels, Label{name, values[i]})
+	}
+	return labels[:len(labels):len(labels)]
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := require.New(t)
+	var buf bytes.Buffer
+	r.NoError(Write(&buf, "rediq_keys", "Keys.", "gauge",
+		Sample{Labels: []Label{{"namespace", `a"b`}}, Value: 3}))
+	r.Equal("# HELP rediq_keys Keys.\n# TYPE rediq_keys gauge\nrediq_keys{namespace=\"a\\\"b\"} 3\n", buf.String())
+}
+
+func TestCounterVec(t *testing.T) {
+	r := require.New(t)
+	c := NewCounterVec("rediq_requests_total", "Requests.", "cmd", "code")
+	c.Inc("get", "200")
+	c.Inc("get", "200")
+	c.Inc("get", "404")
+	var buf bytes.Buffer
+	r.NoError(c.Render(&buf))
+	r.Contains(buf.String(), "rediq_requests_total{cmd=\"get\",code=\"200\"} 2\n")
+	r.Contains(buf.String(), "rediq_requests_total{cmd=\"get\",code=\"404\"} 1\n")
+}
+
+func TestHistogramVec(t *testing.T) {
+	r := require.New(t)
+	h := NewHistogramVec("rediq_latency_seconds", "Latency.", []float64{0.1, 1}, "cmd")
+	h.Observe(0.05, "get")
+	h.Observe(0.5, "get")
+	h.Observe(5, "get")
+	var buf bytes.Buffer
+	r.NoError(h.Render(&buf))
+	out := buf.String()
+	r.Contains(out, "# TYPE rediq_latency_seconds histogram\n")
+	r.Contains(out, "rediq_latency_seconds_bucket{cmd=\"get\",le=\"0.1\"} 1\n")
+	r.Contains(out, "rediq_latency_seconds_bucket{cmd=\"get\",le=\"1\"} 2\n")
+	r.Contains(out, "rediq_latency_seconds_bucket{cmd=\"get\",le=\"+Inf\"} 3\n")
+	r.Contains(out, "rediq_latency_seconds_sum{cmd=\"get\"} 5.55\n")
+	r.Contains(out, "rediq_latency_seconds_count{cmd=\"get\"} 3\n")
+}
@@ -0,0 +1,92 @@
+package migrate
+
+import (
+	"context"
+	"encoding/csv"
+	"github.com/Phil192/rediq/storage"
+	"io"
+	"strconv"
+	"time"
+)
+
+// csvHeader is written on export and skipped on import. Ttl is in
+// seconds, empty or zero for keys without expiration.
+var csvHeader = []string{"key", "value", "ttl"}
+
+func exportCSV(ctx context.Context, s storage.StorerV2, w io.Writer, ns string) (int, error) {
+	if ns == "" {
+		ns = storage.DefaultNamespace
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return 0, err
+	}
+	n := 0
+	err := storage.Walk(ctx, s, func(rec storage.Record) error {
+		body, ok := rec.Value.Body.(string)
+		if rec.Namespace != ns || !ok {
+			return nil
+		}
+		ttl := ""
+		if rec.Value.TTL > 0 {
+			ttl = strconv.FormatInt(seconds(rec.Value.TTL), 10)
+		}
+		n++
+		return cw.Write([]string{rec.Key, body, ttl})
+	})
+	if err != nil {
+		return n, err
+	}
+	cw.Flush()
+	return n, cw.Error()
+}
+
+func readCSV(r io.Reader, ns string) ([]item, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	var items []item
+	for row := 1; ; row++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, &storage.ImportError{Record: row, Err: err}
+		}
+		if row == 1 && isHeader(rec) {
+			continue
+		}
+		it, err := csvItem(rec, ns)
+		if err != nil {
+			return nil, &storage.ImportError{Record: row, Err: err}
+		}
+		items = append(items, it)
+	}
+}
+
+func isHeader(rec []string) bool {
+	if len(rec) < 2 {
+		return false
+	}
+	for i := range rec {
+		if i >= len(csvHeader) || rec[i] != csvHeader[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func csvItem(rec []string, ns string) (item, error) {
+	if len(rec) < 2 || len(rec) > 3 || rec[0] == "" {
+		return item{}, storage.ErrValueType
+	}
+	it := item{ns: ns, key: rec[0], body: rec[1]}
+	if len(rec) == 3 && rec[2] != "" {
+		ttl, err := strconv.ParseInt(rec[2], 10, 64)
+		if err != nil || ttl < 0 {
+			return item{}, storage.ErrValueType
+		}
+		it.ttl = time.Duration(ttl) * time.Second
+	}
+	return it, nil
+}
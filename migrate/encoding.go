@@ -0,0 +1,223 @@
+package migrate
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+// ziplist decodes entries of a Redis ziplist, integers are returned
+// as decimal strings.
+func ziplist(data []byte) ([]string, error) {
+	// zlbytes, zltail and zllen
+	if len(data) < 11 {
+		return nil, ErrBadRDB
+	}
+	var entries []string
+	p := 10
+	for {
+		if p >= len(data) {
+			return nil, ErrBadRDB
+		}
+		if data[p] == 0xff {
+			return entries, nil
+		}
+		// previous entry length
+		if data[p] == 0xfe {
+			p += 5
+		} else {
+			p++
+		}
+		if p >= len(data) {
+			return nil, ErrBadRDB
+		}
+		enc := data[p]
+		var n int
+		switch enc >> 6 {
+		case 0:
+			n, p = int(enc&0x3f), p+1
+		case 1:
+			if p+2 > len(data) {
+				return nil, ErrBadRDB
+			}
+			n, p = int(enc&0x3f)<<8|int(data[p+1]), p+2
+		case 2:
+			if p+5 > len(data) {
+				return nil, ErrBadRDB
+			}
+			n, p = int(binary.BigEndian.Uint32(data[p+1:p+5])), p+5
+		default:
+			v, size, err := ziplistInt(data[p:])
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, strconv.FormatInt(v, 10))
+			p += size
+			continue
+		}
+		if n < 0 || p+n > len(data) {
+			return nil, ErrBadRDB
+		}
+		entries = append(entries, string(data[p:p+n]))
+		p += n
+	}
+}
+
+// ziplistInt decodes an integer entry starting with its encoding byte
+// and returns the value and the size of the entry.
+func ziplistInt(data []byte) (int64, int, error) {
+	enc := data[0]
+	need := map[byte]int{0xc0: 2, 0xd0: 4, 0xe0: 8, 0xf0: 3, 0xfe: 1}
+	if enc >= 0xf1 && enc <= 0xfd {
+		return int64(enc&0x0f) - 1, 1, nil
+	}
+	n, ok := need[enc]
+	if !ok || len(data) < n+1 {
+		return 0, 0, ErrBadRDB
+	}
+	b := data[1 : n+1]
+	switch enc {
+	case 0xc0:
+		return int64(int16(binary.LittleEndian.Uint16(b))), n + 1, nil
+	case 0xd0:
+		return int64(int32(binary.LittleEndian.Uint32(b))), n + 1, nil
+	case 0xe0:
+		return int64(binary.LittleEndian.Uint64(b)), n + 1, nil
+	case 0xf0:
+		v := int32(b[0]) | int32(b[1])<<8 | int32(b[2])<<16
+		return int64(v<<8) >> 8, n + 1, nil
+	}
+	return int64(int8(b[0])), n + 1, nil
+}
+
+// listpack decodes entries of a Redis listpack, integers are returned
+// as decimal strings.
+func listpack(data []byte) ([]string, error) {
+	// total bytes and number of elements
+	if len(data) < 7 {
+		return nil, ErrBadRDB
+	}
+	var entries []string
+	p := 6
+	for {
+		if p >= len(data) {
+			return nil, ErrBadRDB
+		}
+		enc := data[p]
+		if enc == 0xff {
+			return entries, nil
+		}
+		var head, n int
+		var val string
+		isInt := false
+		var v int64
+		switch {
+		case enc&0x80 == 0:
+			head, v, isInt = 1, int64(enc&0x7f), true
+		case enc&0xc0 == 0x80:
+			head, n = 1, int(enc&0x3f)
+		case enc&0xe0 == 0xc0:
+			if p+2 > len(data) {
+				return nil, ErrBadRDB
+			}
+			head, v, isInt = 2, signed(uint64(enc&0x1f)<<8|uint64(data[p+1]), 13), true
+		case enc&0xf0 == 0xe0:
+			if p+2 > len(data) {
+				return nil, ErrBadRDB
+			}
+			head, n = 2, int(enc&0x0f)<<8|int(data[p+1])
+		case enc == 0xf0:
+			if p+5 > len(data) {
+				return nil, ErrBadRDB
+			}
+			head, n = 5, int(binary.LittleEndian.Uint32(data[p+1:p+5]))
+		case enc >= 0xf1 && enc <= 0xf4:
+			size := map[byte]int{0xf1: 2, 0xf2: 3, 0xf3: 4, 0xf4: 8}[enc]
+			if p+1+size > len(data) {
+				return nil, ErrBadRDB
+			}
+			var u uint64
+			for i := size - 1; i >= 0; i-- {
+				u = u<<8 | uint64(data[p+1+i])
+			}
+			head, v, isInt = 1+size, signed(u, uint(size*8)), true
+		default:
+			return nil, ErrBadRDB
+		}
+		if n < 0 || p+head+n > len(data) {
+			return nil, ErrBadRDB
+		}
+		if isInt {
+			val = strconv.FormatInt(v, 10)
+		} else {
+			val = string(data[p+head : p+head+n])
+		}
+		entries = append(entries, val)
+		p += head + n
+		p += backlenSize(head + n)
+	}
+}
+
+// signed extends the sign of a bits wide integer.
+func signed(u uint64, bits uint) int64 {
+	shift := 64 - bits
+	return int64(u<<shift) >> shift
+}
+
+// backlenSize is the size of the entry length stored after a listpack
+// entry of n bytes.
+func backlenSize(n int) int {
+	switch {
+	case n < 128:
+		return 1
+	case n < 16384:
+		return 2
+	case n < 2097152:
+		return 3
+	case n < 268435456:
+		return 4
+	}
+	return 5
+}
+
+// lzfDecompress decodes LZF compressed strings of RDB files.
+func lzfDecompress(in []byte, size uint64) ([]byte, error) {
+	out := make([]byte, 0, size)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			// literal run
+			n := ctrl + 1
+			if i+n > len(in) {
+				return nil, ErrBadRDB
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+		// back reference
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, ErrBadRDB
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, ErrBadRDB
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, ErrBadRDB
+		}
+		for j := 0; j < n+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if uint64(len(out)) != size {
+		return nil, ErrBadRDB
+	}
+	return out, nil
+}
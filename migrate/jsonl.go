@@ -0,0 +1,87 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Phil192/rediq/storage"
+	"io"
+	"time"
+)
+
+// line is a jsonl record, ttl is in seconds and type follows json
+// if it is not set, like in the set command of REST API.
+type line struct {
+	Namespace string             `json:"namespace,omitempty"`
+	Key       string             `json:"key"`
+	Type      *storage.InputType `json:"type,omitempty"`
+	Value     interface{}        `json:"value"`
+	TTL       int64              `json:"ttl,omitempty"`
+	Tags      []string           `json:"tags,omitempty"`
+}
+
+func exportJSONL(ctx context.Context, s storage.StorerV2, w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	n := 0
+	err := storage.Walk(ctx, s, func(rec storage.Record) error {
+		v := rec.Value
+		if v.DataType == storage.TYPED {
+			return nil
+		}
+		typ := v.DataType
+		n++
+		return enc.Encode(line{
+			Namespace: rec.Namespace,
+			Key:       rec.Key,
+			Type:      &typ,
+			Value:     v.Body,
+			TTL:       seconds(v.TTL),
+			Tags:      v.Tags,
+		})
+	})
+	return n, err
+}
+
+func readJSONL(r io.Reader, ns string) ([]item, error) {
+	var items []item
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	for {
+		var l line
+		err := dec.Decode(&l)
+		if err == io.EOF {
+			return items, nil
+		}
+		if err == nil {
+			err = checkLine(&l)
+		}
+		if err != nil {
+			return nil, &storage.ImportError{Record: len(items) + 1, Err: err}
+		}
+		if l.Namespace == "" {
+			l.Namespace = ns
+		}
+		items = append(items, item{
+			ns:   l.Namespace,
+			key:  l.Key,
+			body: l.Value,
+			ttl:  time.Duration(l.TTL) * time.Second,
+			tags: l.Tags,
+		})
+	}
+}
+
+// checkLine converts the value to its type.
+func checkLine(l *line) error {
+	if l.Key == "" || l.Value == nil || l.TTL < 0 {
+		return storage.ErrValueType
+	}
+	if l.Type == nil {
+		return nil
+	}
+	body, err := storage.Convert(l.Value, *l.Type)
+	if err != nil {
+		return err
+	}
+	l.Value = body
+	return nil
+}
@@ -0,0 +1,116 @@
+// Package migrate moves data between rediq and other tools: newline
+// delimited json, csv of string keys and Redis RDB files.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"github.com/Phil192/rediq/storage"
+	"io"
+	"time"
+)
+
+var ErrFormat = errors.New("format must be jsonl, csv or rdb")
+var ErrNoExport = errors.New("rdb format can only be imported")
+
+type Format string
+
+const (
+	JSONL Format = "jsonl"
+	CSV   Format = "csv"
+	RDB   Format = "rdb"
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case JSONL, CSV, RDB:
+		return f, nil
+	}
+	return "", ErrFormat
+}
+
+// ContentType of exported data.
+func (f Format) ContentType() string {
+	switch f {
+	case CSV:
+		return "text/csv"
+	case RDB:
+		return "application/octet-stream"
+	}
+	return "application/x-ndjson"
+}
+
+// Options of Import and Export. Namespace is used for csv keys and
+// jsonl records without namespace, Redis database 0 goes to it as well,
+// other databases go to namespaces db1, db2 and so on.
+type Options struct {
+	Namespace string
+	Mode      storage.ImportMode
+}
+
+// item is a key to import, ttl is zero for keys without expiration.
+type item struct {
+	ns   string
+	key  string
+	body interface{}
+	ttl  time.Duration
+	tags []string
+}
+
+// seconds rounds ttl up, so that a key about to expire is not exported
+// without expiration.
+func seconds(ttl time.Duration) int64 {
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// Export writes a snapshot of s in the format and returns the number
+// of written keys. Csv holds string keys of opt.Namespace only, other
+// keys are skipped. Values of TypedCache are skipped in any format,
+// since they are readable only with their codec.
+func Export(ctx context.Context, s storage.StorerV2, w io.Writer, f Format, opt Options) (int, error) {
+	switch f {
+	case JSONL:
+		return exportJSONL(ctx, s, w)
+	case CSV:
+		return exportCSV(ctx, s, w, opt.Namespace)
+	case RDB:
+		return 0, ErrNoExport
+	}
+	return 0, ErrFormat
+}
+
+// Import loads data in the format into s and returns the number of
+// imported keys. Like storage.Import, the whole input is read before
+// the cache is changed, broken input is reported as *storage.ImportError,
+// quotas are checked before replace mode flushes and rate limits and
+// default TTL of namespaces don't apply. Replace mode flushes only the
+// namespaces present in the input. Keys expired in RDB files are skipped.
+func Import(ctx context.Context, s storage.StorerV2, r io.Reader, f Format, opt Options) (int, error) {
+	var items []item
+	var err error
+	switch f {
+	case JSONL:
+		items, err = readJSONL(r, opt.Namespace)
+	case CSV:
+		items, err = readCSV(r, opt.Namespace)
+	case RDB:
+		items, err = readRDB(r, opt.Namespace, time.Now())
+	default:
+		return 0, ErrFormat
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	records := make([]storage.Record, 0, len(items))
+	for i, it := range items {
+		rec, err := storage.NewRecord(it.ns, it.key, it.body, it.ttl, it.tags...)
+		if err != nil {
+			return 0, &storage.ImportError{Record: i + 1, Err: err}
+		}
+		records = append(records, rec)
+	}
+	return storage.ImportRecords(ctx, s, records, opt.Mode)
+}
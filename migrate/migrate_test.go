@@ -0,0 +1,250 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/Phil192/rediq/storage"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newCache(name string) storage.StorerV2 {
+	return storage.NewCacheV2(storage.DumpPath(filepath.Join(os.TempDir(), name)))
+}
+
+func TestJSONL(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	src := newCache("rediq-jsonl-src.dump")
+	r.NoError(src.Set(ctx, "s", "v", time.Hour, "t"))
+	r.NoError(src.Set(ctx, "b", []byte{0xff}, 0))
+	r.NoError(src.Select("other").Set(ctx, "set", storage.NewStringSet("x", "y"), 0))
+
+	var buf bytes.Buffer
+	n, err := Export(ctx, src, &buf, JSONL, Options{})
+	r.NoError(err)
+	r.Equal(3, n)
+	r.Contains(buf.String(), `{"namespace":"default","key":"s","type":"string","value":"v","ttl":3600,"tags":["t"]}`)
+
+	dst := newCache("rediq-jsonl-dst.dump")
+	n, err = Import(ctx, dst, &buf, JSONL, Options{})
+	r.NoError(err)
+	r.Equal(3, n)
+	v, err := dst.Get(ctx, "b")
+	r.NoError(err)
+	r.Equal([]byte{0xff}, v.Body)
+	v, err = dst.Select("other").Get(ctx, "set")
+	r.NoError(err)
+	r.Equal(storage.NewStringSet("x", "y"), v.Body)
+
+	in := `{"key":"n","value":1}` + "\n" + `{"key":"bad","type":"int","value":"x"}`
+	_, err = Import(ctx, dst, strings.NewReader(in), JSONL, Options{})
+	r.IsType(&storage.ImportError{}, err)
+	r.Equal(2, err.(*storage.ImportError).Record)
+}
+
+func TestCSV(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	src := newCache("rediq-csv.dump")
+	r.NoError(src.Set(ctx, "a", "1,2", 0))
+	r.NoError(src.Set(ctx, "b", "x", time.Minute))
+	r.NoError(src.Set(ctx, "list", []interface{}{"skipped"}, 0))
+
+	var buf bytes.Buffer
+	n, err := Export(ctx, src, &buf, CSV, Options{})
+	r.NoError(err)
+	r.Equal(2, n)
+	r.Equal("key,value,ttl\na,\"1,2\",\nb,x,60\n", buf.String())
+
+	n, err = Import(ctx, src, strings.NewReader("c,y\nd,z,10\n"), CSV, Options{Namespace: "csv", Mode: storage.ImportReplace})
+	r.NoError(err)
+	r.Equal(2, n)
+	// only the namespace of the input is replaced
+	r.Equal(3, src.Len())
+	v, err := src.Select("csv").Get(ctx, "d")
+	r.NoError(err)
+	r.Equal("z", v.Body)
+	r.Equal(10*time.Second, v.TTL)
+
+	_, err = Import(ctx, src, strings.NewReader("key,value,ttl\ne,1,-1\n"), CSV, Options{})
+	r.IsType(&storage.ImportError{}, err)
+	r.Equal(2, err.(*storage.ImportError).Record)
+}
+
+func TestExportShortTTL(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	c := newCache("rediq-short-ttl.dump")
+	r.NoError(c.Set(ctx, "k", "v", 500*time.Millisecond))
+
+	var buf bytes.Buffer
+	_, err := Export(ctx, c, &buf, CSV, Options{Namespace: storage.DefaultNamespace})
+	r.NoError(err)
+	r.Equal("key,value,ttl\nk,v,1\n", buf.String())
+	buf.Reset()
+	_, err = Export(ctx, c, &buf, JSONL, Options{})
+	r.NoError(err)
+	r.Contains(buf.String(), `"ttl":1`)
+}
+
+func TestImportQuota(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	c := storage.NewCacheV2(
+		storage.DumpPath(filepath.Join(os.TempDir(), "rediq-migrate-quota.dump")),
+		storage.Namespace("small", storage.MaxKeys(1), storage.DefaultTTL(time.Second)),
+	)
+	r.NoError(c.Select("small").Set(ctx, "kept", "v", 0))
+
+	_, err := Import(ctx, c, strings.NewReader("a,1\nb,2\n"), CSV, Options{Namespace: "small", Mode: storage.ImportReplace})
+	r.IsType(&storage.ErrQuotaExceeded{}, err)
+	_, err = c.Select("small").Get(ctx, "kept")
+	r.NoError(err)
+
+	// default TTL of the namespace doesn't apply to imported keys
+	n, err := Import(ctx, c, strings.NewReader("a,1\n"), CSV, Options{Namespace: "small", Mode: storage.ImportReplace})
+	r.NoError(err)
+	r.Equal(1, n)
+	v, err := c.Select("small").Get(ctx, "a")
+	r.NoError(err)
+	r.Equal(time.Duration(0), v.TTL)
+}
+
+// rdbWriter builds RDB files for tests.
+type rdbWriter struct {
+	bytes.Buffer
+}
+
+func (w *rdbWriter) str(s string) {
+	w.WriteByte(byte(len(s)))
+	w.WriteString(s)
+}
+
+func (w *rdbWriter) raw(b []byte) {
+	w.WriteByte(byte(len(b)))
+	w.Write(b)
+}
+
+func ziplistOf(entries ...[]byte) []byte {
+	zl := make([]byte, 10)
+	for _, e := range entries {
+		zl = append(zl, 0)
+		zl = append(zl, e...)
+	}
+	return append(zl, 0xff)
+}
+
+func listpackOf(entries ...[]byte) []byte {
+	lp := make([]byte, 6)
+	for _, e := range entries {
+		lp = append(lp, e...)
+		lp = append(lp, byte(len(e)))
+	}
+	return append(lp, 0xff)
+}
+
+func TestRDB(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	now := time.Now()
+	var w rdbWriter
+	w.WriteString("REDIS0011")
+	w.WriteByte(rdbOpAux)
+	w.str("redis-ver")
+	w.str("7.2.0")
+	w.WriteByte(rdbOpSelectDB)
+	w.WriteByte(0)
+	w.WriteByte(rdbOpResizeDB)
+	w.WriteByte(8)
+	w.WriteByte(1)
+
+	w.WriteByte(rdbString)
+	w.str("str")
+	w.str("hello")
+	// integer encoded string
+	w.WriteByte(rdbString)
+	w.str("int")
+	w.Write([]byte{0xc1, 0x39, 0x30})
+	// lzf: literal "a" and a back reference of 5 bytes
+	w.WriteByte(rdbString)
+	w.str("lzf")
+	w.Write([]byte{0xc3, 4, 6, 0, 'a', 3 << 5, 0})
+	w.WriteByte(rdbOpExpireMs)
+	binary.Write(&w, binary.LittleEndian, uint64(now.Add(time.Hour).UnixNano()/int64(time.Millisecond)))
+	w.WriteByte(rdbList)
+	w.str("list")
+	w.WriteByte(2)
+	w.str("a")
+	w.str("b")
+	w.WriteByte(rdbOpExpireMs)
+	binary.Write(&w, binary.LittleEndian, uint64(now.Add(-time.Hour).UnixNano()/int64(time.Millisecond)))
+	w.WriteByte(rdbString)
+	w.str("expired")
+	w.str("x")
+	w.WriteByte(rdbHash)
+	w.str("hash")
+	w.WriteByte(1)
+	w.str("f")
+	w.str("v")
+	w.WriteByte(rdbListZiplist)
+	w.str("ziplist")
+	w.raw(ziplistOf([]byte{0x02, 'z', 'l'}, []byte{0xf3}, []byte{0xfe, 0x80}))
+	w.WriteByte(rdbHashListpack)
+	w.str("lphash")
+	w.raw(listpackOf([]byte{0x81, 'k'}, []byte{0x05}, []byte{0x82, 'k', '2'}, []byte{0xdf, 0xff}))
+	w.WriteByte(rdbOpSelectDB)
+	w.WriteByte(2)
+	w.WriteByte(rdbListQuick2)
+	w.str("quick")
+	w.WriteByte(2)
+	w.WriteByte(2)
+	w.raw(listpackOf([]byte{0x81, 'q'}, []byte{0xf1, 0xe8, 0x03}))
+	w.WriteByte(quicklistPlain)
+	w.str("plain")
+	w.WriteByte(rdbOpEOF)
+	w.Write(make([]byte, 8))
+
+	items, err := readRDB(bytes.NewReader(w.Bytes()), "", now)
+	r.NoError(err)
+	r.Len(items, 8)
+
+	c := newCache("rediq-rdb.dump")
+	n, err := Import(ctx, c, bytes.NewReader(w.Bytes()), RDB, Options{})
+	r.NoError(err)
+	r.Equal(8, n)
+	expected := map[string]interface{}{
+		"str":     "hello",
+		"int":     "12345",
+		"lzf":     "aaaaaa",
+		"list":    []interface{}{"a", "b"},
+		"hash":    map[string]interface{}{"f": "v"},
+		"ziplist": []interface{}{"zl", "2", "-128"},
+		"lphash":  map[string]interface{}{"k": "5", "k2": "-1"},
+	}
+	for k, body := range expected {
+		v, err := c.Get(ctx, k)
+		r.NoError(err, k)
+		r.Equal(body, v.Body, k)
+	}
+	v, err := c.Get(ctx, "list")
+	r.NoError(err)
+	r.True(v.TTL > 59*time.Minute)
+	_, err = c.Get(ctx, "expired")
+	r.Equal(storage.ErrNotFound, err)
+	v, err = c.Select("db2").Get(ctx, "quick")
+	r.NoError(err)
+	r.Equal([]interface{}{"q", "1000", "plain"}, v.Body)
+
+	_, err = Import(ctx, c, bytes.NewReader(w.Bytes()[:40]), RDB, Options{})
+	r.IsType(&storage.ImportError{}, err)
+	_, err = Import(ctx, c, strings.NewReader("not rdb"), RDB, Options{})
+	r.Equal(ErrNotRDB, err)
+	_, err = Export(ctx, c, &bytes.Buffer{}, RDB, Options{})
+	r.Equal(ErrNoExport, err)
+}
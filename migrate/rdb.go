@@ -0,0 +1,364 @@
+package migrate
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/Phil192/rediq/storage"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+var ErrNotRDB = errors.New("not a redis rdb file")
+var ErrBadRDB = errors.New("broken rdb data")
+
+// rdb opcodes and value types, see rdb.h of Redis.
+const (
+	rdbOpFunction2  = 0xf5
+	rdbOpFunction   = 0xf6
+	rdbOpModuleAux  = 0xf7
+	rdbOpIdle       = 0xf8
+	rdbOpFreq       = 0xf9
+	rdbOpAux        = 0xfa
+	rdbOpResizeDB   = 0xfb
+	rdbOpExpireMs   = 0xfc
+	rdbOpExpire     = 0xfd
+	rdbOpSelectDB   = 0xfe
+	rdbOpEOF        = 0xff
+	rdbString       = 0
+	rdbList         = 1
+	rdbHash         = 4
+	rdbListZiplist  = 10
+	rdbHashZiplist  = 13
+	rdbListQuick    = 14
+	rdbHashListpack = 16
+	rdbListQuick2   = 18
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+
+	quicklistPlain = 1
+)
+
+// readRDB reads strings, lists and hashes of an RDB file, version 11
+// and older. Other value types fail the import, since their data can't
+// be skipped without parsing.
+func readRDB(r io.Reader, ns string, now time.Time) ([]item, error) {
+	rd := &rdbReader{r: bufio.NewReader(r)}
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(rd.r, header); err != nil || string(header[:5]) != "REDIS" {
+		return nil, ErrNotRDB
+	}
+	if _, err := strconv.Atoi(string(header[5:])); err != nil {
+		return nil, ErrNotRDB
+	}
+	var items []item
+	db := ns
+	var expireAt time.Time
+	for {
+		op, err := rd.r.ReadByte()
+		if err != nil {
+			return nil, rd.fail(len(items), err)
+		}
+		switch op {
+		case rdbOpEOF:
+			// checksum follows, it is not verified
+			return items, nil
+		case rdbOpSelectDB:
+			n, err := rd.length()
+			if err != nil {
+				return nil, rd.fail(len(items), err)
+			}
+			db = ns
+			if n > 0 {
+				db = fmt.Sprintf("db%d", n)
+			}
+		case rdbOpResizeDB:
+			if _, err := rd.length(); err != nil {
+				return nil, rd.fail(len(items), err)
+			}
+			if _, err := rd.length(); err != nil {
+				return nil, rd.fail(len(items), err)
+			}
+		case rdbOpAux:
+			if _, err := rd.string(); err != nil {
+				return nil, rd.fail(len(items), err)
+			}
+			if _, err := rd.string(); err != nil {
+				return nil, rd.fail(len(items), err)
+			}
+		case rdbOpExpire:
+			var sec uint32
+			if err := binary.Read(rd.r, binary.LittleEndian, &sec); err != nil {
+				return nil, rd.fail(len(items), err)
+			}
+			expireAt = time.Unix(int64(sec), 0)
+		case rdbOpExpireMs:
+			var ms uint64
+			if err := binary.Read(rd.r, binary.LittleEndian, &ms); err != nil {
+				return nil, rd.fail(len(items), err)
+			}
+			expireAt = time.Unix(0, int64(ms)*int64(time.Millisecond))
+		case rdbOpFreq:
+			if _, err := rd.r.ReadByte(); err != nil {
+				return nil, rd.fail(len(items), err)
+			}
+		case rdbOpIdle:
+			if _, err := rd.length(); err != nil {
+				return nil, rd.fail(len(items), err)
+			}
+		case rdbOpModuleAux, rdbOpFunction, rdbOpFunction2:
+			return nil, rd.fail(len(items), fmt.Errorf("unsupported rdb opcode %#x", op))
+		default:
+			key, err := rd.string()
+			if err != nil {
+				return nil, rd.fail(len(items), err)
+			}
+			body, err := rd.value(op)
+			if err != nil {
+				return nil, rd.fail(len(items), fmt.Errorf("key %q: %s", key, err))
+			}
+			it := item{ns: db, key: string(key), body: body}
+			if !expireAt.IsZero() {
+				it.ttl = expireAt.Sub(now)
+			}
+			expired := it.ttl < 0
+			expireAt = time.Time{}
+			if expired {
+				continue
+			}
+			items = append(items, it)
+		}
+	}
+}
+
+type rdbReader struct {
+	r *bufio.Reader
+}
+
+// fail reports err at the record following n read keys.
+func (rd *rdbReader) fail(n int, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrBadRDB
+	}
+	return &storage.ImportError{Record: n + 1, Err: err}
+}
+
+// value reads strings as rediq strings, or bytes if they are not valid
+// utf-8, lists as arrays and hashes as mappings.
+func (rd *rdbReader) value(typ byte) (interface{}, error) {
+	switch typ {
+	case rdbString:
+		s, err := rd.string()
+		if err != nil {
+			return nil, err
+		}
+		if !utf8.Valid(s) {
+			return s, nil
+		}
+		return string(s), nil
+	case rdbList:
+		n, err := rd.length()
+		if err != nil {
+			return nil, err
+		}
+		var list []interface{}
+		for i := uint64(0); i < n; i++ {
+			s, err := rd.string()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, string(s))
+		}
+		return list, nil
+	case rdbHash:
+		n, err := rd.length()
+		if err != nil {
+			return nil, err
+		}
+		hash := make(map[string]interface{})
+		for i := uint64(0); i < n; i++ {
+			field, err := rd.string()
+			if err != nil {
+				return nil, err
+			}
+			val, err := rd.string()
+			if err != nil {
+				return nil, err
+			}
+			hash[string(field)] = string(val)
+		}
+		return hash, nil
+	case rdbListZiplist, rdbHashZiplist, rdbHashListpack:
+		s, err := rd.string()
+		if err != nil {
+			return nil, err
+		}
+		var entries []string
+		if typ == rdbHashListpack {
+			entries, err = listpack(s)
+		} else {
+			entries, err = ziplist(s)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if typ == rdbListZiplist {
+			return toList(entries), nil
+		}
+		return toHash(entries)
+	case rdbListQuick, rdbListQuick2:
+		n, err := rd.length()
+		if err != nil {
+			return nil, err
+		}
+		var entries []string
+		for i := uint64(0); i < n; i++ {
+			container := uint64(0)
+			if typ == rdbListQuick2 {
+				if container, err = rd.length(); err != nil {
+					return nil, err
+				}
+			}
+			s, err := rd.string()
+			if err != nil {
+				return nil, err
+			}
+			var node []string
+			switch {
+			case container == quicklistPlain:
+				node = []string{string(s)}
+			case typ == rdbListQuick2:
+				node, err = listpack(s)
+			default:
+				node, err = ziplist(s)
+			}
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, node...)
+		}
+		return toList(entries), nil
+	}
+	return nil, fmt.Errorf("unsupported rdb value type %d", typ)
+}
+
+// length reads a length encoded number, encoded strings are not
+// expected here.
+func (rd *rdbReader) length() (uint64, error) {
+	n, encoded, err := rd.lengthOrEncoding()
+	if err == nil && encoded {
+		err = ErrBadRDB
+	}
+	return n, err
+}
+
+// lengthOrEncoding returns the length or, if encoded is true, the
+// special encoding of the following string.
+func (rd *rdbReader) lengthOrEncoding() (uint64, bool, error) {
+	b, err := rd.r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
+	case 1:
+		next, err := rd.r.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(next), false, nil
+	case 2:
+		switch b {
+		case 0x80:
+			var v uint32
+			err := binary.Read(rd.r, binary.BigEndian, &v)
+			return uint64(v), false, err
+		case 0x81:
+			var v uint64
+			err := binary.Read(rd.r, binary.BigEndian, &v)
+			return v, false, err
+		}
+		return 0, false, ErrBadRDB
+	}
+	return uint64(b & 0x3f), true, nil
+}
+
+func (rd *rdbReader) string() ([]byte, error) {
+	n, encoded, err := rd.lengthOrEncoding()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		return rd.bytes(n)
+	}
+	switch n {
+	case rdbEncInt8:
+		b, err := rd.r.ReadByte()
+		return []byte(strconv.Itoa(int(int8(b)))), err
+	case rdbEncInt16:
+		var v int16
+		err := binary.Read(rd.r, binary.LittleEndian, &v)
+		return []byte(strconv.Itoa(int(v))), err
+	case rdbEncInt32:
+		var v int32
+		err := binary.Read(rd.r, binary.LittleEndian, &v)
+		return []byte(strconv.Itoa(int(v))), err
+	case rdbEncLZF:
+		clen, err := rd.length()
+		if err != nil {
+			return nil, err
+		}
+		ulen, err := rd.length()
+		if err != nil {
+			return nil, err
+		}
+		data, err := rd.bytes(clen)
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(data, ulen)
+	}
+	return nil, ErrBadRDB
+}
+
+// bytes reads n bytes, big strings are read as data comes, so that
+// a broken length doesn't allocate much.
+func (rd *rdbReader) bytes(n uint64) ([]byte, error) {
+	if n < 1<<16 {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(rd.r, buf)
+		return buf, err
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(rd.r, int64(n)))
+	if err == nil && uint64(len(buf)) != n {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf, err
+}
+
+func toList(entries []string) []interface{} {
+	list := make([]interface{}, len(entries))
+	for i, e := range entries {
+		list[i] = e
+	}
+	return list
+}
+
+func toHash(entries []string) (map[string]interface{}, error) {
+	if len(entries)%2 != 0 {
+		return nil, ErrBadRDB
+	}
+	hash := make(map[string]interface{}, len(entries)/2)
+	for i := 0; i < len(entries); i += 2 {
+		hash[entries[i]] = entries[i+1]
+	}
+	return hash, nil
+}
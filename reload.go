@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/Phil192/rediq/auth"
+	"github.com/Phil192/rediq/config"
+	"github.com/Phil192/rediq/storage"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// reloader applies the hot settings of the config file to the running
+// server on SIGHUP or the reload endpoint.
+type reloader struct {
+	mx    sync.Mutex
+	args  []string
+	cfg   *config.Config
+	cache storage.StorerV2
+	acl   *auth.ACL
+	// slowLog applies slow log settings, it is set once the app is made
+	slowLog func(threshold time.Duration, size int)
+}
+
+// reload reads and checks the config and the users first, nothing is
+// applied if any of them is broken.
+func (r *reloader) reload() (*config.Report, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	next, _, err := loadConfig(r.args)
+	if err != nil {
+		return nil, err
+	}
+	formatter, err := logFormatter(next.Log.Format)
+	if err != nil {
+		return nil, err
+	}
+	var users *auth.ACL
+	if r.acl != nil && next.Auth.ACL == r.cfg.Auth.ACL {
+		if users, err = auth.LoadACL(next.Auth.ACL); err != nil {
+			return nil, err
+		}
+	}
+	cfg, report := config.Reload(r.cfg, next)
+	// the only step which may fail goes first
+	if err := storage.Reconfigure(r.cache, cfg.Limits.Namespaces); err != nil {
+		return nil, err
+	}
+	if users != nil {
+		r.acl.Replace(users)
+		report.Applied = append(report.Applied, "auth.users")
+	}
+	if r.slowLog != nil {
+		r.slowLog(cfg.Limits.SlowLog, cfg.Limits.SlowLogLen)
+	}
+	log.SetLevel(log.Level(cfg.Log.Level))
+	log.SetFormatter(formatter)
+	r.cfg = cfg
+	log.Infof("config reloaded, applied: %v, restart required: %v", report.Applied, report.Restart)
+	return &report, nil
+}
@@ -0,0 +1,73 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/Phil192/rediq/migrate"
+	"github.com/Phil192/rediq/storage"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+// exportHandler streams a snapshot of all namespaces as newline
+// delimited json, see storage.Export. With format param it is exported
+// in an interoperable format, see migrate.Export.
+func (a *application) exportHandler(c *gin.Context) {
+	format, ext := migrate.Format(""), "ndjson"
+	if s := c.Query("format"); s != "" {
+		var err error
+		if format, err = migrate.ParseFormat(s); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		ext = s
+	}
+	name := fmt.Sprintf("rediq-%s.%s", time.Now().UTC().Format("20060102-150405"), ext)
+	c.Header("Content-Type", format.ContentType())
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	c.Status(http.StatusOK)
+	var err error
+	if format == "" {
+		err = storage.Export(c.Request.Context(), a.cache, c.Writer)
+	} else {
+		opt := migrate.Options{Namespace: c.Query("ns")}
+		_, err = migrate.Export(c.Request.Context(), a.cache, c.Writer, format, opt)
+	}
+	if err == nil {
+		return
+	}
+	if c.Writer.Written() {
+		// status is sent already, the client gets a truncated stream
+		c.Error(err)
+		return
+	}
+	c.AbortWithError(errorStatus(err), err)
+}
+
+// importHandler loads a backup from the request body, mode param is
+// merge (default) or replace. Format and ns params are the same as
+// of export, rdb format can be imported as well.
+func (a *application) importHandler(c *gin.Context) {
+	mode, err := storage.ParseImportMode(c.Query("mode"))
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	var n int
+	if s := c.Query("format"); s == "" {
+		n, err = storage.Import(c.Request.Context(), a.cache, c.Request.Body, mode)
+	} else {
+		format, ferr := migrate.ParseFormat(s)
+		if ferr != nil {
+			c.AbortWithError(http.StatusBadRequest, ferr)
+			return
+		}
+		opt := migrate.Options{Namespace: c.Query("ns"), Mode: mode}
+		n, err = migrate.Import(c.Request.Context(), a.cache, c.Request.Body, format, opt)
+	}
+	if err != nil {
+		c.AbortWithError(errorStatus(err), err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"imported": n})
+}
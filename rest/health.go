@@ -0,0 +1,29 @@
+package rest
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sync/atomic"
+)
+
+// Health routes are not authorized, they are used by load balancers
+// and orchestrators which have no credentials.
+
+func (a *application) pingHandler(c *gin.Context) {
+	c.String(http.StatusOK, "PONG")
+}
+
+// healthzHandler answers while the process is able to serve requests.
+func (a *application) healthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, "OK")
+}
+
+// readyzHandler answers 503 until the dump is loaded and after
+// shutdown has begun.
+func (a *application) readyzHandler(c *gin.Context) {
+	if atomic.LoadInt32(&a.closing) == 1 || !a.cache.Ready() {
+		c.JSON(http.StatusServiceUnavailable, "NOT READY")
+		return
+	}
+	c.JSON(http.StatusOK, "OK")
+}
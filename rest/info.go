@@ -0,0 +1,45 @@
+package rest
+
+import (
+	"github.com/Phil192/rediq/storage"
+	"github.com/gin-gonic/gin"
+	"net"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+)
+
+type info struct {
+	storage.Stats
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Clients   int64  `json:"clients"`
+	HeapBytes uint64 `json:"heap_bytes"`
+}
+
+// trackConn counts open client connections, hijacked ones are
+// no longer owned by the server.
+func (a *application) trackConn(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&a.clients, 1)
+	case http.StateClosed, http.StateHijacked:
+		atomic.AddInt64(&a.clients, -1)
+	}
+}
+
+func (a *application) infoHandler(c *gin.Context) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	version := a.opt.version
+	if version == "" {
+		version = "dev"
+	}
+	c.JSON(http.StatusOK, info{
+		Stats:     a.cache.Stats(),
+		Version:   version,
+		GoVersion: runtime.Version(),
+		Clients:   atomic.LoadInt64(&a.clients),
+		HeapBytes: mem.HeapAlloc,
+	})
+}
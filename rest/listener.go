@@ -1,52 +1,246 @@
 package rest
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/Phil192/rediq/auth"
+	"github.com/Phil192/rediq/migrate"
 	"github.com/Phil192/rediq/storage"
 	"github.com/gin-gonic/gin"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type application struct {
-	mux   *gin.Engine
-	cache storage.Storer
-	opt   *listenerOptions
+	mux     *gin.Engine
+	srv     *http.Server
+	cache   storage.StorerV2
+	opt     *listenerOptions
+	metrics *httpMetrics
+	slowLog *slowLog
+	// auditLog is nil unless enabled by Audit
+	auditLog *auditLog
+	clients  int64
+	closing  int32
+	srvMx    sync.Mutex
+	// stopWatch ends watch streams, which never end on their own
+	stopWatch chan struct{}
 }
 
+// NewApp serves c, which is upgraded to StorerV2 to pass
+// request contexts through.
 func NewApp(c storage.Storer, opts ...listenerOpt) *application {
 	app := &application{
-		cache: c,
-		opt:   &listenerOptions{},
+		cache: storage.Upgrade(c),
+		opt: &listenerOptions{
+			slowLogThreshold: 10 * time.Millisecond,
+			slowLogSize:      128,
+		},
+		metrics:   newHTTPMetrics(),
+		stopWatch: make(chan struct{}),
 	}
 	for _, o := range opts {
 		if o != nil {
 			o(app.opt)
 		}
 	}
+	app.slowLog = newSlowLog(app.opt.slowLogThreshold, app.opt.slowLogSize)
+	if app.opt.auditWriter != nil {
+		app.auditLog = newAuditLog(app.opt.auditWriter, app.opt.auditNamespaces)
+	}
 	return app
 }
 
+// SetSlowLog applies new slow log settings to the running server, e.g.
+// on reload.
+func (a *application) SetSlowLog(threshold time.Duration, size int) {
+	a.slowLog.configure(threshold, size)
+}
+
+// ListenAndServe blocks until the server fails or Shutdown is called,
+// the latter returns nil.
 func (a *application) ListenAndServe() error {
-	return a.mux.Run(a.opt.socket)
+	cfg, err := a.tlsConfig()
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:      a.opt.socket,
+		Handler:   a.mux,
+		TLSConfig: cfg,
+		ConnState: a.trackConn,
+	}
+	a.srvMx.Lock()
+	a.srv = srv
+	a.srvMx.Unlock()
+	if cfg == nil {
+		err = srv.ListenAndServe()
+	} else {
+		err = srv.ListenAndServeTLS("", "")
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown fails readiness checks, stops accepting connections and
+// waits for in-flight requests until ctx is done.
+func (a *application) Shutdown(ctx context.Context) error {
+	if atomic.CompareAndSwapInt32(&a.closing, 0, 1) {
+		close(a.stopWatch)
+	}
+	a.srvMx.Lock()
+	srv := a.srv
+	a.srvMx.Unlock()
+	if srv == nil {
+		return nil
+	}
+	return srv.Shutdown(ctx)
 }
 
 func (a *application) RouteAPI(r *gin.Engine) {
-	r.POST("/api/v1/set", TokenAuthMiddleware(), a.setHandler)
-	r.GET("/api/v1/get/:key", TokenAuthMiddleware(), a.getHandler)
-	r.DELETE("/api/v1/remove/:key", TokenAuthMiddleware(), a.deleteHandler)
-	r.GET("/api/v1/keys/:key", TokenAuthMiddleware(), a.keysHandler)
-	r.GET("/api/v1/getby/", TokenAuthMiddleware(), a.getByHandler)
+	v1 := r.Group("/api/v1")
+	a.routeKeyspace(v1)
+	a.routeKeyspace(v1.Group("/ns/:ns"))
+	a.handle(v1, "GET", "/namespaces", "namespaces", auth.Admin, a.namespacesHandler)
+	a.handle(v1, "DELETE", "/flushall", "flushall", auth.Admin, a.flushAllHandler)
+	a.handle(v1, "GET", "/admin/usage", "usage", auth.Admin, a.usageHandler)
+	a.handle(v1, "GET", "/info", "info", auth.Admin, a.infoHandler)
+	a.handle(v1, "GET", "/admin/slowlog", "slowlog", auth.Admin, a.slowLogHandler)
+	a.handle(v1, "DELETE", "/admin/slowlog", "slowlog", auth.Admin, a.slowLogResetHandler)
+	a.handle(v1, "GET", "/admin/export", "export", auth.Admin, a.exportHandler)
+	a.handle(v1, "POST", "/admin/import", "import", auth.Admin, a.importHandler)
+	if a.opt.reload != nil {
+		a.handle(v1, "POST", "/admin/reload", "reload", auth.Admin, a.reloadHandler)
+	}
+	if a.opt.acl != nil {
+		a.handle(v1, "GET", "/admin/users", "users", auth.Admin, a.usersHandler)
+		a.handle(v1, "PUT", "/admin/users/:name", "users", auth.Admin, a.setUserHandler)
+		a.handle(v1, "DELETE", "/admin/users/:name", "users", auth.Admin, a.removeUserHandler)
+	}
+	if a.opt.publicMetrics {
+		r.GET("/metrics", a.metricsHandler)
+	} else {
+		r.GET("/metrics", a.authorize("metrics", auth.Admin), a.metricsHandler)
+	}
+	r.GET("/ping", a.pingHandler)
+	r.GET("/healthz", a.healthzHandler)
+	r.GET("/readyz", a.readyzHandler)
 	a.mux = r
 }
 
+func (a *application) routeKeyspace(r *gin.RouterGroup) {
+	a.handle(r, "POST", "/set", "set", auth.Write, a.setHandler)
+	a.handle(r, "GET", "/get/*key", "get", auth.Read, a.getHandler)
+	a.handle(r, "PUT", "/raw/*key", "setraw", auth.Write, a.putRawHandler)
+	a.handle(r, "GET", "/raw/*key", "getraw", auth.Read, a.getRawHandler)
+	a.handle(r, "DELETE", "/remove/*key", "remove", auth.Write, a.deleteHandler)
+	a.handle(r, "GET", "/ttl/*key", "ttl", auth.Read, a.ttlHandler)
+	a.handle(r, "PUT", "/expire/*key", "expire", auth.Write, a.expireHandler)
+	a.handle(r, "GET", "/keys/*key", "keys", auth.Read, a.keysHandler)
+	a.handle(r, "GET", "/getby/", "getby", auth.Read, a.getByHandler)
+	a.handle(r, "DELETE", "/tag/*tag", "tag", auth.Write, a.invalidateTagHandler)
+	a.handle(r, "GET", "/dbsize", "dbsize", auth.Read, a.dbSizeHandler)
+	a.handle(r, "DELETE", "/flushdb", "flushdb", auth.Write, a.flushDBHandler)
+	a.handle(r, "GET", "/watch", "watch", auth.Read, a.watchHandler)
+}
+
+// handle registers command cmd, which is instrumented, audited if it
+// writes and requires permission perm.
+func (a *application) handle(r gin.IRoutes, method, path, cmd string, perm auth.Permission, h gin.HandlerFunc) {
+	handlers := []gin.HandlerFunc{a.instrument(cmd)}
+	if a.auditLog != nil && perm != auth.Read {
+		handlers = append(handlers, a.audit(cmd, perm == auth.Admin))
+	}
+	handlers = append(handlers, a.authorize(cmd, perm), h)
+	r.Handle(method, path, handlers...)
+}
+
+// authorize checks users against ACL or signed tokens if any of them
+// is set, the shared token is used otherwise unless NoAuth is set.
+func (a *application) authorize(cmd string, perm auth.Permission) gin.HandlerFunc {
+	if a.opt.noAuth {
+		return func(c *gin.Context) { c.Next() }
+	}
+	if a.opt.acl == nil && a.opt.tokenSecret == nil {
+		return TokenAuthMiddleware()
+	}
+	return AuthMiddleware(a.opt.acl, a.opt.tokenSecret, cmd, perm)
+}
+
+// keyspace picks the namespace from the request path, routes without
+// the :ns param operate on the default one. Unknown namespaces are
+// created only by writes.
+func (a *application) keyspace(c *gin.Context) storage.KeyspaceV2 {
+	return a.cache.Select(c.Param("ns"))
+}
+
+// keyParam is the key from the request path. Key and tag routes catch
+// the rest of the path, so that keys and tags may contain slashes.
+func keyParam(c *gin.Context) string {
+	return strings.TrimPrefix(c.Param("key"), "/")
+}
+
+// statusClientClosedRequest is reported when the client goes away
+// before the command is done, like nginx does.
+const statusClientClosedRequest = 499
+
+// errorStatus maps storage errors to http status codes: exceeded request
+// rate is 429, exceeded keys or bytes quota is 507.
+func errorStatus(err error) int {
+	switch err := err.(type) {
+	case *storage.ErrQuotaExceeded:
+		if err.Resource == storage.QuotaRequests {
+			return http.StatusTooManyRequests
+		}
+		return http.StatusInsufficientStorage
+	case *storage.PatternError:
+		return http.StatusBadRequest
+	case *storage.IndexError:
+		return http.StatusNotFound
+	case *storage.ImportError:
+		return http.StatusBadRequest
+	}
+	switch err {
+	case storage.ErrUnknownDataType, storage.ErrValueType, storage.ErrNegativeTTL:
+		return http.StatusBadRequest
+	case storage.ErrNotFound, storage.ErrNamespaceNotFound:
+		return http.StatusNotFound
+	case storage.ErrUnsupportedStorer:
+		return http.StatusNotImplemented
+	case migrate.ErrNoExport, migrate.ErrNotRDB:
+		return http.StatusBadRequest
+	case context.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case context.Canceled:
+		return statusClientClosedRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func keyspacePath(c *gin.Context) string {
+	if ns := c.Param("ns"); ns != "" {
+		return fmt.Sprintf("/api/v1/ns/%s", ns)
+	}
+	return "/api/v1"
+}
+
+// postItem holds value of the type if it is set, otherwise the type
+// follows json: strings, integers, floats, bools, lists and objects.
 type postItem struct {
-	Key   string        `json:"key"`
-	Value interface{}   `json:"value"`
-	TTL   time.Duration `json:"ttl"`
+	Key   string             `json:"key"`
+	Value interface{}        `json:"value"`
+	TTL   time.Duration      `json:"ttl"`
+	Tags  []string           `json:"tags,omitempty"`
+	Type  *storage.InputType `json:"type,omitempty"`
 }
 
 func (a *application) setHandler(c *gin.Context) {
@@ -58,33 +252,55 @@ func (a *application) setHandler(c *gin.Context) {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
-	if err := json.Unmarshal(data, &item); err != nil {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&item); err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
-	if item.Key == "" || item.Value == "" {
+	if item.Key == "" || item.Value == "" || item.Value == nil {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
-	if err := a.cache.Set(item.Key, item.Value, item.TTL); err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+	if item.Type != nil {
+		if *item.Type == storage.TYPED {
+			c.AbortWithError(http.StatusBadRequest, storage.ErrValueType)
+			return
+		}
+		item.Value, err = storage.Convert(item.Value, *item.Type)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+	}
+	c.Set(argsKey, []string{item.Key})
+	a.logValue(c, item.Value)
+	if !allowKey(c, item.Key) {
+		return
+	}
+	err = a.keyspace(c).Set(c.Request.Context(), item.Key, item.Value, item.TTL, item.Tags...)
+	if err != nil {
+		c.AbortWithError(errorStatus(err), err)
 		return
 	}
-	c.String(http.StatusOK, fmt.Sprintf("/api/v1/get/%s", item.Key))
+	c.String(http.StatusOK, fmt.Sprintf("%s/get/%s", keyspacePath(c), item.Key))
 }
 
 func (a *application) getHandler(c *gin.Context) {
-	key := c.Param("key")
+	key := keyParam(c)
 	if key == "" {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
-	val, err := a.cache.Get(key)
+	if !allowKey(c, key) {
+		return
+	}
+	val, err := a.keyspace(c).Get(c.Request.Context(), key)
 	if err == storage.ErrNotFound {
 		c.AbortWithError(http.StatusNotFound, err)
 		return
 	} else if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+		c.AbortWithError(errorStatus(err), err)
 		return
 	}
 	c.JSON(http.StatusOK, val)
@@ -104,49 +320,179 @@ func (a *application) getByHandler(c *gin.Context) {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
+	if !allowKey(c, key) {
+		return
+	}
 	indexInt, err := strconv.Atoi(index)
 	if err == nil {
 		if indexInt < 0 {
 			c.AbortWithError(http.StatusBadRequest, storage.ErrSubSeqType)
 			return
 		}
-		resp, err = a.cache.GetBy(key, indexInt)
+		resp, err = a.keyspace(c).GetBy(c.Request.Context(), key, indexInt)
 	} else {
-		resp, err = a.cache.GetBy(key, index)
+		resp, err = a.keyspace(c).GetBy(c.Request.Context(), key, index)
 	}
 	if err == storage.ErrSubSeqType {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	} else if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+		c.AbortWithError(errorStatus(err), err)
 		return
 	}
 	c.JSON(http.StatusOK, resp)
 }
 
 func (a *application) deleteHandler(c *gin.Context) {
-	key := c.Param("key")
+	key := keyParam(c)
 	if key == "" {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
-	if err := a.cache.Remove(key); err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+	if !allowKey(c, key) {
+		return
+	}
+	if err := a.keyspace(c).Remove(c.Request.Context(), key); err != nil {
+		c.AbortWithError(errorStatus(err), err)
 		return
 	}
 	c.Status(http.StatusOK)
 }
 
 func (a *application) keysHandler(c *gin.Context) {
-	key := c.Param("key")
+	key := keyParam(c)
 	if key == "" {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
-	matchings := a.cache.Keys(key)
+	matchings, err := a.keyspace(c).Keys(c.Request.Context(), key)
+	if err != nil {
+		c.AbortWithError(errorStatus(err), err)
+		return
+	}
+	if u := currentUser(c); u != nil {
+		allowed := matchings[:0]
+		for _, k := range matchings {
+			if u.CanAccess(k) {
+				allowed = append(allowed, k)
+			}
+		}
+		matchings = allowed
+	}
 	if len(matchings) == 0 {
 		c.AbortWithStatus(http.StatusNotFound)
 		return
 	}
 	c.JSON(http.StatusOK, matchings)
 }
+
+func (a *application) invalidateTagHandler(c *gin.Context) {
+	tag := strings.TrimPrefix(c.Param("tag"), "/")
+	if tag == "" {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if !allowAllKeys(c) {
+		return
+	}
+	removed, err := a.keyspace(c).InvalidateTag(c.Request.Context(), tag)
+	if err != nil {
+		c.AbortWithError(errorStatus(err), err)
+		return
+	}
+	c.JSON(http.StatusOK, removed)
+}
+
+func (a *application) dbSizeHandler(c *gin.Context) {
+	ks := a.keyspace(c)
+	if _, ok := a.cache.Namespaces()[ks.Name()]; !ok {
+		c.AbortWithError(http.StatusNotFound, storage.ErrNamespaceNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, ks.Len())
+}
+
+func (a *application) flushDBHandler(c *gin.Context) {
+	if !allowAllKeys(c) {
+		return
+	}
+	if err := a.keyspace(c).Flush(c.Request.Context()); err != nil {
+		c.AbortWithError(errorStatus(err), err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func (a *application) flushAllHandler(c *gin.Context) {
+	if err := a.cache.FlushAll(c.Request.Context()); err != nil {
+		c.AbortWithError(errorStatus(err), err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func (a *application) namespacesHandler(c *gin.Context) {
+	counts := make(map[string]int64)
+	for name, usage := range a.cache.Namespaces() {
+		counts[name] = usage.Keys
+	}
+	c.JSON(http.StatusOK, counts)
+}
+
+func (a *application) usageHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, a.cache.Namespaces())
+}
+
+type userItem struct {
+	Password    string            `json:"password"`
+	Permissions []auth.Permission `json:"permissions"`
+	Keys        []string          `json:"keys,omitempty"`
+}
+
+// reloadHandler answers 200 with the report, a broken config is
+// not applied and answers 400.
+func (a *application) reloadHandler(c *gin.Context) {
+	report, err := a.opt.reload()
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+func (a *application) usersHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, a.opt.acl.Users())
+}
+
+func (a *application) setUserHandler(c *gin.Context) {
+	var item userItem
+	if err := c.BindJSON(&item); err != nil {
+		return
+	}
+	user := &auth.User{
+		Name:        c.Param("name"),
+		Permissions: item.Permissions,
+		Keys:        item.Keys,
+	}
+	err := a.opt.acl.SetUser(user, item.Password)
+	if err == auth.ErrEmptyUser || err == auth.ErrUnknownPermission || err == auth.ErrBadKeyPattern {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func (a *application) removeUserHandler(c *gin.Context) {
+	err := a.opt.acl.RemoveUser(c.Param("name"))
+	if err == auth.ErrUserNotFound {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
@@ -1,18 +1,27 @@
 package rest
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/Phil192/rediq/auth"
+	"github.com/Phil192/rediq/client"
+	"github.com/Phil192/rediq/config"
 	"github.com/Phil192/rediq/storage"
+	"github.com/Phil192/rediq/trace"
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -26,12 +35,14 @@ func TestMain(m *testing.M) {
 	var f io.Writer
 	myCache := storage.NewCache(
 		storage.DumpPath("./var/cache.dump"),
+		storage.Namespace("limited", storage.MaxKeys(1)),
 	)
 	myCache.Run()
 	app := NewApp(
 		myCache,
 		LogFile(f),
 		SetSocket(socket),
+		NoAuth(true),
 	)
 	app.RouteAPI(gin.Default())
 	go func() {
@@ -41,7 +52,7 @@ func TestMain(m *testing.M) {
 	}()
 	time.Sleep(3 * time.Second)
 	code := m.Run()
-	myCache.Close()
+	myCache.Close(context.Background())
 	os.Exit(code)
 }
 
@@ -49,12 +60,36 @@ func TestPing(t *testing.T) {
 	r := require.New(t)
 	resp, err := http.Get(fmt.Sprintf("http://%s/ping", socket))
 	r.NoError(err)
-	r.Equal(404, resp.StatusCode)
+	r.Equal(200, resp.StatusCode)
+	cli, err := client.NewClient("http://"+socket, "", "")
+	r.NoError(err)
+	r.NoError(cli.Ping())
+}
+
+func TestHealth(t *testing.T) {
+	r := require.New(t)
+	acl := auth.NewACL("")
+	c := storage.NewCache(storage.DumpPath(filepath.Join(os.TempDir(), "rediq-health.dump")))
+	app := NewApp(c, ACL(acl))
+	app.RouteAPI(gin.New())
+	do := func(path string) int {
+		w := httptest.NewRecorder()
+		app.mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	r.Equal(200, do("/healthz"))
+	r.Equal(503, do("/readyz"))
+	c.Run()
+	r.Equal(200, do("/readyz"))
+	r.Equal(200, do("/ping"))
+	r.Equal(401, do("/api/v1/dbsize"))
+	r.NoError(c.Close(context.Background()))
+	r.Equal(503, do("/readyz"))
 }
 
 func TestGet(t *testing.T) {
 	r := require.New(t)
-	data := postItem{"testGet", "ok", 0}
+	data := postItem{"testGet", "ok", 0, nil, nil}
 	j, err := json.Marshal(&data)
 	r.NoError(err)
 	resp, err := http.Post(
@@ -76,7 +111,7 @@ func TestGet(t *testing.T) {
 func TestGetBy(t *testing.T) {
 	r := require.New(t)
 	var innerArr = []string{"ok"}
-	data := postItem{"testGetBy", innerArr, 5}
+	data := postItem{"testGetBy", innerArr, 5, nil, nil}
 	j, err := json.Marshal(&data)
 	r.NoError(err)
 	resp, err := http.Post(
@@ -106,7 +141,7 @@ func TestGetBy(t *testing.T) {
 
 func TestSet(t *testing.T) {
 	r := require.New(t)
-	data := postItem{"testSet", "ok", 2}
+	data := postItem{"testSet", "ok", 2, nil, nil}
 	j, err := json.Marshal(&data)
 	r.NoError(err)
 	resp, err := http.Post(
@@ -131,7 +166,7 @@ func TestSet(t *testing.T) {
 
 func TestKeys(t *testing.T) {
 	r := require.New(t)
-	data := postItem{"testKeys", ".", 0}
+	data := postItem{"testKeys", ".", 0, nil, nil}
 	j, err := json.Marshal(&data)
 	r.NoError(err)
 	resp, err := http.Post(
@@ -148,11 +183,14 @@ func TestKeys(t *testing.T) {
 	defer resp.Body.Close()
 	r.NoError(err)
 	r.Contains(string(bts), "testKeys")
+	resp, err = http.Get(fmt.Sprintf("http://%s/api/v1/keys/%s", socket, url.PathEscape("test[")))
+	r.NoError(err)
+	r.Equal(400, resp.StatusCode)
 }
 
 func TestRemove(t *testing.T) {
 	r := require.New(t)
-	data := postItem{"testRemove", "ok", 0}
+	data := postItem{"testRemove", "ok", 0, nil, nil}
 	j, err := json.Marshal(&data)
 	r.NoError(err)
 	resp, err := http.Post(
@@ -176,3 +214,679 @@ func TestRemove(t *testing.T) {
 	r.NoError(err)
 	r.Equal(404, resp.StatusCode)
 }
+
+func TestInvalidateTag(t *testing.T) {
+	r := require.New(t)
+	for _, key := range []string{"testTagOne", "testTagTwo"} {
+		data := postItem{key, "ok", 0, []string{"user:42"}, nil}
+		j, err := json.Marshal(&data)
+		r.NoError(err)
+		resp, err := http.Post(
+			fmt.Sprintf("http://%s/api/v1/set", socket),
+			"application/json",
+			bytes.NewBuffer(j),
+		)
+		r.NoError(err)
+		r.Equal(200, resp.StatusCode)
+	}
+	req, err := http.NewRequest(
+		"DELETE",
+		fmt.Sprintf("http://%s/api/v1/tag/user:42", socket),
+		nil,
+	)
+	r.NoError(err)
+	cli := http.Client{}
+	resp, err := cli.Do(req)
+	r.NoError(err)
+	r.Equal(200, resp.StatusCode)
+	bts, err := ioutil.ReadAll(resp.Body)
+	defer resp.Body.Close()
+	r.NoError(err)
+	r.Contains(string(bts), "testTagOne")
+	r.Contains(string(bts), "testTagTwo")
+	resp, err = http.Get(fmt.Sprintf("http://%s/api/v1/get/testTagOne", socket))
+	r.NoError(err)
+	r.Equal(404, resp.StatusCode)
+}
+
+func TestNamespaces(t *testing.T) {
+	r := require.New(t)
+	data := postItem{"testNamespace", "tenant", 0, nil, nil}
+	j, err := json.Marshal(&data)
+	r.NoError(err)
+	resp, err := http.Post(
+		fmt.Sprintf("http://%s/api/v1/ns/tenant/set", socket),
+		"application/json",
+		bytes.NewBuffer(j),
+	)
+	r.NoError(err)
+	r.Equal(200, resp.StatusCode)
+	bts, err := ioutil.ReadAll(resp.Body)
+	r.NoError(err)
+	r.Equal("/api/v1/ns/tenant/get/testNamespace", string(bts))
+	resp, err = http.Get(fmt.Sprintf("http://%s/api/v1/ns/tenant/get/testNamespace", socket))
+	r.NoError(err)
+	r.Equal(200, resp.StatusCode)
+	resp, err = http.Get(fmt.Sprintf("http://%s/api/v1/get/testNamespace", socket))
+	r.NoError(err)
+	r.Equal(404, resp.StatusCode)
+	resp, err = http.Get(fmt.Sprintf("http://%s/api/v1/ns/tenant/dbsize", socket))
+	r.NoError(err)
+	bts, err = ioutil.ReadAll(resp.Body)
+	r.NoError(err)
+	r.Equal("1", string(bts))
+	req, err := http.NewRequest(
+		"DELETE",
+		fmt.Sprintf("http://%s/api/v1/ns/tenant/flushdb", socket),
+		nil,
+	)
+	r.NoError(err)
+	cli := http.Client{}
+	resp, err = cli.Do(req)
+	r.NoError(err)
+	r.Equal(200, resp.StatusCode)
+	resp, err = http.Get(fmt.Sprintf("http://%s/api/v1/ns/tenant/get/testNamespace", socket))
+	r.NoError(err)
+	r.Equal(404, resp.StatusCode)
+
+	// reads don't create namespaces
+	for _, path := range []string{"get/key", "keys/*", "dbsize"} {
+		resp, err = http.Get(fmt.Sprintf("http://%s/api/v1/ns/unknown/%s", socket, path))
+		r.NoError(err)
+		r.Equal(404, resp.StatusCode, path)
+	}
+	// watch waits for the first write instead
+	resp, err = http.Get(fmt.Sprintf("http://%s/api/v1/ns/unknown/watch", socket))
+	r.NoError(err)
+	r.Equal(200, resp.StatusCode)
+	resp.Body.Close()
+	resp, err = http.Get(fmt.Sprintf("http://%s/api/v1/namespaces", socket))
+	r.NoError(err)
+	bts, err = ioutil.ReadAll(resp.Body)
+	r.NoError(err)
+	r.NotContains(string(bts), "unknown")
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	r := require.New(t)
+	for i, status := range []int{200, 507} {
+		data := postItem{fmt.Sprintf("testQuota%d", i), "ok", 0, nil, nil}
+		j, err := json.Marshal(&data)
+		r.NoError(err)
+		resp, err := http.Post(
+			fmt.Sprintf("http://%s/api/v1/ns/limited/set", socket),
+			"application/json",
+			bytes.NewBuffer(j),
+		)
+		r.NoError(err)
+		r.Equal(status, resp.StatusCode)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/v1/admin/usage", socket))
+	r.NoError(err)
+	r.Equal(200, resp.StatusCode)
+	var usage map[string]storage.Usage
+	r.NoError(json.NewDecoder(resp.Body).Decode(&usage))
+	defer resp.Body.Close()
+	r.Equal(int64(1), usage["limited"].Keys)
+	r.Equal(int64(1), usage["limited"].Rejected)
+}
+
+func TestACL(t *testing.T) {
+	r := require.New(t)
+	acl := auth.NewACL("")
+	r.NoError(acl.SetUser(&auth.User{Name: "admin", Permissions: []auth.Permission{auth.Admin}}, "admin"))
+	r.NoError(acl.SetUser(&auth.User{
+		Name:        "reader",
+		Permissions: []auth.Permission{auth.Read},
+		Keys:        []string{"public:*"},
+	}, "reader"))
+	app := NewApp(storage.NewCache(), ACL(acl))
+	app.RouteAPI(gin.New())
+	do := func(method, path, user, pass string, body io.Reader) int {
+		req := httptest.NewRequest(method, path, body)
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		w := httptest.NewRecorder()
+		app.mux.ServeHTTP(w, req)
+		return w.Code
+	}
+	r.Equal(401, do("GET", "/api/v1/get/public:1", "", "", nil))
+	r.Equal(401, do("GET", "/api/v1/get/public:1", "reader", "wrong", nil))
+	r.Equal(404, do("GET", "/api/v1/get/public:1", "reader", "reader", nil))
+	r.Equal(403, do("GET", "/api/v1/get/private:1", "reader", "reader", nil))
+	r.Equal(403, do("DELETE", "/api/v1/remove/public:1", "reader", "reader", nil))
+	r.Equal(403, do("GET", "/api/v1/admin/users", "reader", "reader", nil))
+	// info covers every namespace
+	r.Equal(403, do("GET", "/api/v1/info", "reader", "reader", nil))
+	r.Equal(200, do("GET", "/api/v1/info", "admin", "admin", nil))
+	user := bytes.NewBufferString(`{"password":"writer","permissions":["write"]}`)
+	r.Equal(200, do("PUT", "/api/v1/admin/users/writer", "admin", "admin", user))
+	r.Equal(200, do("DELETE", "/api/v1/remove/private:1", "writer", "writer", nil))
+	r.Equal(200, do("DELETE", "/api/v1/admin/users/writer", "admin", "admin", nil))
+	r.Equal(401, do("DELETE", "/api/v1/remove/private:1", "writer", "writer", nil))
+}
+
+func TestSharedToken(t *testing.T) {
+	r := require.New(t)
+	os.Setenv("TOKEN", "secret")
+	defer os.Unsetenv("TOKEN")
+	r.True(gin.IsDebugging())
+	app := NewApp(storage.NewCache())
+	app.RouteAPI(gin.New())
+	do := func(app *application, token string) int {
+		req := httptest.NewRequest("GET", "/api/v1/get/k", nil)
+		if token != "" {
+			req.Header.Set("token", token)
+		}
+		w := httptest.NewRecorder()
+		app.mux.ServeHTTP(w, req)
+		return w.Code
+	}
+	r.Equal(401, do(app, ""))
+	r.Equal(401, do(app, "wrong"))
+	r.Equal(404, do(app, "secret"))
+
+	open := NewApp(storage.NewCache(), NoAuth(true))
+	open.RouteAPI(gin.New())
+	r.Equal(404, do(open, ""))
+
+	metrics := func(app *application, token string) int {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if token != "" {
+			req.Header.Set("token", token)
+		}
+		w := httptest.NewRecorder()
+		app.mux.ServeHTTP(w, req)
+		return w.Code
+	}
+	r.Equal(401, metrics(app, ""))
+	r.Equal(200, metrics(app, "secret"))
+	public := NewApp(storage.NewCache(), PublicMetrics(true))
+	public.RouteAPI(gin.New())
+	r.Equal(200, metrics(public, ""))
+}
+
+func TestBearerToken(t *testing.T) {
+	r := require.New(t)
+	secret := []byte("secret")
+	app := NewApp(storage.NewCache(), TokenSecret(secret))
+	app.RouteAPI(gin.New())
+	srv := httptest.NewServer(app.mux)
+	defer srv.Close()
+	do := func(path string, claims auth.Claims) int {
+		token, err := auth.Mint(secret, claims, time.Minute)
+		r.NoError(err)
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		app.mux.ServeHTTP(w, req)
+		return w.Code
+	}
+	reader := auth.Claims{Subject: "alice", Commands: []string{"get"}, Prefixes: []string{"user:"}}
+	r.Equal(404, do("/api/v1/get/user:1", reader))
+	r.Equal(403, do("/api/v1/get/session:1", reader))
+	r.Equal(403, do("/api/v1/dbsize", reader))
+	r.Equal(200, do("/api/v1/dbsize", auth.Claims{Commands: []string{"read"}}))
+
+	issued := 0
+	source := func() (string, time.Time, error) {
+		issued++
+		claims := auth.Claims{Commands: []string{"read"}}
+		if issued == 1 {
+			// pretend the first token was revoked
+			claims.Commands = nil
+			token, err := auth.Mint([]byte("revoked"), claims, time.Minute)
+			return token, time.Now().Add(time.Minute), err
+		}
+		token, err := auth.Mint(secret, claims, time.Minute)
+		return token, time.Now().Add(time.Minute), err
+	}
+	cli, err := client.NewClient(srv.URL, "", "", client.Tokens(source))
+	r.NoError(err)
+	body, err := cli.Get(srv.URL, "/api/v1/dbsize")
+	r.NoError(err)
+	r.Equal("0", string(body))
+	r.Equal(2, issued)
+	_, err = cli.Get(srv.URL, "/api/v1/dbsize")
+	r.NoError(err)
+	r.Equal(2, issued)
+}
+
+func TestMetrics(t *testing.T) {
+	r := require.New(t)
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/v1/get/testMetricsMissing", socket))
+	r.NoError(err)
+	r.Equal(404, resp.StatusCode)
+	resp, err = http.Get(fmt.Sprintf("http://%s/metrics", socket))
+	r.NoError(err)
+	r.Equal(200, resp.StatusCode)
+	bts, err := ioutil.ReadAll(resp.Body)
+	defer resp.Body.Close()
+	r.NoError(err)
+	r.Contains(string(bts), "# TYPE rediq_cache_misses_total counter")
+	r.Contains(string(bts), `rediq_cache_keys{namespace="default"}`)
+	r.Contains(string(bts), `rediq_http_requests_total{cmd="get",code="404"}`)
+	r.Contains(string(bts), `rediq_http_request_duration_seconds_count{cmd="get"}`)
+}
+
+func TestInfo(t *testing.T) {
+	r := require.New(t)
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/v1/info", socket))
+	r.NoError(err)
+	r.Equal(200, resp.StatusCode)
+	defer resp.Body.Close()
+	var i info
+	r.NoError(json.NewDecoder(resp.Body).Decode(&i))
+	r.Equal("dev", i.Version)
+	r.True(i.Clients > 0)
+	r.True(i.Uptime > 0)
+	r.Contains(i.KeysByType, "string")
+}
+
+func TestSlowLog(t *testing.T) {
+	r := require.New(t)
+	acl := auth.NewACL("")
+	r.NoError(acl.SetUser(&auth.User{Name: "admin", Permissions: []auth.Permission{auth.Admin}}, "admin"))
+	app := NewApp(storage.NewCache(), ACL(acl), SlowLog(0, 2))
+	app.RouteAPI(gin.New())
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.SetBasicAuth("admin", "admin")
+		w := httptest.NewRecorder()
+		app.mux.ServeHTTP(w, req)
+		return w
+	}
+	long := string(bytes.Repeat([]byte("k"), 200))
+	do("GET", "/api/v1/get/first")
+	do("GET", "/api/v1/ns/tenant/get/"+long)
+	w := do("GET", "/api/v1/admin/slowlog")
+	r.Equal(200, w.Code)
+	var entries []slowEntry
+	r.NoError(json.Unmarshal(w.Body.Bytes(), &entries))
+	r.Len(entries, 2)
+	r.Equal("get", entries[0].Command)
+	r.Equal("admin", entries[0].Client)
+	r.Equal([]string{"tenant", long[:128] + "..."}, entries[0].Args)
+	r.Equal([]string{"first"}, entries[1].Args)
+
+	w = do("GET", "/api/v1/admin/slowlog?count=5")
+	r.NoError(json.Unmarshal(w.Body.Bytes(), &entries))
+	r.Len(entries, 2)
+	r.Equal("slowlog", entries[0].Command)
+	r.Equal("get", entries[1].Command)
+	w = do("GET", "/api/v1/admin/slowlog?count=1")
+	r.NoError(json.Unmarshal(w.Body.Bytes(), &entries))
+	r.Len(entries, 1)
+	r.Equal(200, do("DELETE", "/api/v1/admin/slowlog").Code)
+	w = do("GET", "/api/v1/admin/slowlog?count=5")
+	r.NoError(json.Unmarshal(w.Body.Bytes(), &entries))
+	r.Len(entries, 1)
+	r.Equal("slowlog", entries[0].Command)
+
+	// settings change on the fly, the newest entries are kept
+	do("GET", "/api/v1/get/second")
+	app.SetSlowLog(time.Hour, 1)
+	do("GET", "/api/v1/get/third")
+	r.Equal([]string{"second"}, app.slowLog.get(5)[0].Args)
+}
+
+func TestShutdown(t *testing.T) {
+	r := require.New(t)
+	sock := "127.0.0.1:8083"
+	engine := gin.New()
+	release := make(chan struct{})
+	engine.GET("/slow", func(c *gin.Context) {
+		<-release
+		c.String(http.StatusOK, "done")
+	})
+	app := NewApp(storage.NewCache(), SetSocket(sock), NoAuth(true))
+	app.RouteAPI(engine)
+	served := make(chan error, 1)
+	go func() {
+		served <- app.ListenAndServe()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://%s/slow", sock))
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- app.Shutdown(context.Background())
+	}()
+	time.Sleep(100 * time.Millisecond)
+	w := httptest.NewRecorder()
+	app.mux.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	r.Equal(503, w.Code)
+	select {
+	case <-shutdown:
+		r.Fail("shutdown returned before in-flight request is done")
+	default:
+	}
+	close(release)
+	r.Equal(200, <-status)
+	r.NoError(<-shutdown)
+	r.NoError(<-served)
+	_, err := http.Get(fmt.Sprintf("http://%s/ping", sock))
+	r.Error(err)
+}
+
+func TestTypedValues(t *testing.T) {
+	r := require.New(t)
+	cli, err := client.NewClient("http://"+socket, "", "")
+	r.NoError(err)
+	addr := fmt.Sprintf("http://%s/api/v1", socket)
+	values := map[string]interface{}{
+		"testTypedInt":   int64(42),
+		"testTypedFloat": 4.2,
+		"testTypedBool":  true,
+		"testTypedBytes": []byte{0, 1, 2},
+		"testTypedSet":   storage.NewStringSet("a", "b"),
+	}
+	for key, val := range values {
+		_, err := cli.PostValue(addr+"/set", key, val, 0)
+		r.NoError(err)
+		v, err := cli.GetValue(addr+"/get/", key)
+		r.NoError(err)
+		typ, _ := storage.TypeOf(val)
+		r.Equal(typ, v.DataType)
+		r.Equal(val, v.Body)
+	}
+	_, err = cli.GetValue(addr+"/get/", "testTypedMissing")
+	r.Equal(storage.ErrNotFound, err)
+
+	resp, err := http.Post(addr+"/set", "application/json",
+		bytes.NewBufferString(`{"key":"testTypedJSON","value":[1,2.5,"x"]}`))
+	r.NoError(err)
+	r.Equal(200, resp.StatusCode)
+	v, err := cli.GetValue(addr+"/get/", "testTypedJSON")
+	r.NoError(err)
+	r.Equal(storage.ARRAY, v.DataType)
+	r.Equal([]interface{}{int64(1), 2.5, "x"}, v.Body)
+
+	resp, err = http.Post(addr+"/set", "application/json",
+		bytes.NewBufferString(`{"key":"testTypedBad","value":"x","type":"int"}`))
+	r.NoError(err)
+	r.Equal(400, resp.StatusCode)
+}
+
+func TestRaw(t *testing.T) {
+	r := require.New(t)
+	cli, err := client.NewClient("http://"+socket, "", "")
+	r.NoError(err)
+	raw := fmt.Sprintf("http://%s%s", socket, client.APIPath("", "raw"))
+	blob := []byte{0x89, 'P', 'N', 'G', 0, 0xff}
+	r.NoError(cli.PutRaw(raw, "testRaw", bytes.NewReader(blob), "image/png", time.Minute, "img"))
+	body, contentType, err := cli.GetRaw(raw, "testRaw")
+	r.NoError(err)
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	r.NoError(err)
+	r.Equal(blob, data)
+	r.Equal("image/png", contentType)
+
+	v, err := cli.GetValue(fmt.Sprintf("http://%s/api/v1/get/", socket), "testRaw")
+	r.NoError(err)
+	r.Equal(storage.BYTES, v.DataType)
+	r.Equal("image/png", v.ContentType)
+	r.Equal([]string{"img"}, v.Tags)
+
+	_, _, err = cli.GetRaw(raw, "testRawMissing")
+	r.Equal(storage.ErrNotFound, err)
+	_, err = cli.PostValue(fmt.Sprintf("http://%s/api/v1/set", socket), "testRawList", []interface{}{"a"}, 0)
+	r.NoError(err)
+	_, _, err = cli.GetRaw(raw, "testRawList")
+	r.IsType(&client.StatusError{}, err)
+	r.Equal(400, err.(*client.StatusError).Code)
+}
+
+func TestBackup(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	serve := func(name string) (storage.StorerV2, client.User) {
+		c := storage.NewCacheV2(storage.DumpPath(filepath.Join(os.TempDir(), name)))
+		r.NoError(c.Run(ctx))
+		app := NewApp(storage.Downgrade(c), NoAuth(true))
+		app.RouteAPI(gin.New())
+		srv := httptest.NewServer(app.mux)
+		t.Cleanup(srv.Close)
+		cli, err := client.NewClient(srv.URL, "", "")
+		r.NoError(err)
+		return c, cli
+	}
+	src, srcCli := serve("rediq-backup-src.dump")
+	dst, dstCli := serve("rediq-backup-dst.dump")
+	r.NoError(src.Set(ctx, "a", "1", 0))
+	r.NoError(src.Select("users").Set(ctx, "ann", []interface{}{"admin"}, time.Hour))
+	r.NoError(dst.Set(ctx, "old", "x", 0))
+
+	var backup bytes.Buffer
+	r.NoError(srcCli.Export(&backup, ""))
+	r.Equal(2, bytes.Count(backup.Bytes(), []byte("\n")))
+
+	n, err := dstCli.Import(bytes.NewReader(backup.Bytes()), "", "merge")
+	r.NoError(err)
+	r.Equal(2, n)
+	r.Equal(2, dst.Len())
+	v, err := dst.Select("users").Get(ctx, "ann")
+	r.NoError(err)
+	r.Equal([]interface{}{"admin"}, v.Body)
+
+	_, err = dstCli.Import(bytes.NewReader(backup.Bytes()), "", "replace")
+	r.NoError(err)
+	_, err = dst.Get(ctx, "old")
+	r.Equal(storage.ErrNotFound, err)
+
+	_, err = dstCli.Import(bytes.NewBufferString(`{"key":"a"}`), "", "merge")
+	r.IsType(&client.StatusError{}, err)
+	r.Equal(400, err.(*client.StatusError).Code)
+	_, err = dstCli.Import(bytes.NewReader(backup.Bytes()), "", "append")
+	r.Equal(400, err.(*client.StatusError).Code)
+
+	var csv bytes.Buffer
+	r.NoError(srcCli.Export(&csv, "csv"))
+	r.Equal("key,value,ttl\na,1,\n", csv.String())
+	n, err = dstCli.Import(&csv, "csv", "replace")
+	r.NoError(err)
+	r.Equal(1, n)
+	r.Equal(1, dst.Len())
+	r.Equal(400, srcCli.Export(&csv, "xml").(*client.StatusError).Code)
+	_, err = dstCli.Import(&csv, "rdb", "merge")
+	r.Equal(400, err.(*client.StatusError).Code)
+}
+
+func TestReload(t *testing.T) {
+	r := require.New(t)
+	fail := false
+	report := &config.Report{Applied: []string{"log.level"}, Restart: []string{"listen.socket"}}
+	c := storage.NewCache(storage.DumpPath(filepath.Join(os.TempDir(), "rediq-reload.dump")))
+	app := NewApp(c, NoAuth(true), Reload(func() (*config.Report, error) {
+		if fail {
+			return nil, fmt.Errorf("broken config")
+		}
+		return report, nil
+	}))
+	app.RouteAPI(gin.New())
+	do := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		app.mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/admin/reload", nil))
+		return w
+	}
+	w := do()
+	r.Equal(200, w.Code)
+	var got config.Report
+	r.NoError(json.Unmarshal(w.Body.Bytes(), &got))
+	r.Equal(*report, got)
+	fail = true
+	r.Equal(400, do().Code)
+}
+
+func TestRequestLog(t *testing.T) {
+	r := require.New(t)
+	var logBuf, auditBuf bytes.Buffer
+	logrus.SetOutput(&logBuf)
+	logrus.SetFormatter(&logrus.JSONFormatter{})
+	defer logrus.SetOutput(os.Stderr)
+	defer logrus.SetFormatter(&logrus.TextFormatter{})
+
+	acl := auth.NewACL("")
+	r.NoError(acl.SetUser(&auth.User{Name: "admin", Permissions: []auth.Permission{auth.Admin}}, "admin"))
+	r.NoError(acl.SetUser(&auth.User{Name: "reader", Permissions: []auth.Permission{auth.Read}}, "reader"))
+	app := NewApp(storage.NewCache(), ACL(acl), Audit(&auditBuf, "tenant"))
+	app.RouteAPI(gin.New())
+	do := func(user, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.SetBasicAuth(user, user)
+		req.Header.Set(requestIDHeader, "req-"+user)
+		w := httptest.NewRecorder()
+		app.mux.ServeHTTP(w, req)
+		return w
+	}
+	w := do("admin", "POST", "/api/v1/set", `{"key":"a","value":"secret"}`)
+	r.Equal(200, w.Code)
+	r.Equal("req-admin", w.Header().Get(requestIDHeader))
+	r.Equal(200, do("admin", "POST", "/api/v1/ns/tenant/set", `{"key":"b","value":"secret"}`).Code)
+	r.Equal(200, do("admin", "GET", "/api/v1/ns/tenant/get/b", "").Code)
+	r.Equal(403, do("reader", "DELETE", "/api/v1/ns/tenant/remove/b", "").Code)
+	r.Equal(200, do("admin", "DELETE", "/api/v1/flushall", "").Code)
+
+	r.NotContains(logBuf.String(), "secret")
+	var entry map[string]interface{}
+	r.NoError(json.NewDecoder(&logBuf).Decode(&entry))
+	r.Equal("req-admin", entry["request_id"])
+	r.Equal("set", entry["cmd"])
+	r.Equal("admin", entry["user"])
+	r.Equal("a", entry["key"])
+	r.Equal(float64(200), entry["status"])
+	r.Equal(float64(28), entry["bytes_in"])
+	r.Contains(entry, "latency_ms")
+
+	var audited []auditEntry
+	dec := json.NewDecoder(&auditBuf)
+	for dec.More() {
+		var e auditEntry
+		r.NoError(dec.Decode(&e))
+		audited = append(audited, e)
+	}
+	r.Len(audited, 3)
+	r.Equal("set", audited[0].Cmd)
+	r.Equal("tenant", audited[0].Namespace)
+	r.Equal("b", audited[0].Key)
+	r.Equal("reader", audited[1].User)
+	r.Equal(403, audited[1].Status)
+	r.Equal("flushall", audited[2].Cmd)
+	r.NotContains(auditBuf.String(), "secret")
+
+	logBuf.Reset()
+	app = NewApp(storage.NewCache(), ACL(acl), LogValues(true))
+	app.RouteAPI(gin.New())
+	r.Equal(200, do("admin", "POST", "/api/v1/set", `{"key":"a","value":"visible"}`).Code)
+	r.Contains(logBuf.String(), `"value":"visible"`)
+}
+
+func TestTracing(t *testing.T) {
+	r := require.New(t)
+	rec := trace.NewRecorder()
+	c := storage.NewCache(storage.DumpPath(filepath.Join(os.TempDir(), "rediq-tracing.dump")))
+	app := NewApp(c, Tracer(rec), NoAuth(true))
+	app.RouteAPI(gin.New())
+	srv := httptest.NewServer(app.mux)
+	defer srv.Close()
+
+	cli, err := client.NewClient(srv.URL, "", "", client.Tracer(rec))
+	r.NoError(err)
+	ctx, root := trace.StartWith(context.Background(), rec, "caller", trace.SpanContext{})
+	_, err = cli.WithContext(ctx).Post(srv.URL+client.APIPath("", "set"), "k", "v", 0)
+	r.NoError(err)
+	root.End()
+
+	clientSpan, ok := rec.Find("rediq.client POST")
+	r.True(ok)
+	r.Equal(root.Context(), clientSpan.Parent)
+	r.Equal(200, clientSpan.Attributes["http.status_code"])
+	serverSpan, ok := rec.Find("rediq set")
+	r.True(ok)
+	r.Equal(clientSpan.Context, serverSpan.Parent)
+	r.Equal(200, serverSpan.Attributes["http.status_code"])
+	storageSpan, ok := rec.Find("storage.set")
+	r.True(ok)
+	r.Equal(serverSpan.Context, storageSpan.Parent)
+	r.Equal(root.Context().TraceID, storageSpan.Context.TraceID)
+
+	// without a client tracer the caller span is propagated
+	rec.Reset()
+	plain, err := client.NewClient(srv.URL, "", "")
+	r.NoError(err)
+	ctx, root = trace.StartWith(context.Background(), rec, "caller", trace.SpanContext{})
+	_, err = plain.WithContext(ctx).Get(srv.URL+client.APIPath("", "get"), "k")
+	r.NoError(err)
+	serverSpan, ok = rec.Find("rediq get")
+	r.True(ok)
+	r.Equal(root.Context(), serverSpan.Parent)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/v1/dbsize", nil)
+	req.Header.Set(trace.Header, "garbage")
+	app.mux.ServeHTTP(w, req)
+	r.Equal(200, w.Code)
+	serverSpan, ok = rec.Find("rediq dbsize")
+	r.True(ok)
+	r.False(serverSpan.Parent.IsValid())
+}
+
+func TestWatch(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	acl := auth.NewACL("")
+	r.NoError(acl.SetUser(&auth.User{
+		Name:        "reader",
+		Permissions: []auth.Permission{auth.Read},
+		Keys:        []string{"public:*"},
+	}, "reader"))
+	app := NewApp(storage.NewCache(), ACL(acl), SlowLog(0, 16))
+	app.RouteAPI(gin.New())
+	srv := httptest.NewServer(app.mux)
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/api/v1/watch", nil)
+	r.NoError(err)
+	req.SetBasicAuth("reader", "reader")
+	begin := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	r.NoError(err)
+	defer resp.Body.Close()
+	r.Equal(200, resp.StatusCode)
+	r.Equal("application/x-ndjson", resp.Header.Get("Content-Type"))
+	lines := bufio.NewScanner(resp.Body)
+	r.True(lines.Scan())
+	r.JSONEq(`{"op":"ready"}`, lines.Text())
+	setup := time.Since(begin)
+
+	r.NoError(app.cache.Set(ctx, "private:1", "v", 0))
+	r.NoError(app.cache.Set(ctx, "public:1", "v", 0))
+	r.NoError(app.cache.Select("other").Set(ctx, "public:2", "v", 0))
+	r.NoError(app.cache.Remove(ctx, "public:1"))
+	r.True(lines.Scan())
+	r.JSONEq(`{"ns":"default","key":"public:1","op":"set"}`, lines.Text())
+	r.True(lines.Scan())
+	r.JSONEq(`{"ns":"default","key":"public:1","op":"remove"}`, lines.Text())
+
+	time.Sleep(150 * time.Millisecond)
+	r.NoError(app.Shutdown(ctx))
+	r.False(lines.Scan())
+	// the stream is timed until it starts
+	entries := app.slowLog.get(16)
+	r.Len(entries, 1)
+	r.Equal("watch", entries[0].Command)
+	r.True(entries[0].Duration <= setup)
+}
@@ -0,0 +1,104 @@
+package rest
+
+import (
+	"bytes"
+	"github.com/Phil192/rediq/metrics"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type httpMetrics struct {
+	latency  *metrics.HistogramVec
+	requests *metrics.CounterVec
+}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{
+		latency: metrics.NewHistogramVec(
+			"rediq_http_request_duration_seconds",
+			"Latency of handled requests by command.",
+			metrics.DefBuckets,
+			"cmd",
+		),
+		requests: metrics.NewCounterVec(
+			"rediq_http_requests_total",
+			"Handled requests by command and status code.",
+			"cmd", "code",
+		),
+	}
+}
+
+// streamKey holds the time a streaming command started to stream, it is
+// timed until then in latency metrics and the slow log.
+const streamKey = "stream"
+
+func (a *application) instrument(cmd string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := requestID(c)
+		span := a.startSpan(c, cmd, id)
+		c.Next()
+		dur := time.Since(start)
+		a.endSpan(c, span)
+		a.logRequest(c, cmd, id, dur)
+		if streamed, ok := c.Get(streamKey); ok {
+			dur = streamed.(time.Time).Sub(start)
+		}
+		a.metrics.latency.Observe(dur.Seconds(), cmd)
+		a.slowLog.record(cmd, start, dur, commandArgs(c), clientName(c))
+		a.metrics.requests.Inc(cmd, strconv.Itoa(c.Writer.Status()))
+	}
+}
+
+func (a *application) metricsHandler(c *gin.Context) {
+	m := a.cache.Metrics()
+	var buf bytes.Buffer
+	counters := []struct {
+		name  string
+		help  string
+		value int64
+	}{
+		{"rediq_cache_hits_total", "Reads of existing keys.", m.Hits},
+		{"rediq_cache_misses_total", "Reads of missing keys.", m.Misses},
+		{"rediq_cache_sets_total", "Stored values.", m.Sets},
+		{"rediq_cache_removes_total", "Removed keys.", m.Removes},
+		{"rediq_cache_expired_total", "Keys removed by TTL.", m.Expired},
+		{"rediq_cache_evicted_total", "Keys evicted by namespace limits.", m.Evicted},
+	}
+	for _, cnt := range counters {
+		metrics.Write(&buf, cnt.name, cnt.help, "counter", metrics.Sample{Value: float64(cnt.value)})
+	}
+	metrics.Write(&buf, "rediq_cache_gc_backlog", "Values waiting in gc channel.", "gauge",
+		metrics.Sample{Value: float64(m.GCBacklog)})
+	metrics.Write(&buf, "rediq_cache_dump_duration_seconds", "Duration of the last dump.", "gauge",
+		metrics.Sample{Value: m.DumpDuration.Seconds()})
+
+	names := make([]string, 0, len(m.Namespaces))
+	for ns := range m.Namespaces {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+	var keys, sizes, shardKeys []metrics.Sample
+	for _, ns := range names {
+		usage := m.Namespaces[ns]
+		label := []metrics.Label{{Name: "namespace", Value: ns}}
+		keys = append(keys, metrics.Sample{Labels: label, Value: float64(usage.Keys)})
+		sizes = append(sizes, metrics.Sample{Labels: label, Value: float64(usage.Bytes)})
+		for shard, n := range m.ShardKeys[ns] {
+			shardKeys = append(shardKeys, metrics.Sample{
+				Labels: []metrics.Label{{Name: "namespace", Value: ns}, {Name: "shard", Value: shard}},
+				Value:  float64(n),
+			})
+		}
+	}
+	metrics.Write(&buf, "rediq_cache_keys", "Keys by namespace.", "gauge", keys...)
+	metrics.Write(&buf, "rediq_cache_bytes", "Approximate size of values by namespace.", "gauge", sizes...)
+	metrics.Write(&buf, "rediq_cache_shard_keys", "Keys by shard.", "gauge", shardKeys...)
+
+	a.metrics.latency.Render(&buf)
+	a.metrics.requests.Render(&buf)
+	c.Data(http.StatusOK, "text/plain; version=0.0.4", buf.Bytes())
+}
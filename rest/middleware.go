@@ -1,24 +1,90 @@
 package rest
 
 import (
+	"crypto/subtle"
+	"github.com/Phil192/rediq/auth"
 	"github.com/gin-gonic/gin"
+	"net/http"
 	"os"
+	"strings"
 )
 
+const userKey = "user"
+
+// TokenAuthMiddleware compares the token header with TOKEN env, in any
+// gin mode.
 func TokenAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if !gin.IsDebugging() {
-			token := c.Request.Header.Get("token")
-			if token == "" {
-				c.AbortWithStatus(401)
+		token := c.Request.Header.Get("token")
+		expected := os.Getenv("TOKEN")
+		if token == "" || expected == "" ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+// AuthMiddleware authenticates caller with a bearer token signed by secret
+// or with basic auth against ACL, either of them may be nil. Then it checks
+// the caller is allowed to run cmd requiring permission perm.
+func AuthMiddleware(acl *auth.ACL, secret []byte, cmd string, perm auth.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var principal auth.Principal
+		header := c.Request.Header.Get("Authorization")
+		if strings.HasPrefix(header, "Bearer ") && secret != nil {
+			claims, err := auth.Verify(secret, strings.TrimPrefix(header, "Bearer "))
+			if err != nil {
+				c.AbortWithError(http.StatusUnauthorized, err)
 				return
 			}
-			if os.Getenv("TOKEN") != token {
-				c.AbortWithStatus(401)
+			principal = claims
+		} else if name, pass, ok := c.Request.BasicAuth(); ok && acl != nil {
+			user, err := acl.Authenticate(name, pass)
+			if err != nil {
+				c.AbortWithError(http.StatusUnauthorized, err)
 				return
 			}
-			c.Next()
+			principal = user
+		} else {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
 		}
+		// set before the check to log who is denied
+		c.Set(userKey, principal)
+		if !principal.Allows(cmd, perm) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Next()
+	}
+}
+
+// currentUser returns nil when the app runs with the shared token.
+func currentUser(c *gin.Context) auth.Principal {
+	u, ok := c.Get(userKey)
+	if !ok {
+		return nil
+	}
+	return u.(auth.Principal)
+}
+
+// allowKey aborts the request with 403 if the user has no access to key.
+func allowKey(c *gin.Context, key string) bool {
+	if u := currentUser(c); u != nil && !u.CanAccess(key) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return false
+	}
+	return true
+}
 
+// allowAllKeys aborts the request with 403 if the user is limited
+// by key patterns, it guards commands touching arbitrary keys.
+func allowAllKeys(c *gin.Context) bool {
+	if u := currentUser(c); u != nil && !u.CanAccessAll() {
+		c.AbortWithStatus(http.StatusForbidden)
+		return false
 	}
+	return true
 }
@@ -1,9 +1,13 @@
 package rest
 
 import (
+	"github.com/Phil192/rediq/auth"
+	"github.com/Phil192/rediq/config"
+	"github.com/Phil192/rediq/trace"
 	"github.com/gin-gonic/gin"
 	"io"
 	"os"
+	"time"
 )
 
 type listenerOpt func(o *listenerOptions)
@@ -11,6 +15,30 @@ type listenerOpt func(o *listenerOptions)
 type listenerOptions struct {
 	socket string
 	engine *gin.Engine
+	acl    *auth.ACL
+	noAuth bool
+
+	publicMetrics bool
+
+	tokenSecret []byte
+
+	certFile string
+	keyFile  string
+	clientCA string
+
+	version string
+
+	slowLogThreshold time.Duration
+	slowLogSize      int
+
+	reload func() (*config.Report, error)
+
+	logValues bool
+
+	auditWriter     io.Writer
+	auditNamespaces []string
+
+	tracer trace.Tracer
 }
 
 func LogFile(logFile io.Writer) listenerOpt {
@@ -27,3 +55,103 @@ func SetSocket(sock string) listenerOpt {
 		o.socket = sock
 	}
 }
+
+// ACL switches authentication from the shared TOKEN to named users.
+func ACL(acl *auth.ACL) listenerOpt {
+	return func(o *listenerOptions) {
+		o.acl = acl
+	}
+}
+
+// NoAuth serves every request without authentication if disabled is
+// true, ACL and token secret are ignored then. It is meant for trusted
+// networks and tests.
+func NoAuth(disabled bool) listenerOpt {
+	return func(o *listenerOptions) {
+		o.noAuth = disabled
+	}
+}
+
+// PublicMetrics serves /metrics without authentication if public is
+// true, e.g. for a scraper in a trusted network. Otherwise metrics
+// require admin permission.
+func PublicMetrics(public bool) listenerOpt {
+	return func(o *listenerOptions) {
+		o.publicMetrics = public
+	}
+}
+
+// TokenSecret enables bearer tokens signed with secret, see auth.Mint.
+func TokenSecret(secret []byte) listenerOpt {
+	return func(o *listenerOptions) {
+		if len(secret) > 0 {
+			o.tokenSecret = secret
+		}
+	}
+}
+
+// TLS serves https with the key pair, certificate is reloaded
+// from disk when the file changes.
+func TLS(certFile, keyFile string) listenerOpt {
+	return func(o *listenerOptions) {
+		o.certFile = certFile
+		o.keyFile = keyFile
+	}
+}
+
+// ClientCA enables mutual TLS, clients must present a certificate
+// signed by one of CAs from the file.
+func ClientCA(caFile string) listenerOpt {
+	return func(o *listenerOptions) {
+		o.clientCA = caFile
+	}
+}
+
+// Version is the build version reported by the info command.
+func Version(v string) listenerOpt {
+	return func(o *listenerOptions) {
+		o.version = v
+	}
+}
+
+// SlowLog records the last size commands running longer than threshold,
+// negative threshold disables the log.
+func SlowLog(threshold time.Duration, size int) listenerOpt {
+	return func(o *listenerOptions) {
+		o.slowLogThreshold = threshold
+		o.slowLogSize = size
+	}
+}
+
+// Reload enables the reload endpoint, fn reloads the config and
+// reports what is applied and what needs a restart.
+func Reload(fn func() (*config.Report, error)) listenerOpt {
+	return func(o *listenerOptions) {
+		o.reload = fn
+	}
+}
+
+// LogValues adds stored values to the request log, they are
+// redacted by default.
+func LogValues(enabled bool) listenerOpt {
+	return func(o *listenerOptions) {
+		o.logValues = enabled
+	}
+}
+
+// Audit appends admin commands and writes to w. Writes are audited only
+// in the namespaces given, all of them if there are none or one is "*".
+func Audit(w io.Writer, namespaces ...string) listenerOpt {
+	return func(o *listenerOptions) {
+		o.auditWriter = w
+		o.auditNamespaces = namespaces
+	}
+}
+
+// Tracer traces commands with t, continuing traces of requests with
+// the traceparent header. Storage spans are children of command spans.
+func Tracer(t trace.Tracer) listenerOpt {
+	return func(o *listenerOptions) {
+		o.tracer = t
+	}
+}
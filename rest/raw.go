@@ -0,0 +1,81 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/Phil192/rediq/storage"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const octetStream = "application/octet-stream"
+
+// putRawHandler stores request body as is, ttl is a duration
+// like 30s and tags are passed with repeated tag params.
+func (a *application) putRawHandler(c *gin.Context) {
+	key := keyParam(c)
+	if key == "" {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	c.Set(argsKey, []string{key})
+	if !allowKey(c, key) {
+		return
+	}
+	var ttl time.Duration
+	if s := c.Query("ttl"); s != "" {
+		var err error
+		ttl, err = time.ParseDuration(s)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+	}
+	data, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	a.logValue(c, string(data))
+	contentType := c.GetHeader("Content-Type")
+	if contentType == "" {
+		contentType = octetStream
+	}
+	err = a.keyspace(c).SetBytes(c.Request.Context(), key, data, contentType, ttl, c.QueryArray("tag")...)
+	if err != nil {
+		c.AbortWithError(errorStatus(err), err)
+		return
+	}
+	c.String(http.StatusOK, fmt.Sprintf("%s/raw/%s", keyspacePath(c), key))
+}
+
+// getRawHandler writes bytes with the stored content type, strings
+// are written as text.
+func (a *application) getRawHandler(c *gin.Context) {
+	key := keyParam(c)
+	if key == "" {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if !allowKey(c, key) {
+		return
+	}
+	val, err := a.keyspace(c).Get(c.Request.Context(), key)
+	if err != nil {
+		c.AbortWithError(errorStatus(err), err)
+		return
+	}
+	switch body := val.Body.(type) {
+	case []byte:
+		contentType := val.ContentType
+		if contentType == "" {
+			contentType = octetStream
+		}
+		c.Data(http.StatusOK, contentType, body)
+	case string:
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(body))
+	default:
+		c.AbortWithError(errorStatus(storage.ErrValueType), storage.ErrValueType)
+	}
+}
@@ -0,0 +1,194 @@
+package rest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Phil192/rediq/storage"
+	"github.com/Phil192/rediq/trace"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	requestIDKey    = "request_id"
+	valueKey        = "value"
+	requestIDHeader = "X-Request-ID"
+
+	// maxRequestIDLen limits ids passed by clients.
+	maxRequestIDLen = 64
+)
+
+// requestID takes the id from the X-Request-ID header or generates one
+// and echoes it in the response.
+func requestID(c *gin.Context) string {
+	id := c.GetHeader(requestIDHeader)
+	if id == "" || len(id) > maxRequestIDLen {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	c.Set(requestIDKey, id)
+	c.Header(requestIDHeader, id)
+	return id
+}
+
+// requestKey is the key the command operates on, if any.
+func requestKey(c *gin.Context) string {
+	if key := keyParam(c); key != "" {
+		return key
+	}
+	if key := c.Query("key"); key != "" {
+		return key
+	}
+	if args := c.GetStringSlice(argsKey); len(args) > 0 {
+		return args[0]
+	}
+	return ""
+}
+
+// userName is the user or token subject, empty for the shared token.
+func userName(c *gin.Context) string {
+	if u := currentUser(c); u != nil {
+		return u.Identity()
+	}
+	return ""
+}
+
+// logValue keeps the stored value, truncated like slow log args, for
+// the request log if values are logged. They are redacted by default.
+func (a *application) logValue(c *gin.Context, v interface{}) {
+	if a.opt.logValues {
+		c.Set(valueKey, truncateArgs([]string{fmt.Sprint(v)})[0])
+	}
+}
+
+// logRequest writes a structured entry per command, use the json
+// formatter of logrus to get json lines.
+func (a *application) logRequest(c *gin.Context, cmd, id string, dur time.Duration) {
+	status := c.Writer.Status()
+	fields := log.Fields{
+		"request_id": id,
+		"cmd":        cmd,
+		"client":     c.ClientIP(),
+		"method":     c.Request.Method,
+		"path":       c.Request.URL.Path,
+		"status":     status,
+		"latency_ms": float64(dur) / float64(time.Millisecond),
+		"bytes_in":   maxInt64(c.Request.ContentLength, 0),
+		"bytes_out":  maxInt64(int64(c.Writer.Size()), 0),
+	}
+	if user := userName(c); user != "" {
+		fields["user"] = user
+	}
+	if sc := trace.SpanFromContext(c.Request.Context()).Context(); sc.IsValid() {
+		fields["trace_id"] = sc.TraceID.String()
+	}
+	if ns := c.Param("ns"); ns != "" {
+		fields["namespace"] = ns
+	}
+	if key := requestKey(c); key != "" {
+		fields["key"] = key
+	}
+	if v, ok := c.Get(valueKey); ok {
+		fields["value"] = v
+	}
+	if err := c.Errors.Last(); err != nil {
+		fields["error"] = err.Error()
+	}
+	entry := log.WithFields(fields)
+	if status >= http.StatusInternalServerError {
+		entry.Errorln("request")
+		return
+	}
+	entry.Infoln("request")
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	User      string    `json:"user,omitempty"`
+	Client    string    `json:"client"`
+	Cmd       string    `json:"cmd"`
+	Namespace string    `json:"namespace,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	Args      []string  `json:"args,omitempty"`
+	Status    int       `json:"status"`
+}
+
+// auditLog appends admin commands and writes to enabled namespaces
+// as json lines. Values are never written.
+type auditLog struct {
+	mx         sync.Mutex
+	enc        *json.Encoder
+	namespaces map[string]bool
+}
+
+// newAuditLog enables all namespaces if there are none or one of them
+// is "*".
+func newAuditLog(w io.Writer, namespaces []string) *auditLog {
+	l := &auditLog{enc: json.NewEncoder(w)}
+	for _, ns := range namespaces {
+		if ns == "*" {
+			return l
+		}
+		if l.namespaces == nil {
+			l.namespaces = make(map[string]bool)
+		}
+		l.namespaces[ns] = true
+	}
+	return l
+}
+
+func (l *auditLog) enabled(ns string) bool {
+	return l.namespaces == nil || l.namespaces[ns]
+}
+
+func (l *auditLog) write(e auditEntry) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if err := l.enc.Encode(e); err != nil {
+		log.Errorln("fail to write audit log:", err)
+	}
+}
+
+// audit records the command after it is handled, including denied
+// ones. Writes are recorded only for enabled namespaces.
+func (a *application) audit(cmd string, admin bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ns := ""
+		if !admin {
+			ns = c.Param("ns")
+			if ns == "" {
+				ns = storage.DefaultNamespace
+			}
+			if !a.auditLog.enabled(ns) {
+				return
+			}
+		}
+		c.Next()
+		a.auditLog.write(auditEntry{
+			Time:      time.Now(),
+			RequestID: c.GetString(requestIDKey),
+			User:      userName(c),
+			Client:    c.ClientIP(),
+			Cmd:       cmd,
+			Namespace: ns,
+			Key:       requestKey(c),
+			Args:      truncateArgs(commandArgs(c)),
+			Status:    c.Writer.Status(),
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package rest
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	argsKey = "args"
+
+	slowLogMaxArgs   = 32
+	slowLogMaxArgLen = 128
+)
+
+type slowEntry struct {
+	ID       int64         `json:"id"`
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+	Command  string        `json:"command"`
+	Args     []string      `json:"args"`
+	Client   string        `json:"client"`
+}
+
+// slowLog keeps the last size commands that took longer than threshold,
+// like Redis SLOWLOG. Negative threshold disables it, zero logs everything.
+type slowLog struct {
+	// threshold is read without mx by every command
+	threshold int64
+	mx        sync.Mutex
+	size      int
+	nextID    int64
+	entries   []slowEntry
+}
+
+func newSlowLog(threshold time.Duration, size int) *slowLog {
+	return &slowLog{
+		threshold: int64(threshold),
+		mx:        sync.Mutex{},
+		size:      size,
+		entries:   make([]slowEntry, 0, size),
+	}
+}
+
+// configure changes the settings on the fly, the newest entries which
+// fit into size are kept.
+func (l *slowLog) configure(threshold time.Duration, size int) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	atomic.StoreInt64(&l.threshold, int64(threshold))
+	if size < 0 {
+		size = 0
+	}
+	l.size = size
+	if len(l.entries) > size {
+		l.entries = append([]slowEntry(nil), l.entries[len(l.entries)-size:]...)
+	}
+}
+
+func (l *slowLog) record(cmd string, start time.Time, dur time.Duration, args []string, client string) {
+	threshold := time.Duration(atomic.LoadInt64(&l.threshold))
+	if threshold < 0 || dur < threshold {
+		return
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if l.size <= 0 {
+		return
+	}
+	if len(l.entries) >= l.size {
+		l.entries = l.entries[len(l.entries)-l.size+1:]
+	}
+	l.entries = append(l.entries, slowEntry{
+		ID:       l.nextID,
+		Time:     start,
+		Duration: dur,
+		Command:  cmd,
+		Args:     truncateArgs(args),
+		Client:   client,
+	})
+	l.nextID++
+}
+
+// get returns up to count entries, the newest first.
+func (l *slowLog) get(count int) []slowEntry {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if count < 0 || count > len(l.entries) {
+		count = len(l.entries)
+	}
+	entries := make([]slowEntry, 0, count)
+	for i := len(l.entries) - 1; i >= len(l.entries)-count; i-- {
+		entries = append(entries, l.entries[i])
+	}
+	return entries
+}
+
+func (l *slowLog) reset() {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.entries = l.entries[:0]
+}
+
+func truncateArgs(args []string) []string {
+	if len(args) > slowLogMaxArgs {
+		args = append(args[:slowLogMaxArgs-1:slowLogMaxArgs-1], "... ("+strconv.Itoa(len(args)-slowLogMaxArgs+1)+" more)")
+	}
+	truncated := make([]string, 0, len(args))
+	for _, arg := range args {
+		if len(arg) > slowLogMaxArgLen {
+			arg = arg[:slowLogMaxArgLen] + "..."
+		}
+		truncated = append(truncated, arg)
+	}
+	return truncated
+}
+
+// commandArgs collects path params, query values and args set
+// by the handler itself, e.g. the key of a posted item.
+func commandArgs(c *gin.Context) []string {
+	args := make([]string, 0, len(c.Params))
+	for _, p := range c.Params {
+		// catch-all params of keys and tags start with a slash
+		args = append(args, strings.TrimPrefix(p.Value, "/"))
+	}
+	for _, values := range c.Request.URL.Query() {
+		args = append(args, values...)
+	}
+	return append(args, c.GetStringSlice(argsKey)...)
+}
+
+// clientName identifies the caller by its user or token subject if any.
+func clientName(c *gin.Context) string {
+	if u := currentUser(c); u != nil {
+		return u.Identity()
+	}
+	return c.ClientIP()
+}
+
+func (a *application) slowLogHandler(c *gin.Context) {
+	count := 10
+	if s := c.Query("count"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		count = n
+	}
+	c.JSON(http.StatusOK, a.slowLog.get(count))
+}
+
+func (a *application) slowLogResetHandler(c *gin.Context) {
+	a.slowLog.reset()
+	c.JSON(http.StatusOK, "OK")
+}
@@ -0,0 +1,106 @@
+package rest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrBadCA = errors.New("no certificates found in client CA file")
+
+// certReloader serves the key pair from files and reloads it once the
+// certificate file is modified, so renewed certificates are picked up
+// without restart.
+type certReloader struct {
+	mx       sync.RWMutex
+	certFile string
+	keyFile  string
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		mx:       sync.RWMutex{},
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	info, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.cert = &cert
+	r.modTime = info.ModTime()
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mx.RLock()
+	modTime := r.modTime
+	r.mx.RUnlock()
+	if info, err := os.Stat(r.certFile); err == nil && !info.ModTime().Equal(modTime) {
+		if err := r.reload(); err != nil {
+			log.Warningln("fail to reload certificate, keep the old one:", err)
+		} else {
+			log.Infoln("certificate reloaded:", r.certFile)
+		}
+	}
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return r.cert, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, ErrBadCA
+	}
+	return pool, nil
+}
+
+// tlsConfig returns nil if TLS isn't configured. With client CA set
+// clients must present a certificate signed by it.
+func (a *application) tlsConfig() (*tls.Config, error) {
+	if a.opt.certFile == "" {
+		return nil, nil
+	}
+	reloader, err := newCertReloader(a.opt.certFile, a.opt.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if a.opt.clientCA != "" {
+		pool, err := loadCertPool(a.opt.clientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
@@ -0,0 +1,115 @@
+package rest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/Phil192/rediq/client"
+	"github.com/Phil192/rediq/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(r *require.Assertions, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	r.NoError(err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	r.NoError(err)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	r.NoError(err)
+	cert, err := x509.ParseCertificate(der)
+	r.NoError(err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) write(r *require.Assertions, dir, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	r.NoError(err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	r.NoError(ioutil.WriteFile(certFile, certPEM, 0600))
+	r.NoError(ioutil.WriteFile(keyFile, keyPEM, 0600))
+	return certFile, keyFile
+}
+
+func TestMutualTLS(t *testing.T) {
+	r := require.New(t)
+	dir, err := ioutil.TempDir("", "rediq-tls")
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(r, "rediq-ca", nil)
+	caFile, _ := ca.write(r, dir, "ca")
+	srvCert, srvKey := newTestCert(r, "server", ca).write(r, dir, "server")
+	cliCert, cliKey := newTestCert(r, "client", ca).write(r, dir, "client")
+
+	app := NewApp(storage.NewCache(), TLS(srvCert, srvKey), ClientCA(caFile), NoAuth(true))
+	app.RouteAPI(gin.New())
+	cfg, err := app.tlsConfig()
+	r.NoError(err)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	r.NoError(err)
+	defer ln.Close()
+	go http.Serve(ln, app.mux)
+	addr := "https://" + ln.Addr().String()
+
+	cli, err := client.NewClient(addr, "", "", client.RootCA(caFile), client.ClientCert(cliCert, cliKey))
+	r.NoError(err)
+	_, err = cli.Get(addr, "/api/v1/dbsize")
+	r.NoError(err)
+
+	anonymous, err := client.NewClient(addr, "", "", client.RootCA(caFile))
+	r.NoError(err)
+	_, err = anonymous.Get(addr, "/api/v1/dbsize")
+	r.Error(err)
+
+	renewed := newTestCert(r, "renewed", ca)
+	renewed.write(r, dir, "server")
+	future := time.Now().Add(time.Minute)
+	r.NoError(os.Chtimes(srvCert, future, future))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{renewed.der}, PrivateKey: renewed.key}},
+	})
+	r.NoError(err)
+	defer conn.Close()
+	r.Equal("renewed", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+}
@@ -0,0 +1,44 @@
+package rest
+
+import (
+	"github.com/Phil192/rediq/trace"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// startSpan starts the server span of the command, a child of the
+// client span from the traceparent header if any. Handlers get it with
+// the request context.
+func (a *application) startSpan(c *gin.Context, cmd, id string) trace.Span {
+	if a.opt.tracer == nil {
+		return trace.SpanFromContext(c.Request.Context())
+	}
+	// a malformed header starts a new trace
+	remote, _ := trace.ParseTraceparent(c.GetHeader(trace.Header))
+	ctx, span := trace.StartWith(c.Request.Context(), a.opt.tracer, "rediq "+cmd, remote)
+	c.Request = c.Request.WithContext(ctx)
+	span.SetAttribute("rediq.cmd", cmd)
+	span.SetAttribute("rediq.request_id", id)
+	span.SetAttribute("http.method", c.Request.Method)
+	if ns := c.Param("ns"); ns != "" {
+		span.SetAttribute("rediq.namespace", ns)
+	}
+	return span
+}
+
+func (a *application) endSpan(c *gin.Context, span trace.Span) {
+	if a.opt.tracer == nil {
+		return
+	}
+	status := c.Writer.Status()
+	span.SetAttribute("http.status_code", status)
+	if user := userName(c); user != "" {
+		span.SetAttribute("enduser.id", user)
+	}
+	if status >= http.StatusInternalServerError {
+		if err := c.Errors.Last(); err != nil {
+			span.SetError(err.Err)
+		}
+	}
+	span.End()
+}
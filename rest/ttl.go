@@ -0,0 +1,50 @@
+package rest
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+type ttlItem struct {
+	TTL time.Duration `json:"ttl"`
+}
+
+// ttlHandler answers the remaining ttl of the key in nanoseconds,
+// zero for persistent keys.
+func (a *application) ttlHandler(c *gin.Context) {
+	key := keyParam(c)
+	if !allowKey(c, key) {
+		return
+	}
+	val, err := a.keyspace(c).Get(c.Request.Context(), key)
+	if err != nil {
+		c.AbortWithError(errorStatus(err), err)
+		return
+	}
+	c.JSON(http.StatusOK, ttlItem{TTL: val.TTL})
+}
+
+// expireHandler sets the ttl given as a duration like 30s, zero or
+// missing ttl makes the key persistent.
+func (a *application) expireHandler(c *gin.Context) {
+	key := keyParam(c)
+	c.Set(argsKey, []string{key})
+	if !allowKey(c, key) {
+		return
+	}
+	var ttl time.Duration
+	if s := c.Query("ttl"); s != "" {
+		var err error
+		ttl, err = time.ParseDuration(s)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+	}
+	if err := a.keyspace(c).Expire(c.Request.Context(), key, ttl); err != nil {
+		c.AbortWithError(errorStatus(err), err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,73 @@
+package rest
+
+import (
+	"encoding/json"
+	"github.com/Phil192/rediq/storage"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+const (
+	watchBuffer    = 1024
+	watchHeartbeat = 15 * time.Second
+
+	// control lines of the watch stream besides changes
+	watchReady storage.ChangeOp = "ready"
+	watchPing  storage.ChangeOp = "ping"
+	watchReset storage.ChangeOp = "reset"
+)
+
+// watchHandler streams changes of the namespace as newline delimited
+// json until the client goes away or the server shuts down. The first
+// line is {"op":"ready"}, sent once the subscription is made, pings
+// keep idle streams alive. A client falling behind gets {"op":"reset"}
+// and the stream ends, keys the user can't access are left out.
+func (a *application) watchHandler(c *gin.Context) {
+	sub, err := a.keyspace(c).Watch(watchBuffer)
+	if err != nil {
+		c.AbortWithError(errorStatus(err), err)
+		return
+	}
+	defer sub.Close()
+	u := currentUser(c)
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	enc := json.NewEncoder(c.Writer)
+	send := func(change storage.Change) bool {
+		if err := enc.Encode(change); err != nil {
+			return false
+		}
+		c.Writer.Flush()
+		return true
+	}
+	if !send(storage.Change{Op: watchReady}) {
+		return
+	}
+	c.Set(streamKey, time.Now())
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case change, ok := <-sub.Changes():
+			if !ok {
+				send(storage.Change{Op: watchReset})
+				return
+			}
+			if u != nil && change.Key != "" && !u.CanAccess(change.Key) {
+				continue
+			}
+			if !send(change) {
+				return
+			}
+		case <-heartbeat.C:
+			if !send(storage.Change{Op: watchPing}) {
+				return
+			}
+		case <-c.Request.Context().Done():
+			return
+		case <-a.stopWatch:
+			return
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"context"
+	"github.com/gobwas/glob"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// Downgrade exposes s with the original Storer interface, every
+// operation runs with the background context.
+func Downgrade(s StorerV2) Storer {
+	return &v1Storer{v1Keyspace{s}, s}
+}
+
+// Upgrade exposes s with the StorerV2 interface. Stores created with
+// NewCache are unwrapped, so operations honour the context, other
+// implementations only check the context before every operation.
+func Upgrade(s Storer) StorerV2 {
+	if v1, ok := s.(*v1Storer); ok {
+		return v1.s
+	}
+	return &v2Storer{v2Keyspace{s}, s}
+}
+
+type v1Keyspace struct {
+	ks KeyspaceV2
+}
+
+func (k v1Keyspace) Name() string {
+	return k.ks.Name()
+}
+
+func (k v1Keyspace) Len() int {
+	return k.ks.Len()
+}
+
+func (k v1Keyspace) Usage() Usage {
+	return k.ks.Usage()
+}
+
+func (k v1Keyspace) Get(key string) (*Value, error) {
+	return k.ks.Get(context.Background(), key)
+}
+
+func (k v1Keyspace) GetBy(key string, subSeq interface{}) (interface{}, error) {
+	return k.ks.GetBy(context.Background(), key, subSeq)
+}
+
+func (k v1Keyspace) Set(key string, data interface{}, ttl time.Duration, tags ...string) error {
+	return k.ks.Set(context.Background(), key, data, ttl, tags...)
+}
+
+// Keys returns no keys for a malformed mask.
+func (k v1Keyspace) Keys(mask string) []string {
+	keys, err := k.ks.Keys(context.Background(), mask)
+	if err != nil {
+		log.Warningln(err)
+		return []string{}
+	}
+	return keys
+}
+
+func (k v1Keyspace) Remove(key string) error {
+	return k.ks.Remove(context.Background(), key)
+}
+
+func (k v1Keyspace) InvalidateTag(tag string) ([]string, error) {
+	return k.ks.InvalidateTag(context.Background(), tag)
+}
+
+func (k v1Keyspace) Flush() error {
+	return k.ks.Flush(context.Background())
+}
+
+type v1Storer struct {
+	v1Keyspace
+	s StorerV2
+}
+
+func (s *v1Storer) Select(name string) Keyspace {
+	return v1Keyspace{s.s.Select(name)}
+}
+
+func (s *v1Storer) Namespaces() map[string]Usage {
+	return s.s.Namespaces()
+}
+
+func (s *v1Storer) FlushAll() error {
+	return s.s.FlushAll(context.Background())
+}
+
+func (s *v1Storer) Metrics() Metrics {
+	return s.s.Metrics()
+}
+
+func (s *v1Storer) Stats() Stats {
+	return s.s.Stats()
+}
+
+func (s *v1Storer) Ready() bool {
+	return s.s.Ready()
+}
+
+// Run logs dump load failure, the cache starts empty then.
+func (s *v1Storer) Run() {
+	if err := s.s.Run(context.Background()); err != nil {
+		log.Warningln(err)
+	}
+}
+
+func (s *v1Storer) Close(ctx context.Context) error {
+	return s.s.Close(ctx)
+}
+
+type v2Keyspace struct {
+	ks Keyspace
+}
+
+func (k v2Keyspace) Name() string {
+	return k.ks.Name()
+}
+
+func (k v2Keyspace) Len() int {
+	return k.ks.Len()
+}
+
+func (k v2Keyspace) Usage() Usage {
+	return k.ks.Usage()
+}
+
+func (k v2Keyspace) Get(ctx context.Context, key string) (*Value, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return k.ks.Get(key)
+}
+
+func (k v2Keyspace) GetBy(ctx context.Context, key string, subSeq interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return k.ks.GetBy(key, subSeq)
+}
+
+func (k v2Keyspace) Set(ctx context.Context, key string, data interface{}, ttl time.Duration, tags ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return k.ks.Set(key, data, ttl, tags...)
+}
+
+// Keys validates mask first, as old implementations may panic on it.
+func (k v2Keyspace) Keys(ctx context.Context, mask string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := glob.Compile(mask); err != nil {
+		return nil, &PatternError{Pattern: mask, Err: err}
+	}
+	return k.ks.Keys(mask), nil
+}
+
+// SetBytes stores data without content type, old Keyspace has no place for it.
+func (k v2Keyspace) SetBytes(ctx context.Context, key string, data []byte, contentType string, ttl time.Duration, tags ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return k.ks.Set(key, data, ttl, tags...)
+}
+
+// Expire is not supported, old Keyspace can't change ttl of a key.
+func (k v2Keyspace) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ErrUnsupportedStorer
+}
+
+func (k v2Keyspace) Remove(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return k.ks.Remove(key)
+}
+
+func (k v2Keyspace) InvalidateTag(ctx context.Context, tag string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return k.ks.InvalidateTag(tag)
+}
+
+func (k v2Keyspace) Flush(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return k.ks.Flush()
+}
+
+// Watch is not supported, old Keyspace doesn't publish changes.
+func (k v2Keyspace) Watch(buffer int) (*Subscription, error) {
+	return nil, ErrUnsupportedStorer
+}
+
+type v2Storer struct {
+	v2Keyspace
+	s Storer
+}
+
+func (s *v2Storer) Select(name string) KeyspaceV2 {
+	return v2Keyspace{s.s.Select(name)}
+}
+
+func (s *v2Storer) Namespaces() map[string]Usage {
+	return s.s.Namespaces()
+}
+
+func (s *v2Storer) FlushAll(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.s.FlushAll()
+}
+
+func (s *v2Storer) Metrics() Metrics {
+	return s.s.Metrics()
+}
+
+func (s *v2Storer) Stats() Stats {
+	return s.s.Stats()
+}
+
+func (s *v2Storer) Ready() bool {
+	return s.s.Ready()
+}
+
+func (s *v2Storer) Run(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.s.Run()
+	return nil
+}
+
+func (s *v2Storer) Close(ctx context.Context) error {
+	return s.s.Close(ctx)
+}
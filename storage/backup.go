@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var ErrImportMode = errors.New("import mode must be merge or replace")
+
+// ImportMode tells Import what to do with keys missing in the backup:
+// merge keeps them, replace drops them.
+type ImportMode int
+
+const (
+	ImportMerge ImportMode = iota
+	ImportReplace
+)
+
+func ParseImportMode(s string) (ImportMode, error) {
+	switch s {
+	case "", "merge":
+		return ImportMerge, nil
+	case "replace":
+		return ImportReplace, nil
+	}
+	return ImportMerge, ErrImportMode
+}
+
+// Record is a key of the backup stream, which is newline delimited json.
+// TTL of the value is the time left when the snapshot was taken.
+type Record struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	Value     *Value `json:"value"`
+}
+
+// NewRecord makes a record to import with ImportRecords, body is
+// converted like in Set.
+func NewRecord(ns, key string, body interface{}, ttl time.Duration, tags ...string) (Record, error) {
+	v, err := newValue(body, ttl)
+	if err != nil {
+		return Record{}, err
+	}
+	v.Tags = tags
+	return Record{Namespace: ns, Key: key, Value: v}, nil
+}
+
+// ImportError is returned by Import for a broken record, which is
+// counted from 1. Nothing is imported then.
+type ImportError struct {
+	Record int
+	Err    error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("bad backup record %d: %s", e.Record, e.Err)
+}
+
+// Export writes a point-in-time snapshot of s to w. Writes are blocked
+// only while the snapshot is taken, not while it is written.
+func Export(ctx context.Context, s StorerV2, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return Walk(ctx, s, func(rec Record) error {
+		return enc.Encode(rec)
+	})
+}
+
+// Walk calls fn for every key of a point-in-time snapshot of s, ordered
+// by namespace and key. Values are decompressed and must not be changed.
+func Walk(ctx context.Context, s StorerV2, fn func(Record) error) error {
+	c, ok := s.(*cache)
+	if !ok {
+		return ErrUnsupportedStorer
+	}
+	snap := c.snapshotItems()
+	for _, ns := range c.namespaceList() {
+		items := snap[ns.name]
+		keys := make([]string, 0, len(items))
+		for k := range items {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			v, err := items[k].unpack()
+			if err != nil {
+				return err
+			}
+			if err := fn(Record{Namespace: ns.name, Key: k, Value: v}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// snapshotItems copies items of every namespace. Values are not copied,
+// since writes replace them instead of changing, so it is enough to hold
+// write locks of all namespaces while the maps are copied.
+func (c *cache) snapshotItems() map[string]map[string]*Value {
+	spaces := c.namespaceList()
+	for _, ns := range spaces {
+		ns.tags.mx.Lock()
+	}
+	snap := make(map[string]map[string]*Value, len(spaces))
+	for _, ns := range spaces {
+		items := make(map[string]*Value, ns.Len())
+		for _, sh := range ns.snapshot() {
+			sh.shMux.RLock()
+			for k, v := range sh.items {
+				items[k] = v
+			}
+			sh.shMux.RUnlock()
+		}
+		snap[ns.name] = items
+	}
+	for _, ns := range spaces {
+		ns.tags.mx.Unlock()
+	}
+	return snap
+}
+
+// Import loads a backup written by Export into s and returns the number
+// of imported keys. The whole backup is read before the cache is changed,
+// so a broken one is not imported partially. Quotas of namespaces are
+// checked against the whole backup before the cache is changed, with
+// current keys in merge mode. Concurrent writes may still take the room,
+// then the backup is imported up to the failed key.
+func Import(ctx context.Context, s StorerV2, r io.Reader, mode ImportMode) (int, error) {
+	c, ok := s.(*cache)
+	if !ok {
+		return 0, ErrUnsupportedStorer
+	}
+	var records []Record
+	dec := json.NewDecoder(r)
+	for {
+		var rec Record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err == nil && rec.Value == nil {
+			err = ErrValueType
+		}
+		if err != nil {
+			return 0, &ImportError{Record: len(records) + 1, Err: err}
+		}
+		records = append(records, rec)
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
+	return c.importRecords(ctx, records, mode, true)
+}
+
+// ImportRecords puts records into s the way Import does, except that
+// replace mode flushes only the namespaces of records, since data of
+// other tools doesn't hold the whole cache.
+func ImportRecords(ctx context.Context, s StorerV2, records []Record, mode ImportMode) (int, error) {
+	c, ok := s.(*cache)
+	if !ok {
+		return 0, ErrUnsupportedStorer
+	}
+	return c.importRecords(ctx, records, mode, false)
+}
+
+// importRecords puts records bypassing rate limits and default TTL of
+// namespaces, replace mode flushes every namespace if all is set.
+func (c *cache) importRecords(ctx context.Context, records []Record, mode ImportMode, all bool) (int, error) {
+	for _, rec := range records {
+		rec.Value.size = sizeOf(rec.Value.Body)
+		if err := c.opt.pack(rec.Value); err != nil {
+			return 0, err
+		}
+	}
+	if err := c.fits(records, mode); err != nil {
+		return 0, err
+	}
+	if mode == ImportReplace {
+		if err := c.flush(ctx, records, all); err != nil {
+			return 0, err
+		}
+	}
+	for i, rec := range records {
+		if err := c.namespace(rec.Namespace).put(ctx, rec.Key, rec.Value); err != nil {
+			return i, err
+		}
+	}
+	return len(records), nil
+}
+
+// flush drops keys of namespaces of records or of every namespace.
+func (c *cache) flush(ctx context.Context, records []Record, all bool) error {
+	if all {
+		return c.FlushAll(ctx)
+	}
+	flushed := make(map[*namespace]bool)
+	for _, rec := range records {
+		ns := c.namespace(rec.Namespace)
+		if flushed[ns] {
+			continue
+		}
+		flushed[ns] = true
+		if err := ns.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fits checks that records put one by one stay within the keys and
+// bytes quotas, starting from empty namespaces in replace mode and from
+// current usage in merge mode. Evicting namespaces have only bytes
+// checked, as if nothing were evicted.
+func (c *cache) fits(records []Record, mode ImportMode) error {
+	type usage struct {
+		opt *namespaceOptions
+		// current keys of merged namespace, nil in replace mode
+		ns    *namespace
+		sizes map[string]int64
+		keys  uint
+		bytes int64
+	}
+	c.mx.Lock()
+	spaces := make(map[string]*usage)
+	for _, rec := range records {
+		name := rec.Namespace
+		if name == "" {
+			name = DefaultNamespace
+		}
+		if _, ok := spaces[name]; ok {
+			continue
+		}
+		u := &usage{opt: &namespaceOptions{}, sizes: make(map[string]int64)}
+		if opt, ok := c.opt.Namespaces[name]; ok {
+			u.opt = opt
+		}
+		if ns, ok := c.spaces[name]; ok && mode == ImportMerge {
+			u.ns = ns
+			u.keys = uint(ns.Len())
+			u.bytes = atomic.LoadInt64(&ns.bytes)
+		}
+		spaces[name] = u
+	}
+	c.mx.Unlock()
+	for _, rec := range records {
+		name := rec.Namespace
+		if name == "" {
+			name = DefaultNamespace
+		}
+		u := spaces[name]
+		old, ok := u.sizes[rec.Key]
+		if !ok && u.ns != nil {
+			if v, err := u.ns.get(rec.Key); err == nil {
+				old, ok = v.size, true
+			}
+		}
+		u.bytes += rec.Value.size - old
+		if u.opt.MaxBytes > 0 && u.bytes > int64(u.opt.MaxBytes) {
+			return &ErrQuotaExceeded{Namespace: name, Resource: QuotaBytes, Limit: u.opt.MaxBytes}
+		}
+		if !ok {
+			if u.opt.MaxKeys > 0 && u.opt.Eviction != EvictRandom && u.keys >= u.opt.MaxKeys {
+				return &ErrQuotaExceeded{Namespace: name, Resource: QuotaKeys, Limit: u.opt.MaxKeys}
+			}
+			u.keys++
+		}
+		u.sizes[rec.Key] = rec.Value.size
+	}
+	return nil
+}
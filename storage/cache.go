@@ -1,39 +1,66 @@
 package storage
 
 import (
-	"crypto/sha1"
+	"context"
 	"encoding/json"
-	"fmt"
-	"github.com/gobwas/glob"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"os"
-	"os/signal"
-	"reflect"
+	"sort"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 )
 
 type cache struct {
+	dumpDuration int64
+	ready        int32
+	started      time.Time
+
+	dumpMx      sync.Mutex
+	lastDump    time.Time
+	lastDumpErr error
+
 	mx     sync.Mutex
-	shards map[string]*shard
+	spaces map[string]*namespace
+	// pending watchers of namespaces which are not created yet
+	pending  map[string]*watchers
+	counters *counters
 
-	gcChan chan itemOnDelete
-	stopGC chan struct{}
+	gcChan   chan itemOnDelete
+	stopGC   chan struct{}
+	stopOnce sync.Once
 
 	opt *cacheOptions
 }
 
+// NewCache creates a cache with the original Storer interface,
+// see NewCacheV2 for the context aware one.
 func NewCache(opts ...cacheOpt) Storer {
+	return Downgrade(newCache(opts...))
+}
+
+func NewCacheV2(opts ...cacheOpt) StorerV2 {
+	return newCache(opts...)
+}
+
+func newCache(opts ...cacheOpt) *cache {
 	c := cache{
-		mx:     sync.Mutex{},
-		stopGC: make(chan struct{}),
+		started:  time.Now(),
+		mx:       sync.Mutex{},
+		counters: &counters{},
+		stopGC:   make(chan struct{}),
 		opt: &cacheOptions{
 			2048,
 			256,
 			".",
 			64,
+			make(map[string]*namespaceOptions),
+			nil,
+			0,
+			nil,
+			false,
+			nil,
 		},
 	}
 	for _, o := range opts {
@@ -42,232 +69,335 @@ func NewCache(opts ...cacheOpt) Storer {
 		}
 	}
 	c.gcChan = make(chan itemOnDelete, c.opt.GCCap)
-	c.shards = make(map[string]*shard, c.opt.BucketsNum)
+	c.spaces = make(map[string]*namespace)
+	c.pending = make(map[string]*watchers)
+	c.spaces[DefaultNamespace] = newNamespace(DefaultNamespace, &c)
+	for name := range c.opt.Namespaces {
+		c.spaces[name] = newNamespace(name, &c)
+	}
 	return &c
 }
 
-func (c *cache) Get(key string) (*Value, error) {
-	return c.get(key)
-}
-
-func (c *cache) GetBy(key string, subSeq interface{}) (interface{}, error) {
-	item, err := c.get(key)
-	if err != nil {
-		return nil, err
-	}
-	var body reflect.Value
-	switch reflect.TypeOf(item.Body).Kind() {
-	case reflect.Slice:
-		body = reflect.ValueOf(item.Body)
-	case reflect.Map:
-		body = reflect.ValueOf(item.Body)
-	default:
-		return nil, ErrNotSequence
+// Select returns the keyspace with the given name, like Redis SELECT.
+// Namespaces which are neither configured nor written yet are created
+// by the first write, reads of them fail with ErrNamespaceNotFound.
+// An empty name selects the default namespace.
+func (c *cache) Select(name string) KeyspaceV2 {
+	if name == "" {
+		name = DefaultNamespace
 	}
-	switch reflect.TypeOf(subSeq).Kind() {
-	case reflect.Uint, reflect.Int:
-		ss := reflect.ValueOf(subSeq)
-		subKey := ss.Int()
-		return body.Index(int(subKey)).Interface(), nil
-	case reflect.String:
-		return body.MapIndex(reflect.ValueOf(subSeq)).Interface(), nil
-	default:
-		return nil, ErrSubSeqType
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if ns, ok := c.spaces[name]; ok {
+		return ns
 	}
+	return &unknownNamespace{name: name, c: c}
 }
 
-func (c *cache) get(key string) (*Value, error) {
-	shard, _, err := c.getOrCreateShard(key)
-	if err != nil {
-		return nil, err
+// namespace returns the namespace with the given name and creates it
+// if it is missing, it is meant for writes.
+func (c *cache) namespace(name string) *namespace {
+	if name == "" {
+		name = DefaultNamespace
 	}
-	shard.shMux.RLock()
-	defer shard.shMux.RUnlock()
-	item, ok := shard.items[key]
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	ns, ok := c.spaces[name]
 	if !ok {
-		return nil, ErrNotFound
+		ns = newNamespace(name, c)
+		c.spaces[name] = ns
 	}
-	return item, nil
+	return ns
 }
 
-type itemOnDelete struct {
-	key string
-	val *Value
+func (c *cache) Namespaces() map[string]Usage {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	usage := make(map[string]Usage, len(c.spaces))
+	for name, ns := range c.spaces {
+		usage[name] = ns.Usage()
+	}
+	return usage
 }
 
-func (c *cache) Set(key string, data interface{}, ttl time.Duration) error {
-	shard, _, err := c.getOrCreateShard(key)
-	if err != nil {
-		return err
-	}
-	v, err := newValue(data, ttl)
-	if err != nil {
-		return err
+// FlushAll drops keys of every namespace, like Redis FLUSHALL.
+func (c *cache) FlushAll(ctx context.Context) error {
+	for _, ns := range c.namespaceList() {
+		if err := ns.Flush(ctx); err != nil {
+			return err
+		}
 	}
-	c.set(shard, key, v)
-	c.gcChan <- itemOnDelete{key: key, val: v}
 	return nil
 }
 
-func (c *cache) set(b *shard, key string, v *Value) {
-	b.shMux.Lock()
-	defer b.shMux.Unlock()
-	b.items[key] = v
-	log.Debugln("set key:", key, "with value:", b.items[key])
+func (c *cache) namespaceList() []*namespace {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	names := make([]string, 0, len(c.spaces))
+	for name := range c.spaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	spaces := make([]*namespace, 0, len(names))
+	for _, name := range names {
+		spaces = append(spaces, c.spaces[name])
+	}
+	return spaces
 }
 
-func (c *cache) Remove(key string) error {
-	shard, shardKey, err := c.getOrCreateShard(key)
-	if err != nil {
-		return err
-	}
-	shard.shMux.Lock()
+func (c *cache) Name() string {
+	return DefaultNamespace
+}
 
-	_, ok := shard.items[key]
-	if ok {
-		delete(shard.items, key)
-		log.Debugln("deleted:", key)
-	}
-	shard.shMux.Unlock()
-	if len(shard.items) == 0 {
-		delete(c.shards, shardKey)
-	}
-	return nil
+func (c *cache) Len() int {
+	return c.namespace(DefaultNamespace).Len()
 }
 
-// https://github.com/gobwas/glob/blob/master/readme.md
-func (c *cache) Keys(mask string) []string {
-	var g glob.Glob
-	matchings := make([]string, 0)
-	var wg sync.WaitGroup
-	mx := new(sync.Mutex)
+func (c *cache) Usage() Usage {
+	return c.namespace(DefaultNamespace).Usage()
+}
 
-	g = glob.MustCompile(mask)
-	for _, sh := range c.shards {
-		wg.Add(1)
-		go func(sh *shard) {
-			defer wg.Done()
-			for k := range sh.items {
-				if g.Match(k) {
-					mx.Lock()
-					matchings = append(matchings, k)
-					mx.Unlock()
-				}
-			}
-		}(sh)
-	}
-	wg.Wait()
-	log.Debugln("keys found:", len(matchings))
-	return matchings
+func (c *cache) Get(ctx context.Context, key string) (*Value, error) {
+	return c.namespace(DefaultNamespace).Get(ctx, key)
 }
 
-func (c *cache) Run() {
+func (c *cache) GetBy(ctx context.Context, key string, subSeq interface{}) (interface{}, error) {
+	return c.namespace(DefaultNamespace).GetBy(ctx, key, subSeq)
+}
+
+func (c *cache) Set(ctx context.Context, key string, data interface{}, ttl time.Duration, tags ...string) error {
+	return c.namespace(DefaultNamespace).Set(ctx, key, data, ttl, tags...)
+}
+
+func (c *cache) SetBytes(ctx context.Context, key string, data []byte, contentType string, ttl time.Duration, tags ...string) error {
+	return c.namespace(DefaultNamespace).SetBytes(ctx, key, data, contentType, ttl, tags...)
+}
+
+func (c *cache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return c.namespace(DefaultNamespace).Expire(ctx, key, ttl)
+}
+
+func (c *cache) Watch(buffer int) (*Subscription, error) {
+	return c.namespace(DefaultNamespace).Watch(buffer)
+}
+
+func (c *cache) Remove(ctx context.Context, key string) error {
+	return c.namespace(DefaultNamespace).Remove(ctx, key)
+}
+
+func (c *cache) InvalidateTag(ctx context.Context, tag string) ([]string, error) {
+	return c.namespace(DefaultNamespace).InvalidateTag(ctx, tag)
+}
+
+func (c *cache) Keys(ctx context.Context, mask string) ([]string, error) {
+	return c.namespace(DefaultNamespace).Keys(ctx, mask)
+}
+
+func (c *cache) Flush(ctx context.Context) error {
+	return c.namespace(DefaultNamespace).Flush(ctx)
+}
+
+type itemOnDelete struct {
+	ns  *namespace
+	key string
+	val *Value
+}
+
+// Run starts expiration and loads the dump. The cache is not ready
+// if the dump fails to load, so that a broken dump is not overwritten
+// by an empty cache unnoticed.
+func (c *cache) Run(ctx context.Context) error {
 	go c.doExpiration()
-	c.readDump()
+	if err := c.readDump(ctx); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&c.ready, 1)
+	return nil
 }
 
-func (c *cache) readDump() {
-	defer os.Remove(c.opt.DumpPath)
+// Ready reports whether the dump is loaded and the cache is not closing.
+func (c *cache) Ready() bool {
+	return atomic.LoadInt32(&c.ready) == 1
+}
+
+func (c *cache) readDump(ctx context.Context) (err error) {
+	ctx, span := c.startSpan(ctx, "storage.load_dump")
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
 	data, err := ioutil.ReadFile(c.opt.DumpPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return
+			return nil
 		}
-		log.Warningln("fail to read dumped data:", err)
-		return
+		return &DumpError{Path: c.opt.DumpPath, Err: err}
+	}
+	if data, err = c.decryptDump(data); err != nil {
+		return &DumpError{Path: c.opt.DumpPath, Err: err}
 	}
-	if err := json.Unmarshal(data, &c.shards); err != nil {
-		log.Warningln("fail to unmarshal dumped data:", err)
-		return
+	var dumped map[string]*dumpedNamespace
+	if err := json.Unmarshal(data, &dumped); err != nil {
+		return &DumpError{Path: c.opt.DumpPath, Err: err}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 	var wg sync.WaitGroup
-	for _, sh := range c.shards {
+	for name, d := range dumped {
 		wg.Add(1)
-		go func(sh *shard) {
+		go func(ns *namespace, d *dumpedNamespace) {
 			defer wg.Done()
-			for k, v := range sh.items {
-				c.gcChan <- itemOnDelete{key: k, val: v}
-			}
-		}(sh)
+			ns.load(d)
+		}(c.namespace(name), d)
 	}
 	wg.Wait()
+	// the dump stays until the final one replaces it, so a crash or
+	// a failed start doesn't lose data
+	return nil
 }
 
-func (c *cache) dumpData() error {
-	if len(c.shards) == 0 {
+func (c *cache) dumpData(ctx context.Context) (err error) {
+	_, span := c.startSpan(ctx, "storage.dump")
+	start := time.Now()
+	defer func() {
+		span.SetError(err)
+		span.End()
+		atomic.StoreInt64(&c.dumpDuration, int64(time.Since(start)))
+		c.dumpMx.Lock()
+		c.lastDump, c.lastDumpErr = start, err
+		c.dumpMx.Unlock()
+	}()
+	dump := make(map[string]*dumpedNamespace)
+	for _, ns := range c.namespaceList() {
+		if ns.Len() == 0 && ns.Usage().Requests == 0 {
+			continue
+		}
+		dump[ns.name] = ns.dump()
+	}
+	span.SetAttribute("rediq.namespaces", len(dump))
+	if len(dump) == 0 {
+		// the previous dump must not bring removed keys back
+		if err := os.Remove(c.opt.DumpPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 		return nil
 	}
 	for tryOut := 3; tryOut > 0; tryOut-- {
-		data, err := json.Marshal(c.shards)
+		data, err := json.Marshal(dump)
 		if err != nil {
 			log.Warningf("fail to dump data: %d tryout", tryOut)
 			continue
 		}
-		if err := ioutil.WriteFile(c.opt.DumpPath, data, 0755); err != nil {
+		if data, err = c.encryptDump(data); err != nil {
+			return err
+		}
+		if err := writeDump(c.opt.DumpPath, data); err != nil {
 			log.Warningf("fail to dump data: %d tryout", tryOut)
 			continue
 		}
+		span.SetAttribute("rediq.dump.bytes", len(data))
 		return nil
 	}
 	return ErrDumpFail
 }
 
+// writeDump writes the dump readable by the owner only, even if it
+// replaces a file with wider permissions. The dump is written next to
+// the old one and renamed over it, so a failed write keeps the old one.
+func writeDump(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 func (c *cache) doExpiration() {
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt, os.Kill, syscall.SIGTERM)
 	for {
 		select {
 		case item := <-c.gcChan:
-			log.Debugln("item to purge", item.key, "time", item.val.TTL)
-			if item.val.TTL == 0 {
+			log.Debugln("item to purge", item.key, "time", item.val.ttl())
+			if item.val.ttl() == 0 {
 				break
 			}
-			go func() {
-				for range time.Tick(time.Second) {
-					if ok := item.val.decrTTL(); !ok {
-						c.Remove(item.key)
-						return
-					}
-				}
-			}()
-		case <-interrupt:
-			c.Close()
-			log.Warningln("interrupted")
-			os.Exit(1)
-		default:
-			break
+			go c.expireAfter(item)
+		case <-c.stopGC:
+			return
 		}
 	}
 }
 
-func (c *cache) Close() {
-	if err := c.dumpData(); err != nil {
-		log.Warningln(err)
-		return
+// expireAfter decrements TTL of the item every second and removes it
+// when TTL is over, unless expiration is stopped before.
+func (c *cache) expireAfter(item itemOnDelete) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if ok := item.val.decrTTL(); !ok {
+				item.ns.expire(item.key, item.val)
+				return
+			}
+		case <-c.stopGC:
+			return
+		}
 	}
-	close(c.gcChan)
-	log.Debugln("cache closed")
 }
 
-func (c *cache) getOrCreateShard(key string) (*shard, string, error) {
-	hasher := sha1.New()
-	_, err := hasher.Write([]byte(key))
-	if err != nil {
-		return nil, "", err
-	}
-	shardKey := fmt.Sprintf("%x", hasher.Sum(nil))[0:2]
-	_, ok := c.shards[shardKey]
-	if !ok {
-		c.newShard(shardKey)
+// Close stops expiration, so no key disappears from the final dump,
+// and dumps data. It returns ctx error if ctx is done before the dump
+// is written. Callers should stop writes before closing the cache.
+func (c *cache) Close(ctx context.Context) error {
+	atomic.StoreInt32(&c.ready, 0)
+	c.stopOnce.Do(func() {
+		close(c.stopGC)
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- c.dumpData(ctx)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+		log.Debugln("cache closed")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return c.shards[shardKey], shardKey, nil
 }
 
-func (c *cache) newShard(shardKey string) {
+// Reconfigure replaces options of namespaces on the fly and creates the
+// configured ones, namespaces missing in cfg get the default options. Keys over the new quotas are
+// kept, the quotas apply to the next writes.
+func Reconfigure(s StorerV2, cfg map[string]NamespaceConfig) error {
+	c, ok := s.(*cache)
+	if !ok {
+		return ErrUnsupportedStorer
+	}
 	c.mx.Lock()
 	defer c.mx.Unlock()
-	c.shards[shardKey] = &shard{
-		shMux: sync.RWMutex{},
-		items: make(map[string]*Value, c.opt.ItemsNum),
+	c.opt.Namespaces = make(map[string]*namespaceOptions, len(cfg))
+	for name, nc := range cfg {
+		c.opt.Namespaces[name] = nc.options()
+		if _, ok := c.spaces[name]; !ok {
+			c.spaces[name] = newNamespace(name, c)
+		}
 	}
+	for name, ns := range c.spaces {
+		opt, ok := c.opt.Namespaces[name]
+		if !ok {
+			opt = &namespaceOptions{}
+		}
+		ns.opt.Store(opt)
+	}
+	return nil
 }
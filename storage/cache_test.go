@@ -1,8 +1,18 @@
 package storage
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Phil192/rediq/trace"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -15,7 +25,7 @@ func TestMain(m *testing.M) {
 	)
 	myCache.Run()
 	code := m.Run()
-	myCache.Close()
+	myCache.Close(context.Background())
 	os.Exit(code)
 }
 
@@ -103,3 +113,750 @@ func TestKeys(t *testing.T) {
 	result := myCache.Keys("Test*eys")
 	r.Equal("TestKeys", result[0])
 }
+
+func TestInvalidateTag(t *testing.T) {
+	r := require.New(t)
+	r.NoError(myCache.Set("testTagOne", "ok", 0, "user:42", "page"))
+	r.NoError(myCache.Set("testTagTwo", "ok", 0, "user:42"))
+	r.NoError(myCache.Set("testTagThree", "ok", 0, "page"))
+	removed, err := myCache.InvalidateTag("user:42")
+	r.NoError(err)
+	r.ElementsMatch([]string{"testTagOne", "testTagTwo"}, removed)
+	_, err = myCache.Get("testTagOne")
+	r.Equal(ErrNotFound, err)
+	_, err = myCache.Get("testTagThree")
+	r.NoError(err)
+	removed, err = myCache.InvalidateTag("page")
+	r.NoError(err)
+	r.Equal([]string{"testTagThree"}, removed)
+}
+
+func TestUntaggedWrites(t *testing.T) {
+	r := require.New(t)
+	dump := filepath.Join(os.TempDir(), "rediq-untagged.dump")
+	os.Remove(dump)
+	defer os.Remove(dump)
+	c := NewCacheV2(DumpPath(dump))
+	ctx := context.Background()
+	r.NoError(c.Run(ctx))
+	defer c.Close(ctx)
+	// an untagged value replacing a tagged one drops its tags
+	r.NoError(c.Set(ctx, "tagged", "old", 0, "page"))
+	r.NoError(c.Set(ctx, "tagged", "new", 0))
+	removed, err := c.InvalidateTag(ctx, "page")
+	r.NoError(err)
+	r.Empty(removed)
+	val, err := c.Get(ctx, "tagged")
+	r.NoError(err)
+	r.Equal("new", val.Body)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("key%d", j)
+				if i%2 == 0 {
+					c.Set(ctx, key, "untagged", 0)
+				} else {
+					c.Set(ctx, key, "tagged", 0, "even")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	r.Equal(101, c.Len())
+	removed, err = c.InvalidateTag(ctx, "even")
+	r.NoError(err)
+	for _, key := range removed {
+		_, err := c.Get(ctx, key)
+		r.Equal(ErrNotFound, err)
+	}
+	r.Equal(101-len(removed), c.Len())
+}
+
+func TestNamespaces(t *testing.T) {
+	r := require.New(t)
+	tenant := myCache.Select("tenant")
+	r.NoError(tenant.Set("testNamespace", "tenant", 0))
+	r.NoError(myCache.Set("testNamespace", "default", 0))
+	val, err := tenant.Get("testNamespace")
+	r.NoError(err)
+	r.Equal("tenant", val.Body)
+	val, err = myCache.Get("testNamespace")
+	r.NoError(err)
+	r.Equal("default", val.Body)
+	r.Equal(1, tenant.Len())
+	r.Equal(int64(1), myCache.Namespaces()["tenant"].Keys)
+	r.NoError(tenant.Flush())
+	_, err = tenant.Get("testNamespace")
+	r.Equal(ErrNotFound, err)
+	r.Equal(0, tenant.Len())
+	_, err = myCache.Get("testNamespace")
+	r.NoError(err)
+	r.NoError(myCache.Remove("testNamespace"))
+}
+
+func TestUnknownNamespace(t *testing.T) {
+	r := require.New(t)
+	c := NewCacheV2(Namespaces(map[string]NamespaceConfig{"configured": {}}))
+	ctx := context.Background()
+	r.Contains(c.Namespaces(), "configured")
+	lazy := c.Select("lazy")
+	_, err := lazy.Get(ctx, "key")
+	r.Equal(ErrNamespaceNotFound, err)
+	_, err = lazy.Keys(ctx, "*")
+	r.Equal(ErrNamespaceNotFound, err)
+	r.NoError(lazy.Remove(ctx, "key"))
+	r.Equal(0, lazy.Len())
+	// watchers wait for the namespace without creating it
+	sub, err := lazy.Watch(4)
+	r.NoError(err)
+	gone, err := c.Select("gone").Watch(1)
+	r.NoError(err)
+	gone.Close()
+	r.NotContains(c.(*cache).pending, "gone")
+	r.NotContains(c.Namespaces(), "lazy")
+
+	r.NoError(lazy.Set(ctx, "key", "ok", 0))
+	r.Contains(c.Namespaces(), "lazy")
+	r.Equal(Change{Namespace: "lazy", Key: "key", Op: ChangeSet}, <-sub.Changes())
+	sub.Close()
+	val, err := lazy.Get(ctx, "key")
+	r.NoError(err)
+	r.Equal("ok", val.Body)
+	val, err = c.Select("lazy").Get(ctx, "key")
+	r.NoError(err)
+	r.Equal("ok", val.Body)
+
+	r.NoError(Reconfigure(c, map[string]NamespaceConfig{"reloaded": {}}))
+	r.Contains(c.Namespaces(), "reloaded")
+}
+
+func TestNamespaceOptions(t *testing.T) {
+	r := require.New(t)
+	c := NewCache(
+		DumpPath("./var/ns.dump"),
+		Namespace("limited", MaxKeys(2)),
+		Namespace("evicted", MaxKeys(2), Eviction(EvictRandom)),
+		Namespace("expiring", DefaultTTL(time.Second)),
+	)
+	c.Run()
+	limited := c.Select("limited")
+	r.NoError(limited.Set("one", "ok", 0))
+	r.NoError(limited.Set("two", "ok", 0))
+	err := limited.Set("three", "ok", 0)
+	r.IsType(&ErrQuotaExceeded{}, err)
+	r.Equal(QuotaKeys, err.(*ErrQuotaExceeded).Resource)
+	r.NoError(limited.Set("two", "overwritten", 0))
+	evicted := c.Select("evicted")
+	for _, key := range []string{"one", "two", "three"} {
+		r.NoError(evicted.Set(key, "ok", 0))
+	}
+	r.Equal(2, evicted.Len())
+	_, err = evicted.Get("three")
+	r.NoError(err)
+	expiring := c.Select("expiring")
+	r.NoError(expiring.Set("one", "ok", 0))
+	time.Sleep(time.Second * 2)
+	_, err = expiring.Get("one")
+	r.Equal(ErrNotFound, err)
+	r.NoError(c.FlushAll())
+	r.Equal(0, limited.Len())
+	r.Equal(0, evicted.Len())
+}
+
+func TestQuotas(t *testing.T) {
+	r := require.New(t)
+	dump := filepath.Join(os.TempDir(), "rediq-quota.dump")
+	os.Remove(dump)
+	defer os.Remove(dump)
+	c := NewCache(
+		DumpPath(dump),
+		Namespace("bytes", MaxBytes(8)),
+		Namespace("rate", MaxRate(2)),
+	)
+	c.Run()
+	bytes := c.Select("bytes")
+	r.NoError(bytes.Set("one", "12345", 0))
+	err := bytes.Set("two", "12345", 0)
+	r.IsType(&ErrQuotaExceeded{}, err)
+	r.Equal(QuotaBytes, err.(*ErrQuotaExceeded).Resource)
+	r.NoError(bytes.Set("one", "12345678", 0))
+	r.Equal(int64(8), bytes.Usage().Bytes)
+	r.NoError(bytes.Remove("one"))
+	r.Equal(int64(0), bytes.Usage().Bytes)
+
+	rate := c.Select("rate")
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	r.NoError(rate.Set("one", "ok", 0))
+	_, err = rate.Get("one")
+	r.NoError(err)
+	_, err = rate.Get("one")
+	r.IsType(&ErrQuotaExceeded{}, err)
+	r.Equal(QuotaRequests, err.(*ErrQuotaExceeded).Resource)
+	usage := rate.Usage()
+	r.Equal(int64(2), usage.Requests)
+	r.Equal(int64(1), usage.Rejected)
+	r.NoError(c.Close(context.Background()))
+
+	restored := NewCache(
+		DumpPath(dump),
+		Namespace("rate", MaxRate(2)),
+	)
+	restored.Run()
+	usage = restored.Select("rate").Usage()
+	r.Equal(int64(1), usage.Keys)
+	r.Equal(int64(2), usage.Requests)
+	r.Equal(int64(1), usage.Rejected)
+	r.NoError(restored.Close(context.Background()))
+}
+
+func TestMetrics(t *testing.T) {
+	r := require.New(t)
+	before := myCache.Metrics()
+	r.NoError(myCache.Set("testMetrics", "ok", 0))
+	_, err := myCache.Get("testMetrics")
+	r.NoError(err)
+	_, err = myCache.Get("testMetricsMissing")
+	r.Equal(ErrNotFound, err)
+	r.NoError(myCache.Remove("testMetrics"))
+	after := myCache.Metrics()
+	r.Equal(before.Sets+1, after.Sets)
+	r.Equal(before.Hits+1, after.Hits)
+	r.Equal(before.Misses+1, after.Misses)
+	r.Equal(before.Removes+1, after.Removes)
+	r.Contains(after.Namespaces, DefaultNamespace)
+}
+
+func TestStats(t *testing.T) {
+	r := require.New(t)
+	c := NewCache()
+	r.NoError(c.Set("testStatsStr", "ok", time.Minute))
+	r.NoError(c.Select("stats").Set("testStatsArr", []interface{}{"a", "b"}, 0))
+	r.NoError(c.Select("stats").Set("testStatsMap", map[string]interface{}{"a": "b"}, 0))
+	s := c.Stats()
+	r.Equal(3, s.Keys)
+	r.Equal(2, s.Namespaces)
+	r.Equal(1, s.KeysWithTTL)
+	r.Equal(1, s.KeysByType["string"])
+	r.Equal(1, s.KeysByType["array"])
+	r.Equal(1, s.KeysByType["mapping"])
+	r.Equal(0, s.KeysByType["typed"])
+	inStats := 0
+	for _, n := range s.ShardKeys["stats"] {
+		inStats += n
+	}
+	r.Equal(2, inStats)
+	r.True(s.Bytes > 0)
+	r.True(s.LastDump.IsZero())
+}
+
+func TestClose(t *testing.T) {
+	r := require.New(t)
+	dump := filepath.Join(os.TempDir(), "rediq-close.dump")
+	os.Remove(dump)
+	defer os.Remove(dump)
+	c := NewCache(DumpPath(dump), GCCap(1))
+	c.Run()
+	r.True(c.Ready())
+	r.NoError(c.Set("testClose", "ok", time.Second))
+	r.NoError(c.Close(context.Background()))
+	r.False(c.Ready())
+	// expiration is stopped and sets do not block on the full gc channel
+	r.NoError(c.Set("testCloseAfter1", "ok", time.Second))
+	r.NoError(c.Set("testCloseAfter2", "ok", time.Second))
+	time.Sleep(1500 * time.Millisecond)
+	_, err := c.Get("testClose")
+	r.NoError(err)
+
+	restored := NewCache(DumpPath(dump))
+	restored.Run()
+	_, err = restored.Get("testClose")
+	r.NoError(err)
+	// the loaded dump stays until the final one replaces it
+	_, err = os.Stat(dump)
+	r.NoError(err)
+	r.NoError(restored.Remove("testClose"))
+	r.NoError(restored.Close(context.Background()))
+
+	// the final dump replaced the loaded one, the removed key stays removed
+	again := NewCache(DumpPath(dump))
+	again.Run()
+	_, err = again.Get("testClose")
+	r.Error(err)
+	r.NoError(again.Close(context.Background()))
+}
+
+func TestStorerV2(t *testing.T) {
+	r := require.New(t)
+	c := NewCacheV2()
+	ctx := context.Background()
+	r.NoError(c.Set(ctx, "testV2", []interface{}{"a"}, 0))
+	_, err := c.Keys(ctx, "[")
+	r.IsType(&PatternError{}, err)
+	_, err = c.GetBy(ctx, "testV2", 1)
+	r.IsType(&IndexError{}, err)
+	_, err = c.GetBy(ctx, "testV2", "a")
+	r.Equal(ErrSubSeqType, err)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = c.Get(cancelled, "testV2")
+	r.Equal(context.Canceled, err)
+	_, err = c.Keys(cancelled, "*")
+	r.Equal(context.Canceled, err)
+
+	_, ok := Upgrade(NewCache()).(*cache)
+	r.True(ok)
+	r.Equal([]string{}, Downgrade(c).Keys("["))
+	legacy := &v2Storer{v2Keyspace{Downgrade(c)}, Downgrade(c)}
+	_, err = legacy.Keys(ctx, "[")
+	r.IsType(&PatternError{}, err)
+	keys, err := legacy.Keys(ctx, "testV*")
+	r.NoError(err)
+	r.Equal([]string{"testV2"}, keys)
+	r.Equal(ErrUnsupportedStorer, legacy.Expire(ctx, "testV2", time.Minute))
+	r.Equal(ErrUnsupportedStorer, legacy.Select("ns").Expire(ctx, "testV2", time.Minute))
+}
+
+type typedUser struct {
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+func TestTypedCache(t *testing.T) {
+	r := require.New(t)
+	dump := filepath.Join(os.TempDir(), "rediq-typed.dump")
+	os.Remove(dump)
+	defer os.Remove(dump)
+	ctx := context.Background()
+	c := NewCacheV2(DumpPath(dump), Namespace("users", MaxKeys(2), Eviction(EvictRandom)))
+	r.NoError(c.Run(ctx))
+	users, err := NewTypedCache(c, TypedOptions[int, typedUser]{Namespace: "users"})
+	r.NoError(err)
+	r.NoError(users.Set(ctx, 1, typedUser{"ann", 30}, 0))
+	u, err := users.Get(ctx, 1)
+	r.NoError(err)
+	r.Equal(typedUser{"ann", 30}, u)
+	_, err = users.Get(ctx, 2)
+	r.Equal(ErrNotFound, err)
+
+	r.NoError(c.Select("users").Set(ctx, "3", "untyped", 0))
+	_, err = users.Get(ctx, 3)
+	r.Equal(ErrTypeMismatch, err)
+	r.NoError(users.Set(ctx, 4, typedUser{"bob", 40}, 0))
+	r.Equal(2, users.Len())
+	r.NoError(users.Remove(ctx, 4))
+	r.NoError(users.Set(ctx, 1, typedUser{"ann", 31}, 0))
+	r.NoError(c.Close(ctx))
+
+	restored := NewCacheV2(DumpPath(dump))
+	r.NoError(restored.Run(ctx))
+	users, err = NewTypedCache(restored, TypedOptions[int, typedUser]{Namespace: "users"})
+	r.NoError(err)
+	u, err = users.Get(ctx, 1)
+	r.NoError(err)
+	r.Equal(typedUser{"ann", 31}, u)
+	loaded, err := restored.Select("users").Get(ctx, "1")
+	r.NoError(err)
+	r.IsType([]byte(nil), loaded.Body)
+
+	_, err = NewTypedCache(&v2Storer{}, TypedOptions[string, string]{})
+	r.Equal(ErrUnsupportedStorer, err)
+	type point struct{ x, y int }
+	_, err = NewTypedCache(restored, TypedOptions[point, string]{})
+	r.Equal(ErrKeyType, err)
+	points, err := NewTypedCache(restored, TypedOptions[point, string]{
+		Key: func(p point) string { return fmt.Sprintf("%d:%d", p.x, p.y) },
+	})
+	r.NoError(err)
+	r.NoError(points.Set(ctx, point{1, 2}, "a", 0))
+	v, err := points.Get(ctx, point{1, 2})
+	r.NoError(err)
+	r.Equal("a", v)
+	r.NoError(restored.Close(ctx))
+}
+
+func TestTypedDump(t *testing.T) {
+	r := require.New(t)
+	dump := filepath.Join(os.TempDir(), "rediq-types.dump")
+	os.Remove(dump)
+	defer os.Remove(dump)
+	ctx := context.Background()
+	values := map[string]interface{}{
+		"str":   "ok",
+		"int":   int64(7),
+		"float": 0.5,
+		"bool":  false,
+		"bytes": []byte("raw"),
+		"set":   NewStringSet("x"),
+		"list":  []interface{}{int64(1), "a"},
+		"map":   map[string]interface{}{"n": int64(2)},
+	}
+	c := NewCacheV2(DumpPath(dump))
+	r.NoError(c.Run(ctx))
+	for k, v := range values {
+		r.NoError(c.Set(ctx, k, v, 0))
+	}
+	r.NoError(c.Set(ctx, "int32", int32(3), 0))
+	r.NoError(c.Close(ctx))
+
+	restored := NewCacheV2(DumpPath(dump))
+	r.NoError(restored.Run(ctx))
+	for k, v := range values {
+		got, err := restored.Get(ctx, k)
+		r.NoError(err)
+		typ, err := TypeOf(v)
+		r.NoError(err)
+		r.Equal(typ, got.DataType, k)
+		r.Equal(v, got.Body, k)
+	}
+	got, err := restored.Get(ctx, "int32")
+	r.NoError(err)
+	r.Equal(int64(3), got.Body)
+	r.NoError(restored.Close(ctx))
+
+	var old Value
+	r.NoError(json.Unmarshal([]byte(`{"body":["a"],"ttl":0}`), &old))
+	r.Equal(ARRAY, old.DataType)
+}
+
+func TestCompression(t *testing.T) {
+	r := require.New(t)
+	dump := filepath.Join(os.TempDir(), "rediq-compress.dump")
+	os.Remove(dump)
+	defer os.Remove(dump)
+	ctx := context.Background()
+	big := strings.Repeat("rediq ", 100)
+	list := []interface{}{big, int64(1)}
+	c := NewCacheV2(DumpPath(dump), Compression(Gzip(gzip.BestSpeed), 64))
+	r.NoError(c.Run(ctx))
+	r.NoError(c.Set(ctx, "big", big, 0))
+	r.NoError(c.Set(ctx, "list", list, 0))
+	r.NoError(c.SetBytes(ctx, "raw", []byte(big), "text/plain", 0))
+	r.NoError(c.Set(ctx, "small", "ok", 0))
+
+	v, err := c.Get(ctx, "big")
+	r.NoError(err)
+	r.Equal(big, v.Body)
+	v, err = c.Get(ctx, "raw")
+	r.NoError(err)
+	r.Equal([]byte(big), v.Body)
+	r.Equal("text/plain", v.ContentType)
+	item, err := c.GetBy(ctx, "list", 1)
+	r.NoError(err)
+	r.Equal(int64(1), item)
+
+	s := c.Stats()
+	r.Equal("gzip", s.Compression)
+	r.Equal(3, s.CompressedKeys)
+	r.True(s.CompressionRatio > 1)
+	r.True(c.Usage().Bytes < int64(3*len(big)))
+	r.NoError(c.Close(ctx))
+
+	data, err := ioutil.ReadFile(dump)
+	r.NoError(err)
+	r.Contains(string(data), big)
+	restored := NewCacheV2(DumpPath(dump))
+	r.NoError(restored.Run(ctx))
+	v, err = restored.Get(ctx, "list")
+	r.NoError(err)
+	r.Equal(list, v.Body)
+	r.Equal(0, restored.Stats().CompressedKeys)
+	r.NoError(restored.Close(ctx))
+}
+
+func TestDumpEncryption(t *testing.T) {
+	r := require.New(t)
+	dump := filepath.Join(os.TempDir(), "rediq-encrypted.dump")
+	os.Remove(dump)
+	defer os.Remove(dump)
+	ctx := context.Background()
+	oldKey, err := ParseKey(strings.Repeat("ab", 32))
+	r.NoError(err)
+	newKey, err := ParseKey(strings.Repeat("cd", 16))
+	r.NoError(err)
+	_, err = ParseKey("short")
+	r.Equal(ErrBadKey, err)
+
+	c := NewCacheV2(DumpPath(dump), DumpEncryption(oldKey))
+	r.NoError(c.Run(ctx))
+	r.NoError(c.Set(ctx, "session", "secret-token", 0))
+	r.NoError(c.Close(ctx))
+	info, err := os.Stat(dump)
+	r.NoError(err)
+	r.Equal(os.FileMode(0600), info.Mode().Perm())
+	data, err := ioutil.ReadFile(dump)
+	r.NoError(err)
+	r.NotContains(string(data), "secret-token")
+
+	err = NewCacheV2(DumpPath(dump)).Run(ctx)
+	r.IsType(&DumpError{}, err)
+	r.Equal(ErrNoKey, err.(*DumpError).Err)
+	err = NewCacheV2(DumpPath(dump), DumpEncryption(newKey)).Run(ctx)
+	r.IsType(&DumpError{}, err)
+	r.Equal(ErrWrongKey, err.(*DumpError).Err)
+
+	// rotation: the dump is read with the old key and written with the new one
+	rotated := NewCacheV2(DumpPath(dump), DumpEncryption(newKey, oldKey))
+	r.NoError(rotated.Run(ctx))
+	r.NoError(rotated.Close(ctx))
+	restored := NewCacheV2(DumpPath(dump), DumpEncryption(newKey))
+	r.NoError(restored.Run(ctx))
+	v, err := restored.Get(ctx, "session")
+	r.NoError(err)
+	r.Equal("secret-token", v.Body)
+	r.NoError(restored.Close(ctx))
+
+	data, err = ioutil.ReadFile(dump)
+	r.NoError(err)
+	data[len(data)-1] ^= 1
+	r.NoError(ioutil.WriteFile(dump, data, 0600))
+	err = NewCacheV2(DumpPath(dump), DumpEncryption(newKey)).Run(ctx)
+	r.IsType(&DumpError{}, err)
+	r.Equal(ErrWrongKey, err.(*DumpError).Err)
+
+	// a plain dump is encrypted only if it is allowed explicitly
+	r.NoError(ioutil.WriteFile(dump, []byte(`{}`), 0600))
+	err = NewCacheV2(DumpPath(dump), DumpEncryption(newKey)).Run(ctx)
+	r.IsType(&DumpError{}, err)
+	r.Equal(ErrPlainDump, err.(*DumpError).Err)
+	plain := NewCacheV2(DumpPath(dump), DumpEncryption(newKey), EncryptPlainDump(true))
+	r.NoError(plain.Run(ctx))
+	r.NoError(plain.Close(ctx))
+}
+
+func TestExportImport(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	src := NewCacheV2(DumpPath(filepath.Join(os.TempDir(), "rediq-export.dump")))
+	r.NoError(src.Set(ctx, "a", int64(1), 0, "t"))
+	r.NoError(src.Select("other").Set(ctx, "b", map[string]interface{}{"x": "y"}, time.Hour))
+
+	var buf bytes.Buffer
+	r.NoError(Export(ctx, src, &buf))
+	// writes after the snapshot are not exported
+	r.NoError(src.Set(ctx, "c", "late", 0))
+
+	dst := NewCacheV2(DumpPath(filepath.Join(os.TempDir(), "rediq-import.dump")))
+	r.NoError(dst.Set(ctx, "keep", "me", 0))
+	n, err := Import(ctx, dst, bytes.NewReader(buf.Bytes()), ImportMerge)
+	r.NoError(err)
+	r.Equal(2, n)
+	v, err := dst.Get(ctx, "a")
+	r.NoError(err)
+	r.Equal(int64(1), v.Body)
+	r.Equal([]string{"t"}, v.Tags)
+	v, err = dst.Select("other").Get(ctx, "b")
+	r.NoError(err)
+	r.Equal(time.Hour, v.TTL)
+	_, err = dst.Get(ctx, "keep")
+	r.NoError(err)
+
+	_, err = Import(ctx, dst, bytes.NewReader(buf.Bytes()), ImportReplace)
+	r.NoError(err)
+	_, err = dst.Get(ctx, "keep")
+	r.Equal(ErrNotFound, err)
+
+	_, err = Import(ctx, dst, strings.NewReader(`{"key":"a","value":{"body":1}}{"key":`), ImportReplace)
+	r.IsType(&ImportError{}, err)
+	r.Equal(2, err.(*ImportError).Record)
+	r.Equal(1, dst.Len())
+
+	// a backup over quotas fails before anything is flushed
+	limited := NewCacheV2(
+		DumpPath(filepath.Join(os.TempDir(), "rediq-import-limited.dump")),
+		Namespace("other", MaxKeys(1)),
+	)
+	r.NoError(limited.Set(ctx, "keep", "me", 0))
+	over := `{"namespace":"other","key":"a","value":{"body":1}}
+{"namespace":"other","key":"a","value":{"body":2}}
+{"namespace":"other","key":"b","value":{"body":3}}
+`
+	_, err = Import(ctx, limited, strings.NewReader(over), ImportReplace)
+	r.IsType(&ErrQuotaExceeded{}, err)
+	r.Equal(QuotaKeys, err.(*ErrQuotaExceeded).Resource)
+	_, err = limited.Get(ctx, "keep")
+	r.NoError(err)
+	fits := `{"namespace":"other","key":"a","value":{"body":1}}
+{"namespace":"other","key":"a","value":{"body":2}}
+`
+	n, err = Import(ctx, limited, strings.NewReader(fits), ImportReplace)
+	r.NoError(err)
+	r.Equal(2, n)
+	_, err = limited.Get(ctx, "keep")
+	r.Equal(ErrNotFound, err)
+
+	// merge counts the keys in place and doesn't import partially
+	before, err := limited.Select("other").Get(ctx, "a")
+	r.NoError(err)
+	merged := `{"namespace":"other","key":"a","value":{"body":3}}
+{"namespace":"other","key":"b","value":{"body":4}}
+`
+	_, err = Import(ctx, limited, strings.NewReader(merged), ImportMerge)
+	r.IsType(&ErrQuotaExceeded{}, err)
+	after, err := limited.Select("other").Get(ctx, "a")
+	r.NoError(err)
+	r.Equal(before.Body, after.Body)
+	n, err = Import(ctx, limited, strings.NewReader(fits), ImportMerge)
+	r.NoError(err)
+	r.Equal(2, n)
+}
+
+func TestReconfigure(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	c := NewCacheV2(Namespaces(map[string]NamespaceConfig{"tenant": {MaxKeys: 1}}))
+	ns := c.Select("tenant")
+	r.NoError(ns.Set(ctx, "a", "1", 0))
+	r.IsType(&ErrQuotaExceeded{}, ns.Set(ctx, "b", "1", 0))
+
+	r.NoError(Reconfigure(c, map[string]NamespaceConfig{
+		"tenant": {MaxKeys: 2},
+		"new":    {DefaultTTL: time.Minute},
+	}))
+	r.NoError(ns.Set(ctx, "b", "1", 0))
+	r.Equal(uint(2), ns.Usage().MaxKeys)
+	r.NoError(c.Select("new").Set(ctx, "k", "v", 0))
+	v, err := c.Select("new").Get(ctx, "k")
+	r.NoError(err)
+	r.Equal(time.Minute, v.TTL)
+
+	r.NoError(Reconfigure(c, nil))
+	r.Equal(uint(0), ns.Usage().MaxKeys)
+	p, err := ParseEviction("random")
+	r.NoError(err)
+	r.Equal(EvictRandom, p)
+	_, err = ParseEviction("lru")
+	r.Equal(ErrEviction, err)
+}
+
+func TestTracing(t *testing.T) {
+	r := require.New(t)
+	dump := filepath.Join(os.TempDir(), "rediq-tracing.dump")
+	defer os.Remove(dump)
+	rec := trace.NewRecorder()
+	c := NewCacheV2(DumpPath(dump), Tracing(rec))
+	r.NoError(c.Run(context.Background()))
+	_, ok := rec.Find("storage.load_dump")
+	r.True(ok)
+	rec.Reset()
+
+	// commands are traced only within a request span
+	r.NoError(c.Set(context.Background(), "untraced", "v", 0))
+	r.Empty(rec.Spans())
+	ctx, root := trace.StartWith(context.Background(), rec, "request", trace.SpanContext{})
+	r.NoError(c.Select("ns").Set(ctx, "k", "v", 0))
+	_, err := c.Get(ctx, "missing")
+	r.Equal(ErrNotFound, err)
+	root.End()
+
+	set, ok := rec.Find("storage.set")
+	r.True(ok)
+	r.Equal(root.Context(), set.Parent)
+	r.Equal("ns", set.Attributes["rediq.namespace"])
+	r.Equal("k", set.Attributes["rediq.key"])
+	wait, ok := rec.Find("storage.lock_wait")
+	r.True(ok)
+	r.Equal(set.Context, wait.Parent)
+	get, ok := rec.Find("storage.get")
+	r.True(ok)
+	r.Nil(get.Err)
+	r.Equal(false, get.Attributes["rediq.hit"])
+
+	r.NoError(c.Close(context.Background()))
+	d, ok := rec.Find("storage.dump")
+	r.True(ok)
+	r.False(d.Parent.IsValid())
+	r.Equal(2, d.Attributes["rediq.namespaces"])
+	r.NotNil(d.Attributes["rediq.dump.bytes"])
+}
+
+func TestExpire(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	c := NewCacheV2(DumpPath(filepath.Join(os.TempDir(), "rediq-expire.dump")))
+	r.NoError(c.Run(ctx))
+	r.NoError(c.Set(ctx, "k", "v", time.Second, "t"))
+	r.NoError(c.Expire(ctx, "k", time.Hour))
+	r.NoError(c.Select("ns").Set(ctx, "short", "v", 0))
+	r.NoError(c.Select("ns").Expire(ctx, "short", time.Second))
+	r.Equal(ErrNotFound, c.Expire(ctx, "missing", time.Second))
+	r.Equal(ErrNegativeTTL, c.Expire(ctx, "k", -time.Second))
+
+	time.Sleep(2500 * time.Millisecond)
+	// ttl itself is decremented concurrently
+	v, err := c.Get(ctx, "k")
+	r.NoError(err)
+	r.Equal([]string{"t"}, v.Tags)
+	_, err = c.Select("ns").Get(ctx, "short")
+	r.Equal(ErrNotFound, err)
+	r.NoError(c.Remove(ctx, "k"))
+	r.NoError(c.Close(ctx))
+}
+
+func TestWatch(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	dump := filepath.Join(os.TempDir(), "rediq-watch.dump")
+	os.Remove(dump)
+	c := NewCacheV2(DumpPath(dump),
+		Namespace("small", MaxKeys(1), Eviction(EvictRandom)))
+	r.NoError(c.Run(ctx))
+	sub, err := c.Watch(16)
+	r.NoError(err)
+	r.NoError(c.Set(ctx, "k", "v", 0, "t"))
+	r.NoError(c.Expire(ctx, "k", time.Hour))
+	r.NoError(c.Set(ctx, "other", "v", 0))
+	r.NoError(c.Select("ns").Set(ctx, "k", "v", 0))
+	_, err = c.InvalidateTag(ctx, "t")
+	r.NoError(err)
+	r.NoError(c.Remove(ctx, "other"))
+	r.NoError(c.Remove(ctx, "other"))
+	r.NoError(c.Flush(ctx))
+	r.NoError(c.Set(ctx, "short", "v", time.Second))
+	want := []Change{
+		{DefaultNamespace, "k", ChangeSet},
+		{DefaultNamespace, "k", ChangeTTL},
+		{DefaultNamespace, "other", ChangeSet},
+		{DefaultNamespace, "k", ChangeRemove},
+		{DefaultNamespace, "other", ChangeRemove},
+		{DefaultNamespace, "", ChangeFlush},
+		{DefaultNamespace, "short", ChangeSet},
+		{DefaultNamespace, "short", ChangeExpired},
+	}
+	for _, change := range want {
+		select {
+		case got := <-sub.Changes():
+			r.Equal(change, got)
+		case <-time.After(3 * time.Second):
+			r.Fail("no change", change)
+		}
+	}
+
+	small, err := c.Select("small").Watch(16)
+	r.NoError(err)
+	r.NoError(c.Select("small").Set(ctx, "a", "v", 0))
+	r.NoError(c.Select("small").Set(ctx, "b", "v", 0))
+	r.Equal(Change{"small", "a", ChangeSet}, <-small.Changes())
+	r.Equal(Change{"small", "a", ChangeEvicted}, <-small.Changes())
+	r.Equal(Change{"small", "b", ChangeSet}, <-small.Changes())
+
+	slow, err := c.Watch(1)
+	r.NoError(err)
+	r.NoError(c.Set(ctx, "a", "v", 0))
+	r.NoError(c.Set(ctx, "b", "v", 0))
+	<-slow.Changes()
+	_, open := <-slow.Changes()
+	r.False(open)
+	slow.Close()
+	sub.Close()
+	for range sub.Changes() {
+	}
+
+	_, err = v2Keyspace{Downgrade(c)}.Watch(1)
+	r.Equal(ErrUnsupportedStorer, err)
+	r.NoError(c.Close(ctx))
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+)
+
+// Compressor packs values bigger than the compression threshold,
+// see Compression option.
+type Compressor interface {
+	Name() string
+	Compress([]byte) ([]byte, error)
+	Decompress([]byte) ([]byte, error)
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+// Gzip compresses values with gzip of the level, e.g. gzip.BestSpeed.
+func Gzip(level int) Compressor {
+	return &gzipCompressor{level: level}
+}
+
+func (g *gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (g *gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, g.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (g *gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (n *namespace) pack(v *Value) error {
+	return n.shOpt.pack(v)
+}
+
+// pack compresses body of v if it is a string, bytes, list or map
+// not smaller than threshold and compression saves space.
+func (o *cacheOptions) pack(v *Value) error {
+	cmp := o.Compressor
+	if cmp == nil {
+		return nil
+	}
+	var raw []byte
+	switch v.DataType {
+	case STR:
+		s, ok := v.Body.(string)
+		if !ok {
+			return nil
+		}
+		raw = []byte(s)
+	case BYTES:
+		raw = v.Body.([]byte)
+	case ARRAY, MAPPING:
+		var err error
+		if raw, err = json.Marshal(v.Body); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	if len(raw) < o.CompressAbove {
+		return nil
+	}
+	packed, err := cmp.Compress(raw)
+	if err != nil {
+		return err
+	}
+	if len(packed) >= len(raw) {
+		return nil
+	}
+	v.Body = nil
+	v.packed = packed
+	v.compressor = cmp
+	v.rawSize = int64(len(raw))
+	v.size = int64(len(packed))
+	return nil
+}
+
+// unpack returns a copy of v with decompressed body and the ttl left,
+// so that callers don't race with expiration.
+func (v *Value) unpack() (*Value, error) {
+	if v.packed == nil {
+		return v.withTTL(v.ttl()), nil
+	}
+	raw, err := v.compressor.Decompress(v.packed)
+	if err != nil {
+		return nil, err
+	}
+	var body interface{}
+	switch v.DataType {
+	case STR:
+		body = string(raw)
+	case BYTES:
+		body = raw
+	default:
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		if err := dec.Decode(&body); err != nil {
+			return nil, err
+		}
+		body = normalizeJSON(body)
+	}
+	return &Value{
+		Body:        body,
+		TTL:         v.ttl(),
+		DataType:    v.DataType,
+		Tags:        v.Tags,
+		ContentType: v.ContentType,
+		size:        v.size,
+	}, nil
+}
+
+// MarshalJSON writes compressed values decompressed, so dumps and
+// responses don't depend on compression.
+func (v *Value) MarshalJSON() ([]byte, error) {
+	type plain Value
+	u, err := v.unpack()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal((*plain)(u))
+}
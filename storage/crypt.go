@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+)
+
+var ErrBadKey = errors.New("dump key must be 16, 24 or 32 bytes in hex or base64")
+var ErrNoKey = errors.New("dump is encrypted, but no key is given")
+var ErrWrongKey = errors.New("dump is encrypted with another key or corrupted")
+var ErrPlainDump = errors.New("dump is not encrypted, but a key is given")
+
+// dumpMagic starts encrypted dumps. The header is the magic, the key id
+// and the nonce, it is authenticated as additional data of AES-GCM.
+var dumpMagic = []byte("REDIQENC1")
+
+const keyIDSize = 8
+
+// ParseKey decodes an AES key given in hex or base64, e.g. from a file
+// or an environment variable.
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		if key, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, ErrBadKey
+		}
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, ErrBadKey
+}
+
+func keyID(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:keyIDSize]
+}
+
+// encryptDump seals data with the first key of the cache.
+func (c *cache) encryptDump(data []byte) ([]byte, error) {
+	if len(c.opt.DumpKeys) == 0 {
+		return data, nil
+	}
+	key := c.opt.DumpKeys[0]
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, len(dumpMagic)+keyIDSize+gcm.NonceSize())
+	header = append(header, dumpMagic...)
+	header = append(header, keyID(key)...)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+	return gcm.Seal(header, nonce, data, header), nil
+}
+
+// decryptDump opens data with the key it was sealed with. Plain dumps
+// are returned as is without keys or with EncryptPlainDump, so that
+// a plain file put in place of an encrypted dump is not loaded.
+func (c *cache) decryptDump(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, dumpMagic) {
+		if len(c.opt.DumpKeys) > 0 && !c.opt.EncryptPlain {
+			return nil, ErrPlainDump
+		}
+		return data, nil
+	}
+	if len(c.opt.DumpKeys) == 0 {
+		return nil, ErrNoKey
+	}
+	id := data[len(dumpMagic):]
+	if len(id) < keyIDSize {
+		return nil, ErrWrongKey
+	}
+	for _, key := range c.opt.DumpKeys {
+		if !bytes.Equal(id[:keyIDSize], keyID(key)) {
+			continue
+		}
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		headerLen := len(dumpMagic) + keyIDSize + gcm.NonceSize()
+		if len(data) < headerLen {
+			return nil, ErrWrongKey
+		}
+		header := data[:headerLen]
+		nonce := header[len(dumpMagic)+keyIDSize:]
+		plain, err := gcm.Open(nil, nonce, data[headerLen:], header)
+		if err != nil {
+			return nil, ErrWrongKey
+		}
+		return plain, nil
+	}
+	return nil, ErrWrongKey
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrBadKey
+	}
+	return cipher.NewGCM(block)
+}
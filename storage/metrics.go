@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// counters are shared by all namespaces of the cache.
+type counters struct {
+	hits    int64
+	misses  int64
+	sets    int64
+	removes int64
+	expired int64
+	evicted int64
+}
+
+func (c *counters) hit(err error) {
+	if err == ErrNotFound {
+		atomic.AddInt64(&c.misses, 1)
+	} else if err == nil {
+		atomic.AddInt64(&c.hits, 1)
+	}
+}
+
+// Metrics is a snapshot of cache counters since start.
+type Metrics struct {
+	Hits         int64
+	Misses       int64
+	Sets         int64
+	Removes      int64
+	Expired      int64
+	Evicted      int64
+	GCBacklog    int
+	DumpDuration time.Duration
+	Namespaces   map[string]Usage
+	ShardKeys    map[string]map[string]int
+}
+
+func (c *cache) Metrics() Metrics {
+	m := Metrics{
+		Hits:         atomic.LoadInt64(&c.counters.hits),
+		Misses:       atomic.LoadInt64(&c.counters.misses),
+		Sets:         atomic.LoadInt64(&c.counters.sets),
+		Removes:      atomic.LoadInt64(&c.counters.removes),
+		Expired:      atomic.LoadInt64(&c.counters.expired),
+		Evicted:      atomic.LoadInt64(&c.counters.evicted),
+		GCBacklog:    len(c.gcChan),
+		DumpDuration: time.Duration(atomic.LoadInt64(&c.dumpDuration)),
+		Namespaces:   make(map[string]Usage),
+		ShardKeys:    make(map[string]map[string]int),
+	}
+	for _, ns := range c.namespaceList() {
+		m.Namespaces[ns.name] = ns.Usage()
+		m.ShardKeys[ns.name] = ns.shardKeys()
+	}
+	return m
+}
+
+func (n *namespace) shardKeys() map[string]int {
+	keys := make(map[string]int)
+	for shardKey, sh := range n.snapshot() {
+		sh.shMux.RLock()
+		keys[shardKey] = len(sh.items)
+		sh.shMux.RUnlock()
+	}
+	return keys
+}
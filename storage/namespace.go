@@ -0,0 +1,628 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"github.com/gobwas/glob"
+	log "github.com/sirupsen/logrus"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultNamespace = "default"
+
+// namespace is an isolated keyspace. Every namespace has its own shards,
+// tag index and options, while expiration is shared with the owning cache.
+type namespace struct {
+	count    int64
+	bytes    int64
+	requests int64
+	rejected int64
+
+	name   string
+	mx     sync.Mutex
+	shards map[string]*shard
+	tags   *tagIndex
+	rate   *rateLimiter
+	// watchers are notified under tags.mx or the shard lock of the key,
+	// so changes of a key come in order
+	watchers *watchers
+
+	gcChan   chan<- itemOnDelete
+	stopGC   <-chan struct{}
+	counters *counters
+	opt      atomic.Value // *namespaceOptions, replaced by Reconfigure
+	shOpt    *cacheOptions
+}
+
+func newNamespace(name string, c *cache) *namespace {
+	nsOpt, ok := c.opt.Namespaces[name]
+	if !ok {
+		nsOpt = &namespaceOptions{}
+	}
+	n := &namespace{
+		name:     name,
+		mx:       sync.Mutex{},
+		shards:   make(map[string]*shard, c.opt.BucketsNum),
+		tags:     newTagIndex(),
+		rate:     &rateLimiter{},
+		watchers: c.takeWatchers(name),
+		gcChan:   c.gcChan,
+		stopGC:   c.stopGC,
+		counters: c.counters,
+		shOpt:    c.opt,
+	}
+	n.opt.Store(nsOpt)
+	return n
+}
+
+func (n *namespace) options() *namespaceOptions {
+	return n.opt.Load().(*namespaceOptions)
+}
+
+func (n *namespace) Name() string {
+	return n.name
+}
+
+func (n *namespace) Len() int {
+	return int(atomic.LoadInt64(&n.count))
+}
+
+func (n *namespace) Usage() Usage {
+	opt := n.options()
+	return Usage{
+		Keys:     atomic.LoadInt64(&n.count),
+		Bytes:    atomic.LoadInt64(&n.bytes),
+		Requests: atomic.LoadInt64(&n.requests),
+		Rejected: atomic.LoadInt64(&n.rejected),
+		MaxKeys:  opt.MaxKeys,
+		MaxBytes: opt.MaxBytes,
+		MaxRate:  opt.MaxRate,
+	}
+}
+
+// acquire accounts a request against the namespace rate quota.
+func (n *namespace) acquire() error {
+	if limit := n.options().MaxRate; !n.rate.allow(limit) {
+		return n.reject(QuotaRequests, limit)
+	}
+	atomic.AddInt64(&n.requests, 1)
+	return nil
+}
+
+func (n *namespace) reject(res QuotaResource, limit uint) error {
+	atomic.AddInt64(&n.rejected, 1)
+	return &ErrQuotaExceeded{Namespace: n.name, Resource: res, Limit: limit}
+}
+
+func (n *namespace) Get(ctx context.Context, key string) (v *Value, err error) {
+	_, span := n.startSpan(ctx, "get", key)
+	defer func() { endSpan(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := n.acquire(); err != nil {
+		return nil, err
+	}
+	v, err = n.get(key)
+	n.counters.hit(err)
+	if err != nil {
+		return nil, err
+	}
+	return v.unpack()
+}
+
+func (n *namespace) GetBy(ctx context.Context, key string, subSeq interface{}) (_ interface{}, err error) {
+	_, span := n.startSpan(ctx, "getby", key)
+	defer func() { endSpan(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := n.acquire(); err != nil {
+		return nil, err
+	}
+	item, err := n.get(key)
+	n.counters.hit(err)
+	if err != nil {
+		return nil, err
+	}
+	if item, err = item.unpack(); err != nil {
+		return nil, err
+	}
+	var body reflect.Value
+	switch reflect.TypeOf(item.Body).Kind() {
+	case reflect.Slice:
+		body = reflect.ValueOf(item.Body)
+	case reflect.Map:
+		body = reflect.ValueOf(item.Body)
+	default:
+		return nil, ErrNotSequence
+	}
+	ss := reflect.ValueOf(subSeq)
+	switch ss.Kind() {
+	case reflect.Uint, reflect.Int:
+		if body.Kind() != reflect.Slice {
+			return nil, ErrSubSeqType
+		}
+		var i int
+		if ss.Kind() == reflect.Int {
+			i = int(ss.Int())
+		} else {
+			i = int(ss.Uint())
+		}
+		if i < 0 || i >= body.Len() {
+			return nil, &IndexError{Key: key, Index: subSeq}
+		}
+		return body.Index(i).Interface(), nil
+	case reflect.String:
+		if body.Kind() != reflect.Map {
+			return nil, ErrSubSeqType
+		}
+		v := body.MapIndex(ss)
+		if !v.IsValid() {
+			return nil, &IndexError{Key: key, Index: subSeq}
+		}
+		return v.Interface(), nil
+	default:
+		return nil, ErrSubSeqType
+	}
+}
+
+func (n *namespace) get(key string) (*Value, error) {
+	shard, _, err := n.getOrCreateShard(key)
+	if err != nil {
+		return nil, err
+	}
+	shard.shMux.RLock()
+	defer shard.shMux.RUnlock()
+	item, ok := shard.items[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return item, nil
+}
+
+func (n *namespace) Set(ctx context.Context, key string, data interface{}, ttl time.Duration, tags ...string) error {
+	return n.store(ctx, key, data, "", ttl, tags)
+}
+
+// SetBytes stores data as BYTES value which keeps its content type.
+func (n *namespace) SetBytes(ctx context.Context, key string, data []byte, contentType string, ttl time.Duration, tags ...string) error {
+	return n.store(ctx, key, data, contentType, ttl, tags)
+}
+
+func (n *namespace) store(ctx context.Context, key string, data interface{}, contentType string, ttl time.Duration, tags []string) (err error) {
+	ctx, span := n.startSpan(ctx, "set", key)
+	defer func() { endSpan(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := n.acquire(); err != nil {
+		return err
+	}
+	if ttl == 0 {
+		ttl = n.options().DefaultTTL
+	}
+	v, err := newValue(data, ttl)
+	if err != nil {
+		return err
+	}
+	v.Tags = tags
+	v.ContentType = contentType
+	if err := n.pack(v); err != nil {
+		return err
+	}
+	return n.put(ctx, key, v)
+}
+
+// put stores prepared value v, checking quotas and scheduling expiration.
+// Only values with tags, either new or old, and namespaces with size
+// quotas serialize writes, others share the tag index lock.
+func (n *namespace) put(ctx context.Context, key string, v *Value) error {
+	if len(v.Tags) == 0 && !n.options().sized() && n.putUntagged(ctx, key, v) {
+		return nil
+	}
+	n.lock(ctx)
+	if err := n.reserve(key, v); err != nil {
+		n.tags.mx.Unlock()
+		return err
+	}
+	shard, _, err := n.getOrCreateShard(key)
+	if err != nil {
+		n.tags.mx.Unlock()
+		return err
+	}
+	if old := n.set(shard, key, v); old != nil {
+		n.tags.untag(key, old.Tags)
+		atomic.AddInt64(&n.bytes, -old.size)
+	} else {
+		atomic.AddInt64(&n.count, 1)
+	}
+	atomic.AddInt64(&n.bytes, v.size)
+	n.tags.tag(key, v.Tags)
+	n.publish(key, ChangeSet)
+	n.tags.mx.Unlock()
+	atomic.AddInt64(&n.counters.sets, 1)
+	n.schedule(key, v)
+	return nil
+}
+
+// putUntagged stores v under the shared lock unless the old value has
+// tags to drop from the index, it reports whether v is stored.
+func (n *namespace) putUntagged(ctx context.Context, key string, v *Value) bool {
+	n.rlock(ctx)
+	defer n.tags.mx.RUnlock()
+	shard, _, err := n.getOrCreateShard(key)
+	if err != nil {
+		return false
+	}
+	shard.shMux.Lock()
+	old := shard.items[key]
+	if old != nil && len(old.Tags) > 0 {
+		shard.shMux.Unlock()
+		return false
+	}
+	shard.items[key] = v
+	if old != nil {
+		atomic.AddInt64(&n.bytes, -old.size)
+	} else {
+		atomic.AddInt64(&n.count, 1)
+	}
+	atomic.AddInt64(&n.bytes, v.size)
+	n.publish(key, ChangeSet)
+	shard.shMux.Unlock()
+	log.Debugln("set key:", key, "in namespace:", n.name, "bytes:", v.size)
+	atomic.AddInt64(&n.counters.sets, 1)
+	n.schedule(key, v)
+	return true
+}
+
+// schedule passes the value to expiration, values set after
+// the cache is closed never expire.
+func (n *namespace) schedule(key string, v *Value) {
+	select {
+	case n.gcChan <- itemOnDelete{ns: n, key: key, val: v}:
+	case <-n.stopGC:
+	}
+}
+
+func (n *namespace) set(b *shard, key string, v *Value) *Value {
+	b.shMux.Lock()
+	defer b.shMux.Unlock()
+	old := b.items[key]
+	b.items[key] = v
+	log.Debugln("set key:", key, "in namespace:", n.name, "bytes:", v.size)
+	return old
+}
+
+// reserve checks namespace quotas for v and makes room for a new key
+// according to the eviction policy. It expects tags.mx to be held
+// by the caller, as every write does.
+func (n *namespace) reserve(key string, v *Value) error {
+	old, _ := n.get(key)
+	var oldSize int64
+	if old != nil {
+		oldSize = old.size
+	}
+	bytes := atomic.LoadInt64(&n.bytes) - oldSize + v.size
+	opt := n.options()
+	if opt.MaxBytes > 0 && bytes > int64(opt.MaxBytes) {
+		return n.reject(QuotaBytes, opt.MaxBytes)
+	}
+	if old != nil || opt.MaxKeys == 0 || uint(n.Len()) < opt.MaxKeys {
+		return nil
+	}
+	switch opt.Eviction {
+	case EvictRandom:
+		return n.evict()
+	default:
+		return n.reject(QuotaKeys, opt.MaxKeys)
+	}
+}
+
+func (n *namespace) evict() error {
+	n.mx.Lock()
+	var victim string
+	for _, sh := range n.shards {
+		sh.shMux.RLock()
+		for k := range sh.items {
+			victim = k
+			break
+		}
+		sh.shMux.RUnlock()
+		if victim != "" {
+			break
+		}
+	}
+	n.mx.Unlock()
+	if victim == "" {
+		return n.reject(QuotaKeys, n.options().MaxKeys)
+	}
+	v, err := n.remove(victim, nil)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		n.tags.untag(victim, v.Tags)
+		atomic.AddInt64(&n.counters.evicted, 1)
+		n.publish(victim, ChangeEvicted)
+		log.Debugln("evicted:", victim, "from namespace:", n.name)
+	}
+	return nil
+}
+
+func (n *namespace) Remove(ctx context.Context, key string) (err error) {
+	ctx, span := n.startSpan(ctx, "remove", key)
+	defer func() { endSpan(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := n.acquire(); err != nil {
+		return err
+	}
+	n.lock(ctx)
+	defer n.tags.mx.Unlock()
+	v, err := n.remove(key, nil)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		n.tags.untag(key, v.Tags)
+		atomic.AddInt64(&n.counters.removes, 1)
+		n.publish(key, ChangeRemove)
+	}
+	return nil
+}
+
+// Expire sets a new ttl of key, zero ttl makes the key persistent.
+// The value is replaced by a copy, so the expiration scheduled for the
+// old ttl leaves it alone.
+func (n *namespace) Expire(ctx context.Context, key string, ttl time.Duration) (err error) {
+	ctx, span := n.startSpan(ctx, "expire", key)
+	defer func() { endSpan(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ttl < 0 {
+		return ErrNegativeTTL
+	}
+	if err := n.acquire(); err != nil {
+		return err
+	}
+	n.lock(ctx)
+	defer n.tags.mx.Unlock()
+	shard, _, err := n.getOrCreateShard(key)
+	if err != nil {
+		return err
+	}
+	shard.shMux.Lock()
+	v, ok := shard.items[key]
+	if !ok {
+		shard.shMux.Unlock()
+		return ErrNotFound
+	}
+	updated := v.withTTL(ttl)
+	shard.items[key] = updated
+	shard.shMux.Unlock()
+	n.publish(key, ChangeTTL)
+	n.schedule(key, updated)
+	return nil
+}
+
+// expire removes key only if it still holds v, so that an overwritten
+// or flushed value can't take its successor down with it.
+func (n *namespace) expire(key string, v *Value) {
+	n.tags.mx.Lock()
+	defer n.tags.mx.Unlock()
+	removed, err := n.remove(key, v)
+	if err != nil {
+		log.Warningln("fail to expire key:", key, err)
+		return
+	}
+	if removed != nil {
+		n.tags.untag(key, removed.Tags)
+		atomic.AddInt64(&n.counters.expired, 1)
+		n.publish(key, ChangeExpired)
+	}
+}
+
+func (n *namespace) remove(key string, only *Value) (*Value, error) {
+	shard, shardKey, err := n.getOrCreateShard(key)
+	if err != nil {
+		return nil, err
+	}
+	shard.shMux.Lock()
+
+	v, ok := shard.items[key]
+	if ok && (only == nil || only == v) {
+		delete(shard.items, key)
+		atomic.AddInt64(&n.count, -1)
+		atomic.AddInt64(&n.bytes, -v.size)
+		log.Debugln("deleted:", key)
+	} else {
+		v = nil
+	}
+	empty := len(shard.items) == 0
+	shard.shMux.Unlock()
+	if empty {
+		n.mx.Lock()
+		delete(n.shards, shardKey)
+		n.mx.Unlock()
+	}
+	return v, nil
+}
+
+// InvalidateTag removes every key tagged with tag and returns removed keys.
+// The tag index stays locked for the whole operation, so no key can be
+// tagged or untagged in between.
+func (n *namespace) InvalidateTag(ctx context.Context, tag string) (_ []string, err error) {
+	ctx, span := n.startSpan(ctx, "tag", "")
+	defer func() { endSpan(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := n.acquire(); err != nil {
+		return nil, err
+	}
+	n.lock(ctx)
+	defer n.tags.mx.Unlock()
+	keys := n.tags.tagged(tag)
+	for _, key := range keys {
+		v, err := n.remove(key, nil)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			n.tags.untag(key, v.Tags)
+			atomic.AddInt64(&n.counters.removes, 1)
+			n.publish(key, ChangeRemove)
+		}
+	}
+	log.Debugln("invalidated tag:", tag, "keys:", len(keys))
+	return keys, nil
+}
+
+// Keys returns keys matching glob mask, it stops scanning shards
+// once ctx is done.
+// https://github.com/gobwas/glob/blob/master/readme.md
+func (n *namespace) Keys(ctx context.Context, mask string) (_ []string, err error) {
+	_, span := n.startSpan(ctx, "keys", "")
+	defer func() { endSpan(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	g, err := glob.Compile(mask)
+	if err != nil {
+		return nil, &PatternError{Pattern: mask, Err: err}
+	}
+	matchings := make([]string, 0)
+	var wg sync.WaitGroup
+	mx := new(sync.Mutex)
+
+	for _, sh := range n.snapshot() {
+		wg.Add(1)
+		go func(sh *shard) {
+			defer wg.Done()
+			if ctx.Err() != nil {
+				return
+			}
+			sh.shMux.RLock()
+			defer sh.shMux.RUnlock()
+			for k := range sh.items {
+				if g.Match(k) {
+					mx.Lock()
+					matchings = append(matchings, k)
+					mx.Unlock()
+				}
+			}
+		}(sh)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	log.Debugln("keys found:", len(matchings))
+	return matchings, nil
+}
+
+// Flush drops every key of the namespace, like Redis FLUSHDB.
+func (n *namespace) Flush(ctx context.Context) (err error) {
+	ctx, span := n.startSpan(ctx, "flush", "")
+	defer func() { endSpan(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	n.lock(ctx)
+	defer n.tags.mx.Unlock()
+	n.mx.Lock()
+	n.shards = make(map[string]*shard, n.shOpt.BucketsNum)
+	n.mx.Unlock()
+	n.tags.keys = make(map[string]map[string]struct{})
+	atomic.StoreInt64(&n.count, 0)
+	atomic.StoreInt64(&n.bytes, 0)
+	n.publish("", ChangeFlush)
+	log.Debugln("flushed namespace:", n.name)
+	return nil
+}
+
+// Watch subscribes to changes of keys with room for buffer changes.
+func (n *namespace) Watch(buffer int) (*Subscription, error) {
+	return n.watchers.subscribe(buffer), nil
+}
+
+func (n *namespace) publish(key string, op ChangeOp) {
+	n.watchers.publish(Change{Namespace: n.name, Key: key, Op: op})
+}
+
+func (n *namespace) snapshot() map[string]*shard {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	shards := make(map[string]*shard, len(n.shards))
+	for k, sh := range n.shards {
+		shards[k] = sh
+	}
+	return shards
+}
+
+type dumpedNamespace struct {
+	Shards map[string]*shard `json:"shards"`
+	Usage  Usage             `json:"usage"`
+}
+
+func (n *namespace) dump() *dumpedNamespace {
+	return &dumpedNamespace{
+		Shards: n.snapshot(),
+		Usage:  n.Usage(),
+	}
+}
+
+// load puts dumped shards into the namespace and schedules their expiration.
+// Keys and bytes are counted again, while request counters are restored.
+func (n *namespace) load(d *dumpedNamespace) {
+	n.tags.mx.Lock()
+	defer n.tags.mx.Unlock()
+	n.mx.Lock()
+	n.shards = d.Shards
+	n.mx.Unlock()
+	atomic.StoreInt64(&n.requests, d.Usage.Requests)
+	atomic.StoreInt64(&n.rejected, d.Usage.Rejected)
+	for _, sh := range d.Shards {
+		for k, v := range sh.items {
+			v.size = sizeOf(v.Body)
+			if err := n.pack(v); err != nil {
+				log.Warningln("fail to compress key:", k, err)
+			}
+			n.tags.tag(k, v.Tags)
+			atomic.AddInt64(&n.count, 1)
+			atomic.AddInt64(&n.bytes, v.size)
+			n.schedule(k, v)
+		}
+	}
+}
+
+func (n *namespace) getOrCreateShard(key string) (*shard, string, error) {
+	hasher := sha1.New()
+	_, err := hasher.Write([]byte(key))
+	if err != nil {
+		return nil, "", err
+	}
+	shardKey := fmt.Sprintf("%x", hasher.Sum(nil))[0:2]
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	sh, ok := n.shards[shardKey]
+	if !ok {
+		sh = n.newShard()
+		n.shards[shardKey] = sh
+	}
+	return sh, shardKey, nil
+}
+
+func (n *namespace) newShard() *shard {
+	return &shard{
+		shMux: sync.RWMutex{},
+		items: make(map[string]*Value, n.shOpt.ItemsNum),
+	}
+}
@@ -1,5 +1,11 @@
 package storage
 
+import (
+	"errors"
+	"github.com/Phil192/rediq/trace"
+	"time"
+)
+
 type cacheOpt func(o *cacheOptions)
 
 type cacheOptions struct {
@@ -7,6 +13,15 @@ type cacheOptions struct {
 	BucketsNum uint
 	DumpPath   string
 	GCCap      int
+	Namespaces map[string]*namespaceOptions
+
+	Compressor    Compressor
+	CompressAbove int
+
+	DumpKeys     [][]byte
+	EncryptPlain bool
+
+	Tracer trace.Tracer
 }
 
 func ShardsNum(i uint) cacheOpt {
@@ -32,3 +47,172 @@ func GCCap(i int) cacheOpt {
 		o.GCCap = i
 	}
 }
+
+// Compression packs string, bytes, list and map values of at least
+// threshold bytes with c. Values are decompressed on every read.
+func Compression(c Compressor, threshold int) cacheOpt {
+	return func(o *cacheOptions) {
+		o.Compressor = c
+		o.CompressAbove = threshold
+	}
+}
+
+// DumpEncryption encrypts the dump with AES-GCM and key. Dumps written
+// with old keys are still read, and the next dump is written with key,
+// so keys are rotated by moving the current key to old.
+func DumpEncryption(key []byte, old ...[]byte) cacheOpt {
+	return func(o *cacheOptions) {
+		if key == nil {
+			return
+		}
+		o.DumpKeys = append([][]byte{key}, old...)
+	}
+}
+
+// EncryptPlainDump lets a cache with DumpEncryption load a plain dump,
+// which is encrypted by the next dump. It is meant for turning
+// encryption on and should be dropped afterwards.
+func EncryptPlainDump(allowed bool) cacheOpt {
+	return func(o *cacheOptions) {
+		o.EncryptPlain = allowed
+	}
+}
+
+// Tracing traces dumps with t. Commands are traced as children of
+// the span in their context.
+func Tracing(t trace.Tracer) cacheOpt {
+	return func(o *cacheOptions) {
+		o.Tracer = t
+	}
+}
+
+func Namespace(name string, opts ...namespaceOpt) cacheOpt {
+	return func(o *cacheOptions) {
+		nsOpt := &namespaceOptions{}
+		for _, opt := range opts {
+			if opt != nil {
+				opt(nsOpt)
+			}
+		}
+		o.Namespaces[name] = nsOpt
+	}
+}
+
+type EvictionPolicy int
+
+const (
+	NoEviction EvictionPolicy = iota
+	EvictRandom
+)
+
+var ErrEviction = errors.New("eviction must be noeviction or random")
+
+var evictionNames = map[EvictionPolicy]string{
+	NoEviction:  "noeviction",
+	EvictRandom: "random",
+}
+
+func (p EvictionPolicy) String() string {
+	return evictionNames[p]
+}
+
+func ParseEviction(s string) (EvictionPolicy, error) {
+	if s == "" {
+		return NoEviction, nil
+	}
+	for p, name := range evictionNames {
+		if name == s {
+			return p, nil
+		}
+	}
+	return NoEviction, ErrEviction
+}
+
+func (p EvictionPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *EvictionPolicy) UnmarshalText(text []byte) error {
+	v, err := ParseEviction(string(text))
+	if err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
+
+type namespaceOpt func(o *namespaceOptions)
+
+type namespaceOptions struct {
+	DefaultTTL time.Duration
+	MaxKeys    uint
+	MaxBytes   uint
+	MaxRate    uint
+	Eviction   EvictionPolicy
+}
+
+// sized reports whether keys or bytes are limited, checking these
+// quotas needs writes to be serialized.
+func (o *namespaceOptions) sized() bool {
+	return o.MaxKeys > 0 || o.MaxBytes > 0
+}
+
+func DefaultTTL(ttl time.Duration) namespaceOpt {
+	return func(o *namespaceOptions) {
+		o.DefaultTTL = ttl
+	}
+}
+
+func MaxKeys(i uint) namespaceOpt {
+	return func(o *namespaceOptions) {
+		o.MaxKeys = i
+	}
+}
+
+func MaxBytes(i uint) namespaceOpt {
+	return func(o *namespaceOptions) {
+		o.MaxBytes = i
+	}
+}
+
+// MaxRate limits requests per second to the namespace.
+func MaxRate(i uint) namespaceOpt {
+	return func(o *namespaceOptions) {
+		o.MaxRate = i
+	}
+}
+
+func Eviction(p EvictionPolicy) namespaceOpt {
+	return func(o *namespaceOptions) {
+		o.Eviction = p
+	}
+}
+
+// NamespaceConfig holds options of a namespace as data, e.g. read from
+// a config file.
+type NamespaceConfig struct {
+	DefaultTTL time.Duration  `json:"default_ttl" yaml:"default_ttl"`
+	MaxKeys    uint           `json:"max_keys" yaml:"max_keys"`
+	MaxBytes   uint           `json:"max_bytes" yaml:"max_bytes"`
+	MaxRate    uint           `json:"max_rate" yaml:"max_rate"`
+	Eviction   EvictionPolicy `json:"eviction" yaml:"eviction"`
+}
+
+func (nc NamespaceConfig) options() *namespaceOptions {
+	return &namespaceOptions{
+		DefaultTTL: nc.DefaultTTL,
+		MaxKeys:    nc.MaxKeys,
+		MaxBytes:   nc.MaxBytes,
+		MaxRate:    nc.MaxRate,
+		Eviction:   nc.Eviction,
+	}
+}
+
+// Namespaces configures namespaces like Namespace does.
+func Namespaces(cfg map[string]NamespaceConfig) cacheOpt {
+	return func(o *cacheOptions) {
+		for name, nc := range cfg {
+			o.Namespaces[name] = nc.options()
+		}
+	}
+}
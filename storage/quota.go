@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type QuotaResource string
+
+const (
+	QuotaKeys     QuotaResource = "keys"
+	QuotaBytes    QuotaResource = "bytes"
+	QuotaRequests QuotaResource = "requests"
+)
+
+type ErrQuotaExceeded struct {
+	Namespace string
+	Resource  QuotaResource
+	Limit     uint
+}
+
+func (e *ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("namespace %s exceeded %s quota of %d", e.Namespace, e.Resource, e.Limit)
+}
+
+// Usage reports resources consumed by a namespace along with its limits,
+// zero limit means unlimited.
+type Usage struct {
+	Keys     int64 `json:"keys"`
+	Bytes    int64 `json:"bytes"`
+	Requests int64 `json:"requests"`
+	Rejected int64 `json:"rejected"`
+	MaxKeys  uint  `json:"max_keys,omitempty"`
+	MaxBytes uint  `json:"max_bytes,omitempty"`
+	MaxRate  uint  `json:"max_rate,omitempty"`
+}
+
+// rateLimiter counts requests in a fixed one second window.
+type rateLimiter struct {
+	mx     sync.Mutex
+	window int64
+	count  uint
+}
+
+func (r *rateLimiter) allow(limit uint) bool {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	now := time.Now().Unix()
+	if now != r.window {
+		r.window = now
+		r.count = 0
+	}
+	if limit > 0 && r.count >= limit {
+		return false
+	}
+	r.count++
+	return true
+}
+
+// sizeOf approximates memory taken by the value body with its json length.
+func sizeOf(data interface{}) int64 {
+	switch d := data.(type) {
+	case string:
+		return int64(len(d))
+	case []byte:
+		return int64(len(d))
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return 0
+	}
+	return int64(len(b))
+}
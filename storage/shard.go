@@ -13,6 +13,8 @@ type shard struct {
 }
 
 func (s *shard) MarshalJSON() ([]byte, error) {
+	s.shMux.RLock()
+	defer s.shMux.RUnlock()
 	buffer := bytes.NewBufferString("{")
 	length := len(s.items)
 	count := 0
@@ -0,0 +1,75 @@
+package storage
+
+import "time"
+
+// Stats describes the current state of the cache, like Redis INFO.
+// Bytes is an estimate of stored values size, not the process memory.
+// CompressionRatio is the raw size of compressed values divided by
+// their compressed size, zero when nothing is compressed.
+type Stats struct {
+	Started     time.Time                 `json:"started"`
+	Uptime      time.Duration             `json:"uptime"`
+	Namespaces  int                       `json:"namespaces"`
+	Shards      int                       `json:"shards"`
+	Keys        int                       `json:"keys"`
+	KeysByType  map[string]int            `json:"keys_by_type"`
+	KeysWithTTL int                       `json:"keys_with_ttl"`
+	Bytes       int64                     `json:"bytes"`
+	ShardKeys   map[string]map[string]int `json:"shard_keys"`
+	LastDump    time.Time                 `json:"last_dump"`
+	LastDumpErr string                    `json:"last_dump_error,omitempty"`
+
+	Compression       string  `json:"compression,omitempty"`
+	CompressedKeys    int     `json:"compressed_keys"`
+	CompressedBytes   int64   `json:"compressed_bytes"`
+	UncompressedBytes int64   `json:"uncompressed_bytes"`
+	CompressionRatio  float64 `json:"compression_ratio"`
+}
+
+func (c *cache) Stats() Stats {
+	s := Stats{
+		Started:    c.started,
+		Uptime:     time.Since(c.started),
+		KeysByType: make(map[string]int, len(typeNames)),
+		ShardKeys:  make(map[string]map[string]int),
+	}
+	for _, name := range typeNames {
+		s.KeysByType[name] = 0
+	}
+	for _, ns := range c.namespaceList() {
+		s.Namespaces++
+		s.Bytes += ns.Usage().Bytes
+		s.ShardKeys[ns.name] = make(map[string]int)
+		for shardKey, sh := range ns.snapshot() {
+			s.Shards++
+			sh.shMux.RLock()
+			s.ShardKeys[ns.name][shardKey] = len(sh.items)
+			for _, v := range sh.items {
+				s.Keys++
+				s.KeysByType[v.DataType.String()]++
+				if v.ttl() > 0 {
+					s.KeysWithTTL++
+				}
+				if v.packed != nil {
+					s.CompressedKeys++
+					s.CompressedBytes += v.size
+					s.UncompressedBytes += v.rawSize
+				}
+			}
+			sh.shMux.RUnlock()
+		}
+	}
+	if c.opt.Compressor != nil {
+		s.Compression = c.opt.Compressor.Name()
+	}
+	if s.CompressedBytes > 0 {
+		s.CompressionRatio = float64(s.UncompressedBytes) / float64(s.CompressedBytes)
+	}
+	c.dumpMx.Lock()
+	s.LastDump = c.lastDump
+	if c.lastDumpErr != nil {
+		s.LastDumpErr = c.lastDumpErr.Error()
+	}
+	c.dumpMx.Unlock()
+	return s
+}
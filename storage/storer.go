@@ -1,70 +1,202 @@
 package storage
 
 import (
+	"context"
 	"errors"
-	"reflect"
+	"fmt"
+	"sync/atomic"
 	"time"
 )
 
 var ErrNotFound = errors.New("not found in cache")
 var ErrSubSeqType = errors.New("subsequence must be defined by string or positive integer")
 var ErrNotSequence = errors.New("returned value is not subsequence. Use Get method instead.")
-var ErrUnknownDataType = errors.New("only strings, maps and slices are supported.")
+var ErrUnknownDataType = errors.New("only strings, numbers, bools, bytes, sets, maps and slices are supported.")
+var ErrValueType = errors.New("value does not match its type")
 var ErrNegativeTTL = errors.New("ttl must be positive integer")
 var ErrDumpFail = errors.New("fail to dump data")
+var ErrUnsupportedStorer = errors.New("storer does not support this operation")
 
+// InputType is the type of a stored value, it is kept with the value
+// in REST responses and dumps.
 type InputType int
 
 const (
 	STR InputType = iota
 	ARRAY
 	MAPPING
+	// TYPED values are set by TypedCache
+	TYPED
+	INT
+	FLOAT
+	BOOL
+	BYTES
+	SET
 )
 
-type Storer interface {
+var typeNames = map[InputType]string{
+	STR:     "string",
+	ARRAY:   "array",
+	MAPPING: "mapping",
+	TYPED:   "typed",
+	INT:     "int",
+	FLOAT:   "float",
+	BOOL:    "bool",
+	BYTES:   "bytes",
+	SET:     "set",
+}
+
+func (t InputType) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Keyspace is a set of operations over a single namespace.
+type Keyspace interface {
+	Name() string
+	Len() int
+	Usage() Usage
 	Get(string) (*Value, error)
 	GetBy(string, interface{}) (interface{}, error)
-	Set(string, interface{}, time.Duration) error
+	Set(string, interface{}, time.Duration, ...string) error
 	Keys(string) []string
 	Remove(string) error
+	InvalidateTag(string) ([]string, error)
+	Flush() error
+}
+
+// Storer operates on the default namespace, other ones are reachable
+// with Select.
+type Storer interface {
+	Keyspace
+	Select(string) Keyspace
+	Namespaces() map[string]Usage
+	FlushAll() error
+	Metrics() Metrics
+	Stats() Stats
+	Ready() bool
 	Run()
-	Close()
+	Close(context.Context) error
+}
+
+// KeyspaceV2 is Keyspace with context aware operations, they return
+// ctx error once ctx is done.
+type KeyspaceV2 interface {
+	Name() string
+	Len() int
+	Usage() Usage
+	Get(context.Context, string) (*Value, error)
+	GetBy(context.Context, string, interface{}) (interface{}, error)
+	Set(context.Context, string, interface{}, time.Duration, ...string) error
+	SetBytes(context.Context, string, []byte, string, time.Duration, ...string) error
+	Expire(context.Context, string, time.Duration) error
+	Keys(context.Context, string) ([]string, error)
+	Remove(context.Context, string) error
+	InvalidateTag(context.Context, string) ([]string, error)
+	Flush(context.Context) error
+	Watch(int) (*Subscription, error)
+}
+
+// StorerV2 is Storer built on KeyspaceV2, Run reports dump load failures.
+type StorerV2 interface {
+	KeyspaceV2
+	Select(string) KeyspaceV2
+	Namespaces() map[string]Usage
+	FlushAll(context.Context) error
+	Metrics() Metrics
+	Stats() Stats
+	Ready() bool
+	Run(context.Context) error
+	Close(context.Context) error
+}
+
+// PatternError is returned by Keys for a malformed glob mask.
+type PatternError struct {
+	Pattern string
+	Err     error
+}
+
+func (e *PatternError) Error() string {
+	return fmt.Sprintf("bad key pattern %q: %s", e.Pattern, e.Err)
+}
+
+// IndexError is returned by GetBy when the sequence has no such
+// index or map key.
+type IndexError struct {
+	Key   string
+	Index interface{}
+}
+
+func (e *IndexError) Error() string {
+	return fmt.Sprintf("no index %v in %s", e.Index, e.Key)
+}
+
+// DumpError is returned by Run when the dump can't be read.
+type DumpError struct {
+	Path string
+	Err  error
+}
+
+func (e *DumpError) Error() string {
+	return fmt.Sprintf("fail to load dump %s: %s", e.Path, e.Err)
 }
 
 type Value struct {
 	Body     interface{}   `json:"body"`
 	TTL      time.Duration `json:"ttl"`
-	DataType InputType     `json:"-"`
+	DataType InputType     `json:"type"`
+	Tags     []string      `json:"tags,omitempty"`
+	// ContentType of BYTES values set with SetBytes
+	ContentType string `json:"content_type,omitempty"`
+
+	size int64
+	// packed body of compressed values, Body is nil then
+	packed     []byte
+	compressor Compressor
+	rawSize    int64
 }
 
 func newValue(data interface{}, ttl time.Duration) (*Value, error) {
 	if ttl < 0 {
 		return nil, ErrNegativeTTL
 	}
-	var dataType InputType
-	switch reflect.ValueOf(data).Kind() {
-	case reflect.String:
-		dataType = STR
-	case reflect.Slice:
-		dataType = ARRAY
-	case reflect.Map:
-		keyType := reflect.TypeOf(data).Key().Kind()
-		if keyType != reflect.String {
-			return nil, ErrUnknownDataType
-		}
-		dataType = MAPPING
-	default:
-		return nil, ErrUnknownDataType
+	data, dataType, err := normalize(data)
+	if err != nil {
+		return nil, err
 	}
 	v := &Value{
 		Body:     data,
 		TTL:      ttl,
 		DataType: dataType,
+		size:     sizeOf(data),
 	}
 	return v, nil
 }
 
+// withTTL copies v with another ttl. It doesn't read the ttl of v,
+// which is decremented by expiration concurrently.
+func (v *Value) withTTL(ttl time.Duration) *Value {
+	return &Value{
+		Body:        v.Body,
+		TTL:         ttl,
+		DataType:    v.DataType,
+		Tags:        v.Tags,
+		ContentType: v.ContentType,
+		size:        v.size,
+		packed:      v.packed,
+		compressor:  v.compressor,
+		rawSize:     v.rawSize,
+	}
+}
+
+// decrTTL counts a second off the ttl of a stored value, which is read
+// concurrently with ttl.
 func (v *Value) decrTTL() bool {
-	v.TTL -= 1 * time.Second
-	return v.TTL > 0
+	return atomic.AddInt64((*int64)(&v.TTL), -int64(time.Second)) > 0
+}
+
+func (v *Value) ttl() time.Duration {
+	return time.Duration(atomic.LoadInt64((*int64)(&v.TTL)))
 }
@@ -0,0 +1,51 @@
+package storage
+
+import "sync"
+
+// tagIndex maps tags to keys. Its lock is held exclusively by writes
+// which change tags or need the whole namespace, and shared by writes
+// of untagged values, see namespace.put.
+type tagIndex struct {
+	mx   sync.RWMutex
+	keys map[string]map[string]struct{}
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{
+		mx:   sync.RWMutex{},
+		keys: make(map[string]map[string]struct{}),
+	}
+}
+
+// tag and untag expect mx to be held by the caller
+func (t *tagIndex) tag(key string, tags []string) {
+	for _, tag := range tags {
+		keys, ok := t.keys[tag]
+		if !ok {
+			keys = make(map[string]struct{})
+			t.keys[tag] = keys
+		}
+		keys[key] = struct{}{}
+	}
+}
+
+func (t *tagIndex) untag(key string, tags []string) {
+	for _, tag := range tags {
+		keys, ok := t.keys[tag]
+		if !ok {
+			continue
+		}
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(t.keys, tag)
+		}
+	}
+}
+
+func (t *tagIndex) tagged(tag string) []string {
+	keys := make([]string, 0, len(t.keys[tag]))
+	for k := range t.keys[tag] {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"github.com/Phil192/rediq/trace"
+)
+
+// startSpan starts a span of the keyspace command as a child of the
+// request span in ctx, commands without one are not traced.
+func (n *namespace) startSpan(ctx context.Context, cmd, key string) (context.Context, trace.Span) {
+	ctx, span := trace.Start(ctx, "storage."+cmd)
+	span.SetAttribute("rediq.namespace", n.name)
+	if key != "" {
+		span.SetAttribute("rediq.key", key)
+	}
+	return ctx, span
+}
+
+// endSpan ends span failed with err, missing keys are misses
+// rather than failures.
+func endSpan(span trace.Span, err error) {
+	if err == ErrNotFound {
+		span.SetAttribute("rediq.hit", false)
+	} else {
+		span.SetError(err)
+	}
+	span.End()
+}
+
+// lock takes the tag index lock, which serializes writes to the
+// namespace, and traces the wait.
+func (n *namespace) lock(ctx context.Context) {
+	_, span := trace.Start(ctx, "storage.lock_wait")
+	n.tags.mx.Lock()
+	span.End()
+}
+
+// rlock shares the tag index lock with other writes of untagged values.
+func (n *namespace) rlock(ctx context.Context) {
+	_, span := trace.Start(ctx, "storage.lock_wait")
+	n.tags.mx.RLock()
+	span.End()
+}
+
+// startSpan starts a span of background work like dumps, it is a root
+// span of the Tracing tracer unless ctx has a span already.
+func (c *cache) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	if c.opt.Tracer == nil || trace.SpanFromContext(ctx).Context().IsValid() {
+		return trace.Start(ctx, name)
+	}
+	return trace.StartWith(ctx, c.opt.Tracer, name, trace.SpanContext{})
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+	"unsafe"
+)
+
+var (
+	ErrTypeMismatch = errors.New("stored value has another type")
+	ErrKeyType      = errors.New("key type needs TypedOptions.Key")
+)
+
+// Codec converts values of TypedCache to bytes when they leave the
+// process: in dumps and in REST responses.
+type Codec[V any] interface {
+	Encode(V) ([]byte, error)
+	Decode([]byte) (V, error)
+}
+
+// JSONCodec is the default codec of TypedCache.
+type JSONCodec[V any] struct{}
+
+func (JSONCodec[V]) Encode(v V) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[V]) Decode(data []byte) (V, error) {
+	var v V
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// TypedOptions configures TypedCache. Key converts keys to the cache
+// keys, it is required unless K is string or one of integer types, so
+// that distinct keys never share a cache key. Size estimates value size for
+// MaxBytes quota, by default it is the length of strings and byte slices
+// and the shallow size of other types.
+type TypedOptions[K comparable, V any] struct {
+	Namespace string
+	Key       func(K) string
+	Size      func(V) int64
+	Codec     Codec[V]
+}
+
+// TypedCache stores values of type V under keys of type K in a namespace
+// of the cache, sharing its sharding, quotas, eviction and expiration.
+// Values are kept as is, codec is only used for dumps and the wire.
+type TypedCache[K comparable, V any] struct {
+	ns  *namespace
+	opt TypedOptions[K, V]
+}
+
+func NewTypedCache[K comparable, V any](s StorerV2, opt TypedOptions[K, V]) (*TypedCache[K, V], error) {
+	c, ok := s.(*cache)
+	if !ok {
+		return nil, ErrUnsupportedStorer
+	}
+	if opt.Key == nil {
+		var zero K
+		if _, ok := typedKey(zero); !ok {
+			return nil, ErrKeyType
+		}
+		opt.Key = func(key K) string {
+			k, _ := typedKey(key)
+			return k
+		}
+	}
+	if opt.Size == nil {
+		opt.Size = typedSize[V]
+	}
+	if opt.Codec == nil {
+		opt.Codec = JSONCodec[V]{}
+	}
+	return &TypedCache[K, V]{ns: c.namespace(opt.Namespace), opt: opt}, nil
+}
+
+func (t *TypedCache[K, V]) Namespace() string {
+	return t.ns.name
+}
+
+func (t *TypedCache[K, V]) Len() int {
+	return t.ns.Len()
+}
+
+func (t *TypedCache[K, V]) Set(ctx context.Context, key K, val V, ttl time.Duration, tags ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ttl < 0 {
+		return ErrNegativeTTL
+	}
+	if err := t.ns.acquire(); err != nil {
+		return err
+	}
+	if ttl == 0 {
+		ttl = t.ns.options().DefaultTTL
+	}
+	v := &Value{
+		Body:     typedBody[V]{val: val, codec: t.opt.Codec},
+		TTL:      ttl,
+		DataType: TYPED,
+		Tags:     tags,
+		size:     t.opt.Size(val),
+	}
+	return t.ns.put(ctx, t.opt.Key(key), v)
+}
+
+// Get returns ErrTypeMismatch if the key holds a value set through
+// the untyped API or a value the codec fails to decode.
+func (t *TypedCache[K, V]) Get(ctx context.Context, key K) (V, error) {
+	var zero V
+	v, err := t.ns.Get(ctx, t.opt.Key(key))
+	if err != nil {
+		return zero, err
+	}
+	switch body := v.Body.(type) {
+	case typedBody[V]:
+		return body.val, nil
+	case []byte:
+		// value loaded from the dump
+		val, err := t.opt.Codec.Decode(body)
+		if err != nil {
+			return zero, ErrTypeMismatch
+		}
+		return val, nil
+	}
+	return zero, ErrTypeMismatch
+}
+
+func (t *TypedCache[K, V]) Remove(ctx context.Context, key K) error {
+	return t.ns.Remove(ctx, t.opt.Key(key))
+}
+
+// typedBody is the body of values set by TypedCache, it is encoded
+// with the codec as base64 json string.
+type typedBody[V any] struct {
+	val   V
+	codec Codec[V]
+}
+
+func (b typedBody[V]) MarshalJSON() ([]byte, error) {
+	data, err := b.codec.Encode(b.val)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(data)
+}
+
+func typedKey[K comparable](key K) (string, bool) {
+	switch k := any(key).(type) {
+	case string:
+		return k, true
+	case int:
+		return strconv.Itoa(k), true
+	case int64:
+		return strconv.FormatInt(k, 10), true
+	case int32:
+		return strconv.FormatInt(int64(k), 10), true
+	case int16:
+		return strconv.FormatInt(int64(k), 10), true
+	case int8:
+		return strconv.FormatInt(int64(k), 10), true
+	case uint:
+		return strconv.FormatUint(uint64(k), 10), true
+	case uint64:
+		return strconv.FormatUint(k, 10), true
+	case uint32:
+		return strconv.FormatUint(uint64(k), 10), true
+	case uint16:
+		return strconv.FormatUint(uint64(k), 10), true
+	case uint8:
+		return strconv.FormatUint(uint64(k), 10), true
+	}
+	return "", false
+}
+
+func typedSize[V any](val V) int64 {
+	switch v := any(val).(type) {
+	case string:
+		return int64(len(v))
+	case []byte:
+		return int64(len(v))
+	}
+	return int64(unsafe.Sizeof(val))
+}
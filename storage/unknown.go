@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrNamespaceNotFound = errors.New("namespace not found")
+
+// unknownNamespace is selected by a name which has no namespace yet.
+// Reads fail without creating it until the first write creates the
+// namespace, so reading random names doesn't grow the cache.
+type unknownNamespace struct {
+	name string
+	c    *cache
+}
+
+// lookup returns the namespace if it is created by now.
+func (u *unknownNamespace) lookup() *namespace {
+	u.c.mx.Lock()
+	defer u.c.mx.Unlock()
+	return u.c.spaces[u.name]
+}
+
+func (u *unknownNamespace) Name() string {
+	return u.name
+}
+
+func (u *unknownNamespace) Len() int {
+	if ns := u.lookup(); ns != nil {
+		return ns.Len()
+	}
+	return 0
+}
+
+func (u *unknownNamespace) Usage() Usage {
+	if ns := u.lookup(); ns != nil {
+		return ns.Usage()
+	}
+	return Usage{}
+}
+
+func (u *unknownNamespace) Get(ctx context.Context, key string) (*Value, error) {
+	if ns := u.lookup(); ns != nil {
+		return ns.Get(ctx, key)
+	}
+	return nil, ErrNamespaceNotFound
+}
+
+func (u *unknownNamespace) GetBy(ctx context.Context, key string, subSeq interface{}) (interface{}, error) {
+	if ns := u.lookup(); ns != nil {
+		return ns.GetBy(ctx, key, subSeq)
+	}
+	return nil, ErrNamespaceNotFound
+}
+
+func (u *unknownNamespace) Set(ctx context.Context, key string, data interface{}, ttl time.Duration, tags ...string) error {
+	return u.c.namespace(u.name).Set(ctx, key, data, ttl, tags...)
+}
+
+func (u *unknownNamespace) SetBytes(ctx context.Context, key string, data []byte, contentType string, ttl time.Duration, tags ...string) error {
+	return u.c.namespace(u.name).SetBytes(ctx, key, data, contentType, ttl, tags...)
+}
+
+func (u *unknownNamespace) Keys(ctx context.Context, mask string) ([]string, error) {
+	if ns := u.lookup(); ns != nil {
+		return ns.Keys(ctx, mask)
+	}
+	return nil, ErrNamespaceNotFound
+}
+
+func (u *unknownNamespace) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	if ns := u.lookup(); ns != nil {
+		return ns.Expire(ctx, key, ttl)
+	}
+	return ErrNamespaceNotFound
+}
+
+// Watch of a missing namespace doesn't create it, the subscription gets
+// changes once a write creates the namespace.
+func (u *unknownNamespace) Watch(buffer int) (*Subscription, error) {
+	u.c.mx.Lock()
+	defer u.c.mx.Unlock()
+	if ns, ok := u.c.spaces[u.name]; ok {
+		return ns.Watch(buffer)
+	}
+	w, ok := u.c.pending[u.name]
+	if !ok {
+		w = newWatchers()
+		w.release = func() { u.c.release(u.name, w) }
+		u.c.pending[u.name] = w
+	}
+	return w.subscribe(buffer), nil
+}
+
+// takeWatchers returns the pending watchers of a namespace being created
+// or new ones, it must be called with mx locked.
+func (c *cache) takeWatchers(name string) *watchers {
+	if w, ok := c.pending[name]; ok {
+		delete(c.pending, name)
+		return w
+	}
+	return newWatchers()
+}
+
+// release forgets pending watchers once the last of them is closed.
+func (c *cache) release(name string, w *watchers) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.pending[name] == w && w.empty() {
+		delete(c.pending, name)
+	}
+}
+
+// Remove, InvalidateTag and Flush of a missing namespace have nothing
+// to drop, like on an empty one.
+func (u *unknownNamespace) Remove(ctx context.Context, key string) error {
+	if ns := u.lookup(); ns != nil {
+		return ns.Remove(ctx, key)
+	}
+	return nil
+}
+
+func (u *unknownNamespace) InvalidateTag(ctx context.Context, tag string) ([]string, error) {
+	if ns := u.lookup(); ns != nil {
+		return ns.InvalidateTag(ctx, tag)
+	}
+	return []string{}, nil
+}
+
+func (u *unknownNamespace) Flush(ctx context.Context) error {
+	if ns := u.lookup(); ns != nil {
+		return ns.Flush(ctx)
+	}
+	return nil
+}
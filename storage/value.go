@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// StringSet is the Go representation of SET values.
+type StringSet map[string]struct{}
+
+func NewStringSet(members ...string) StringSet {
+	s := make(StringSet, len(members))
+	for _, m := range members {
+		s[m] = struct{}{}
+	}
+	return s
+}
+
+// Members returns sorted members of the set.
+func (s StringSet) Members() []string {
+	members := make([]string, 0, len(s))
+	for m := range s {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members
+}
+
+func (s StringSet) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Members())
+}
+
+func (t InputType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+// UnmarshalJSON accepts type names as well as numbers of old dumps.
+func (t *InputType) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		var n int
+		if err := json.Unmarshal(data, &n); err != nil {
+			return err
+		}
+		*t = InputType(n)
+		return nil
+	}
+	parsed, err := ParseType(name)
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+func ParseType(name string) (InputType, error) {
+	for t, n := range typeNames {
+		if n == name {
+			return t, nil
+		}
+	}
+	return 0, ErrUnknownDataType
+}
+
+// TypeOf returns the type data would be stored with.
+func TypeOf(data interface{}) (InputType, error) {
+	_, t, err := normalize(data)
+	return t, err
+}
+
+// normalize converts data to the Go representation of its type:
+// integers to int64, floats to float64, json numbers to either of them.
+func normalize(data interface{}) (interface{}, InputType, error) {
+	switch d := data.(type) {
+	case string:
+		return d, STR, nil
+	case []byte:
+		return d, BYTES, nil
+	case StringSet:
+		return d, SET, nil
+	case bool:
+		return d, BOOL, nil
+	case json.Number:
+		if i, err := d.Int64(); err == nil {
+			return i, INT, nil
+		}
+		f, err := d.Float64()
+		if err != nil {
+			return nil, 0, ErrValueType
+		}
+		return f, FLOAT, nil
+	case []interface{}:
+		return normalizeJSON(d), ARRAY, nil
+	case map[string]interface{}:
+		return normalizeJSON(d), MAPPING, nil
+	}
+	v := reflect.ValueOf(data)
+	switch v.Kind() {
+	case reflect.String:
+		return data, STR, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), INT, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint()), INT, nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), FLOAT, nil
+	case reflect.Slice:
+		return data, ARRAY, nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, 0, ErrUnknownDataType
+		}
+		return data, MAPPING, nil
+	}
+	return nil, 0, ErrUnknownDataType
+}
+
+// normalizeJSON replaces json numbers nested in decoded lists and maps.
+func normalizeJSON(data interface{}) interface{} {
+	switch d := data.(type) {
+	case json.Number:
+		v, _, err := normalize(d)
+		if err != nil {
+			return d.String()
+		}
+		return v
+	case []interface{}:
+		list := make([]interface{}, len(d))
+		for i, item := range d {
+			list[i] = normalizeJSON(item)
+		}
+		return list
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(d))
+		for k, item := range d {
+			m[k] = normalizeJSON(item)
+		}
+		return m
+	}
+	return data
+}
+
+// Convert turns body decoded from json with UseNumber into the Go
+// representation of typ. Bytes are expected as base64 string, set as
+// list of strings. TYPED values can only be set by TypedCache.
+func Convert(body interface{}, typ InputType) (interface{}, error) {
+	switch typ {
+	case STR:
+		if s, ok := body.(string); ok {
+			return s, nil
+		}
+	case INT:
+		switch n := body.(type) {
+		case json.Number:
+			if i, err := n.Int64(); err == nil {
+				return i, nil
+			}
+		case string:
+			if i, err := strconv.ParseInt(n, 10, 64); err == nil {
+				return i, nil
+			}
+		}
+	case FLOAT:
+		switch n := body.(type) {
+		case json.Number:
+			if f, err := n.Float64(); err == nil {
+				return f, nil
+			}
+		case string:
+			if f, err := strconv.ParseFloat(n, 64); err == nil {
+				return f, nil
+			}
+		}
+	case BOOL:
+		if b, ok := body.(bool); ok {
+			return b, nil
+		}
+	case BYTES:
+		if s, ok := body.(string); ok {
+			if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+				return b, nil
+			}
+		}
+	case SET:
+		if list, ok := body.([]interface{}); ok {
+			set := make(StringSet, len(list))
+			for _, item := range list {
+				m, ok := item.(string)
+				if !ok {
+					return nil, ErrValueType
+				}
+				set[m] = struct{}{}
+			}
+			return set, nil
+		}
+	case ARRAY:
+		if list, ok := body.([]interface{}); ok {
+			return normalizeJSON(list), nil
+		}
+	case MAPPING:
+		if m, ok := body.(map[string]interface{}); ok {
+			return normalizeJSON(m), nil
+		}
+	}
+	return nil, ErrValueType
+}
+
+// UnmarshalJSON restores the body with its type, values without type
+// come from old dumps and get the type of json body.
+func (v *Value) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Body     json.RawMessage `json:"body"`
+		TTL      time.Duration   `json:"ttl"`
+		DataType *InputType      `json:"type"`
+		Tags     []string        `json:"tags"`
+
+		ContentType string `json:"content_type"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	var body interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw.Body))
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		return err
+	}
+	var err error
+	switch {
+	case raw.DataType == nil:
+		body, v.DataType, err = normalize(body)
+	case *raw.DataType == TYPED:
+		// decoded once here, the codec is applied by TypedCache.Get
+		v.DataType = TYPED
+		body, err = Convert(body, BYTES)
+	default:
+		v.DataType = *raw.DataType
+		body, err = Convert(body, v.DataType)
+	}
+	if err != nil {
+		return err
+	}
+	v.Body = body
+	v.TTL = raw.TTL
+	v.Tags = raw.Tags
+	v.ContentType = raw.ContentType
+	return nil
+}
@@ -0,0 +1,92 @@
+package storage
+
+import "sync"
+
+// ChangeOp tells how a key has changed.
+type ChangeOp string
+
+const (
+	ChangeSet     ChangeOp = "set"
+	ChangeTTL     ChangeOp = "ttl"
+	ChangeRemove  ChangeOp = "remove"
+	ChangeExpired ChangeOp = "expired"
+	ChangeEvicted ChangeOp = "evicted"
+	// ChangeFlush drops every key of the namespace, it has no key.
+	ChangeFlush ChangeOp = "flush"
+)
+
+// Change of a key, it is published after the change is applied.
+type Change struct {
+	Namespace string   `json:"ns,omitempty"`
+	Key       string   `json:"key,omitempty"`
+	Op        ChangeOp `json:"op"`
+}
+
+// Subscription delivers changes of one namespace in order. Publishers
+// never wait for subscribers: once the buffer of a subscription is full
+// its channel is closed, and the subscriber must forget everything it
+// knows about the namespace and subscribe again.
+type Subscription struct {
+	ch chan Change
+	w  *watchers
+}
+
+// Changes is closed by Close or when the subscriber falls behind.
+func (s *Subscription) Changes() <-chan Change {
+	return s.ch
+}
+
+func (s *Subscription) Close() {
+	s.w.unsubscribe(s)
+}
+
+type watchers struct {
+	mx   sync.Mutex
+	subs map[*Subscription]struct{}
+	// release is called once the last subscription is closed
+	release func()
+}
+
+func newWatchers() *watchers {
+	return &watchers{subs: make(map[*Subscription]struct{})}
+}
+
+func (w *watchers) subscribe(buffer int) *Subscription {
+	s := &Subscription{ch: make(chan Change, buffer), w: w}
+	w.mx.Lock()
+	w.subs[s] = struct{}{}
+	w.mx.Unlock()
+	return s
+}
+
+func (w *watchers) unsubscribe(s *Subscription) {
+	w.mx.Lock()
+	if _, ok := w.subs[s]; ok {
+		delete(w.subs, s)
+		close(s.ch)
+	}
+	empty := len(w.subs) == 0
+	w.mx.Unlock()
+	if empty && w.release != nil {
+		w.release()
+	}
+}
+
+func (w *watchers) empty() bool {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return len(w.subs) == 0
+}
+
+func (w *watchers) publish(c Change) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	for s := range w.subs {
+		select {
+		case s.ch <- c:
+		default:
+			delete(w.subs, s)
+			close(s.ch)
+		}
+	}
+}
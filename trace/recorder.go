@@ -0,0 +1,105 @@
+package trace
+
+import (
+	"sync"
+	"time"
+)
+
+// RecordedSpan is an ended span kept by Recorder.
+type RecordedSpan struct {
+	Name       string
+	Context    SpanContext
+	Parent     SpanContext
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Err        error
+}
+
+// Recorder is a Tracer keeping ended spans in memory.
+type Recorder struct {
+	mx    sync.Mutex
+	spans []RecordedSpan
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+func (r *Recorder) Start(parent SpanContext, name string) Span {
+	return &recordedSpan{
+		recorder: r,
+		span: RecordedSpan{
+			Name:       name,
+			Context:    NewSpanContext(parent),
+			Parent:     parent,
+			Start:      time.Now(),
+			Attributes: make(map[string]interface{}),
+		},
+	}
+}
+
+// Spans returns ended spans in the order they ended.
+func (r *Recorder) Spans() []RecordedSpan {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return append([]RecordedSpan(nil), r.spans...)
+}
+
+// Find returns the first ended span with the name.
+func (r *Recorder) Find(name string) (RecordedSpan, bool) {
+	for _, s := range r.Spans() {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return RecordedSpan{}, false
+}
+
+func (r *Recorder) Reset() {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.spans = nil
+}
+
+type recordedSpan struct {
+	mx       sync.Mutex
+	recorder *Recorder
+	span     RecordedSpan
+	ended    bool
+}
+
+func (s *recordedSpan) Context() SpanContext {
+	return s.span.Context
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.span.Attributes[key] = value
+}
+
+func (s *recordedSpan) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.span.Err = err
+}
+
+func (s *recordedSpan) End() {
+	s.mx.Lock()
+	if s.ended {
+		s.mx.Unlock()
+		return
+	}
+	s.ended = true
+	s.span.End = time.Now()
+	span := s.span
+	s.mx.Unlock()
+
+	s.recorder.mx.Lock()
+	defer s.recorder.mx.Unlock()
+	s.recorder.spans = append(s.recorder.spans, span)
+}
@@ -0,0 +1,149 @@
+// Package trace propagates W3C trace context between the client and
+// the server and starts spans with a pluggable Tracer. Tracers of
+// OpenTelemetry or other systems are plugged in by implementing Tracer,
+// Recorder keeps spans in memory for tests.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Header carries the trace context of requests.
+const Header = "traceparent"
+
+var ErrTraceparent = errors.New("malformed traceparent")
+
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanContext identifies a span across processes.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether both ids are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats sc as the traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses the header value of version 00, later
+// versions are parsed the same way as the spec requires.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		(parts[0] == "00" && len(parts) != 4) || len(parts[3]) != 2 {
+		return sc, ErrTraceparent
+	}
+	if n, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil || n != len(sc.TraceID) || len(parts[1]) != 32 {
+		return sc, ErrTraceparent
+	}
+	if n, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil || n != len(sc.SpanID) || len(parts[2]) != 16 {
+		return sc, ErrTraceparent
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || !sc.IsValid() {
+		return sc, ErrTraceparent
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// NewSpanContext returns a child of parent, or a new sampled trace if
+// parent is invalid.
+func NewSpanContext(parent SpanContext) SpanContext {
+	sc := SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled}
+	if !parent.IsValid() {
+		rand.Read(sc.TraceID[:])
+		sc.Sampled = true
+	}
+	rand.Read(sc.SpanID[:])
+	return sc
+}
+
+// Span is a traced operation, it must be ended.
+type Span interface {
+	Context() SpanContext
+	SetAttribute(key string, value interface{})
+	// SetError marks the span failed, nil is ignored.
+	SetError(err error)
+	End()
+}
+
+// Tracer starts spans, parent is invalid for root spans.
+type Tracer interface {
+	Start(parent SpanContext, name string) Span
+}
+
+type noopSpan struct{}
+
+func (noopSpan) Context() SpanContext             { return SpanContext{} }
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) SetError(error)                   {}
+func (noopSpan) End()                             {}
+
+type spanKey struct{}
+
+type active struct {
+	tracer Tracer
+	span   Span
+}
+
+// ContextWithSpan returns ctx carrying span, its children are started
+// with t.
+func ContextWithSpan(ctx context.Context, t Tracer, span Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, active{tracer: t, span: span})
+}
+
+// SpanFromContext returns the span of ctx or a span doing nothing.
+func SpanFromContext(ctx context.Context) Span {
+	if a, ok := ctx.Value(spanKey{}).(active); ok {
+		return a.span
+	}
+	return noopSpan{}
+}
+
+// Start starts a child of the span in ctx with the same tracer. Without
+// a span in ctx nothing is traced.
+func Start(ctx context.Context, name string) (context.Context, Span) {
+	a, ok := ctx.Value(spanKey{}).(active)
+	if !ok {
+		return ctx, noopSpan{}
+	}
+	return StartWith(ctx, a.tracer, name, SpanContext{})
+}
+
+// StartWith starts a span with t as a child of the span in ctx or, if
+// there is none, of the remote parent, which may be invalid.
+func StartWith(ctx context.Context, t Tracer, name string, remote SpanContext) (context.Context, Span) {
+	parent := SpanFromContext(ctx).Context()
+	if !parent.IsValid() {
+		parent = remote
+	}
+	span := t.Start(parent, name)
+	return ContextWithSpan(ctx, t, span), span
+}
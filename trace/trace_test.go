@@ -0,0 +1,58 @@
+package trace
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestTraceparent(t *testing.T) {
+	r := require.New(t)
+	h := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(h)
+	r.NoError(err)
+	r.Equal("4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	r.Equal("00f067aa0ba902b7", sc.SpanID.String())
+	r.True(sc.Sampled)
+	r.Equal(h, sc.Traceparent())
+
+	_, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future")
+	r.NoError(err)
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-x",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bz-01",
+	} {
+		_, err := ParseTraceparent(bad)
+		r.Equal(ErrTraceparent, err, bad)
+	}
+}
+
+func TestStart(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+	_, span := Start(ctx, "untraced")
+	r.False(span.Context().IsValid())
+	span.End()
+
+	rec := NewRecorder()
+	remote := NewSpanContext(SpanContext{})
+	ctx, root := StartWith(ctx, rec, "root", remote)
+	_, child := Start(ctx, "child")
+	child.SetAttribute("k", 1)
+	child.End()
+	child.End()
+	root.End()
+
+	spans := rec.Spans()
+	r.Len(spans, 2)
+	r.Equal("child", spans[0].Name)
+	r.Equal(1, spans[0].Attributes["k"])
+	r.Equal(root.Context(), spans[0].Parent)
+	r.Equal(remote, spans[1].Parent)
+	r.Equal(remote.TraceID, spans[0].Context.TraceID)
+}